@@ -0,0 +1,232 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Role - роль пользователя бота
+type Role string
+
+const (
+	RoleOwner   Role = "owner"   // Владелец: все возможности
+	RoleAdmin   Role = "admin"   // Администратор: без лимитов, управление пользователями
+	RoleMember  Role = "member"  // Обычный пользователь с дневным лимитом
+	RoleBlocked Role = "blocked" // Заблокирован, сообщения не обрабатываются
+)
+
+// Permission - отдельная возможность бота
+type Permission string
+
+const (
+	PermChat      Permission = "chat"      // Разговор с ChatGPT и озвучивание
+	PermThoughts  Permission = "thoughts"  // Сохранение мыслей
+	PermDatabase  Permission = "database"  // Запросы к БД на естественном языке
+	PermUnlimited Permission = "unlimited" // Без дневного лимита
+	PermAdmin     Permission = "admin"     // Управление пользователями и лимитами
+	PermPersonas  Permission = "personas"  // Создание и изменение персон ChatGPT
+)
+
+// rolePermissions - какие возможности есть у каждой роли
+var rolePermissions = map[Role][]Permission{
+	RoleOwner:   {PermChat, PermThoughts, PermDatabase, PermUnlimited, PermAdmin, PermPersonas},
+	RoleAdmin:   {PermChat, PermDatabase, PermUnlimited, PermAdmin},
+	RoleMember:  {PermChat, PermDatabase},
+	RoleBlocked: {},
+}
+
+// User - пользователь бота из таблицы users
+type User struct {
+	ID        int64
+	Username  string
+	FirstName string
+	Role      Role
+}
+
+// Can проверяет, есть ли у пользователя возможность
+func (u *User) Can(perm Permission) bool {
+	if u == nil {
+		return false
+	}
+	for _, p := range rolePermissions[u.Role] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// DisplayName возвращает username, а если его нет - имя пользователя
+func (u *User) DisplayName() string {
+	if u.Username != "" {
+		return u.Username
+	}
+	return u.FirstName
+}
+
+// parseRole проверяет название роли
+func parseRole(name string) (Role, error) {
+	role := Role(strings.ToLower(strings.TrimSpace(name)))
+	if _, ok := rolePermissions[role]; !ok {
+		return "", fmt.Errorf("неизвестная роль %q", name)
+	}
+	return role, nil
+}
+
+// ensureUser регистрирует пользователя при первом сообщении, обновляет его имя
+// и возвращает запись с ролью
+func ensureUser(from *tgbotapi.User) (*User, error) {
+	_, err := db.Exec(`
+	INSERT INTO users (user_id, username, first_name, role, created_at, updated_at)
+	VALUES (?, ?, ?, 'member', datetime('now'), datetime('now'))
+	ON CONFLICT(user_id) DO UPDATE SET
+		username = excluded.username,
+		first_name = excluded.first_name,
+		updated_at = excluded.updated_at
+	`, from.ID, from.UserName, from.FirstName)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка регистрации пользователя: %v", err)
+	}
+
+	return getUser(from.ID)
+}
+
+// getUser возвращает пользователя по Telegram ID
+func getUser(userID int64) (*User, error) {
+	user := &User{ID: userID}
+	var username, firstName sql.NullString
+	var role string
+
+	err := db.QueryRow(
+		`SELECT username, first_name, role FROM users WHERE user_id = ?`, userID,
+	).Scan(&username, &firstName, &role)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("пользователь %d не найден", userID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения пользователя: %v", err)
+	}
+
+	user.Username = username.String
+	user.FirstName = firstName.String
+	user.Role = Role(role)
+	return user, nil
+}
+
+// setUserRole назначает роль пользователю, создавая запись при необходимости
+func setUserRole(userID int64, role Role) error {
+	_, err := db.Exec(`
+	INSERT INTO users (user_id, role, created_at, updated_at)
+	VALUES (?, ?, datetime('now'), datetime('now'))
+	ON CONFLICT(user_id) DO UPDATE SET
+		role = excluded.role,
+		updated_at = excluded.updated_at
+	`, userID, string(role))
+	if err != nil {
+		return fmt.Errorf("ошибка изменения роли: %v", err)
+	}
+	return nil
+}
+
+// parseUserIDs разбирает список Telegram ID через запятую
+func parseUserIDs(value string) ([]int64, error) {
+	var ids []int64
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(part, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("некорректный Telegram ID %q", part)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// bootstrapOwners назначает роль владельца пользователям из BOT_OWNER_IDS, а владельцев,
+// которых в списке больше нет, делает обычными пользователями. Роль владельца
+// меняется только здесь, поэтому список в переменной - единственный источник владельцев
+func bootstrapOwners() error {
+	ids, err := parseUserIDs(getEnv("BOT_OWNER_IDS", ""))
+	if err != nil {
+		return fmt.Errorf("ошибка разбора BOT_OWNER_IDS: %v", err)
+	}
+
+	owners := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		owners[id] = true
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("ошибка начала транзакции: %v", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT user_id FROM users WHERE role = ?`, string(RoleOwner))
+	if err != nil {
+		return fmt.Errorf("ошибка чтения владельцев: %v", err)
+	}
+	var removed []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return fmt.Errorf("ошибка чтения владельцев: %v", err)
+		}
+		if !owners[id] {
+			removed = append(removed, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("ошибка чтения владельцев: %v", err)
+	}
+
+	for _, id := range removed {
+		if _, err := tx.Exec(`UPDATE users SET role = ?, updated_at = datetime('now') WHERE user_id = ?`,
+			string(RoleMember), id); err != nil {
+			return fmt.Errorf("ошибка изменения роли: %v", err)
+		}
+		log.Printf("👤 Пользователь %d больше не владелец: его нет в BOT_OWNER_IDS", id)
+	}
+
+	for _, id := range ids {
+		_, err := tx.Exec(`
+		INSERT INTO users (user_id, role, created_at, updated_at)
+		VALUES (?, ?, datetime('now'), datetime('now'))
+		ON CONFLICT(user_id) DO UPDATE SET
+			role = excluded.role,
+			updated_at = excluded.updated_at
+		`, id, string(RoleOwner))
+		if err != nil {
+			return fmt.Errorf("ошибка изменения роли: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("ошибка назначения владельцев: %v", err)
+	}
+
+	if len(ids) == 0 {
+		log.Printf("⚠️  BOT_OWNER_IDS не задан, владельцев бота нет")
+		return nil
+	}
+	log.Printf("👑 Владельцы бота: %v", ids)
+	return nil
+}
+
+// intentPermission - какая возможность нужна для каждого намерения
+var intentPermission = map[Intent]Permission{
+	IntentChat:     PermChat,
+	IntentSpeak:    PermChat,
+	IntentThought:  PermThoughts,
+	IntentDatabase: PermDatabase,
+}
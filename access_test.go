@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestBootstrapOwners(t *testing.T) {
+	openTestDB(t)
+	if _, err := db.Exec(`INSERT INTO users (user_id, role) VALUES (1, 'owner'), (2, 'owner'), (3, 'admin'), (4, 'member')`); err != nil {
+		t.Fatal(err)
+	}
+
+	// 2 убрали из списка, 3 и 5 добавили
+	t.Setenv("BOT_OWNER_IDS", "1, 3,5")
+	if err := bootstrapOwners(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[int64]Role{1: RoleOwner, 2: RoleMember, 3: RoleOwner, 4: RoleMember, 5: RoleOwner}
+	for id, role := range want {
+		var got string
+		if err := db.QueryRow(`SELECT role FROM users WHERE user_id = ?`, id).Scan(&got); err != nil {
+			t.Fatalf("пользователь %d: %v", id, err)
+		}
+		if Role(got) != role {
+			t.Errorf("роль пользователя %d = %s; ожидалось %s", id, got, role)
+		}
+	}
+}
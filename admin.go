@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// adminCommands - команды, доступные владельцу и администраторам
+var adminCommands = map[string]bool{
+	"users":      true,
+	"grant":      true,
+	"revoke":     true,
+	"block":      true,
+	"setplan":    true,
+	"setlimit":   true,
+	"resetlimit": true,
+	"broadcast":  true,
+}
+
+// adminHelp - справка по командам администратора
+const adminHelp = "🛠 Команды администратора:\n\n" +
+	"/users - список пользователей\n" +
+	"/grant <пользователь> [admin|member] - назначить роль (по умолчанию admin)\n" +
+	"/revoke <пользователь> - вернуть роль member (снимает и блокировку)\n" +
+	"/block <пользователь> - заблокировать\n" +
+	"/setplan <пользователь> <план> - назначить план квоты\n" +
+	"/setlimit <пользователь> <ед.|default> - дневной лимит в единицах квоты (дробные - через точку)\n" +
+	"/resetlimit <пользователь> - обнулить расход за сегодня\n" +
+	"/broadcast <текст> - сообщение всем пользователям\n\n" +
+	"Пользователь указывается как Telegram ID или @username"
+
+// recordAudit записывает действие администратора в журнал
+func recordAudit(admin *User, action string, targetUserID int64, details string) {
+	var target interface{}
+	if targetUserID != 0 {
+		target = targetUserID
+	}
+
+	_, err := db.Exec(`
+	INSERT INTO admin_audit_log (timestamp, admin_id, admin_username, action, target_user_id, details)
+	VALUES (datetime('now'), ?, ?, ?, ?, ?)
+	`, admin.ID, admin.DisplayName(), action, target, details)
+	if err != nil {
+		log.Printf("⚠️ Ошибка записи в журнал аудита: %v", err)
+		return
+	}
+	log.Printf("🛠 [%s] %s %v %s", admin.DisplayName(), action, target, details)
+}
+
+// resolveUser находит пользователя по Telegram ID или @username.
+// Username в Telegram может перейти к другому аккаунту, поэтому в таблице он бывает
+// у нескольких пользователей - тогда нужно указать ID
+func resolveUser(ref string) (*User, error) {
+	ref = strings.TrimSpace(ref)
+	if ref == "" {
+		return nil, fmt.Errorf("не указан пользователь")
+	}
+
+	if id, err := strconv.ParseInt(ref, 10, 64); err == nil {
+		return getUser(id)
+	}
+
+	username := strings.TrimPrefix(ref, "@")
+	rows, err := db.Query(
+		`SELECT user_id FROM users WHERE username = ? COLLATE NOCASE ORDER BY updated_at DESC`, username,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка поиска пользователя: %v", err)
+	}
+	defer rows.Close()
+
+	var ids []string
+	var userID int64
+	for rows.Next() {
+		if err := rows.Scan(&userID); err != nil {
+			return nil, fmt.Errorf("ошибка поиска пользователя: %v", err)
+		}
+		ids = append(ids, strconv.FormatInt(userID, 10))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ошибка поиска пользователя: %v", err)
+	}
+
+	switch len(ids) {
+	case 0:
+		return nil, fmt.Errorf("пользователь %s не найден", ref)
+	case 1:
+		return getUser(userID)
+	default:
+		return nil, fmt.Errorf("%s был у нескольких пользователей (%s), укажите ID", ref, strings.Join(ids, ", "))
+	}
+}
+
+// handleAdminCommand обрабатывает команды администратора
+func handleAdminCommand(bot *tgbotapi.BotAPI, admin *User, message *tgbotapi.Message) {
+	reply := func(text string) {
+		bot.Send(tgbotapi.NewMessage(message.Chat.ID, text))
+	}
+
+	if !admin.Can(PermAdmin) {
+		log.Printf("🚫 Пользователь %s (%d) пытался выполнить /%s", admin.DisplayName(), admin.ID, message.Command())
+		reply("❌ У вас нет доступа к этой функции")
+		return
+	}
+
+	args := strings.Fields(message.CommandArguments())
+
+	switch message.Command() {
+	case "users":
+		text, err := listUsers()
+		if err != nil {
+			log.Printf("Ошибка списка пользователей: %v", err)
+			reply("❌ Ошибка получения списка пользователей")
+			return
+		}
+		reply(text)
+
+	case "grant", "revoke", "block":
+		if len(args) == 0 {
+			reply(adminHelp)
+			return
+		}
+
+		role := RoleAdmin
+		switch message.Command() {
+		case "revoke":
+			role = RoleMember
+		case "block":
+			role = RoleBlocked
+		default:
+			if len(args) > 1 {
+				parsed, err := parseRole(args[1])
+				if err != nil || parsed == RoleOwner || parsed == RoleBlocked {
+					reply("❌ Можно назначить только роль admin или member")
+					return
+				}
+				role = parsed
+			}
+		}
+
+		target, err := resolveUser(args[0])
+		if err != nil {
+			reply(fmt.Sprintf("❌ %v", err))
+			return
+		}
+
+		if err := checkRoleChange(admin, target, role); err != nil {
+			reply(fmt.Sprintf("❌ %v", err))
+			return
+		}
+
+		if err := setUserRole(target.ID, role); err != nil {
+			log.Printf("Ошибка изменения роли: %v", err)
+			reply("❌ Ошибка изменения роли")
+			return
+		}
+		recordAudit(admin, message.Command(), target.ID, fmt.Sprintf("%s → %s", target.Role, role))
+		reply(fmt.Sprintf("✅ %s: роль %s → %s", formatUserRef(target), target.Role, role))
+
+	case "setplan":
+		if len(args) < 2 {
+			reply(adminHelp + "\n\nПланы: " + strings.Join(listPlanNames(), ", "))
+			return
+		}
+
+		target, err := resolveUser(args[0])
+		if err != nil {
+			reply(fmt.Sprintf("❌ %v", err))
+			return
+		}
+
+		if err := setUserPlan(target.ID, args[1]); err != nil {
+			reply(fmt.Sprintf("❌ %v", err))
+			return
+		}
+		recordAudit(admin, "setplan", target.ID, "plan="+args[1])
+		reply(fmt.Sprintf("✅ %s: план %s", formatUserRef(target), args[1]))
+
+	case "setlimit":
+		if len(args) < 2 {
+			reply(adminHelp)
+			return
+		}
+
+		limit := -1.0
+		if args[1] != "default" {
+			parsed, err := strconv.ParseFloat(args[1], 64)
+			if err != nil || parsed < 0 {
+				reply("❌ Лимит - неотрицательное число единиц квоты или default")
+				return
+			}
+			limit = parsed
+		}
+
+		target, err := resolveUser(args[0])
+		if err != nil {
+			reply(fmt.Sprintf("❌ %v", err))
+			return
+		}
+
+		if err := setUserDailyLimit(target, limit); err != nil {
+			log.Printf("Ошибка изменения лимита: %v", err)
+			reply("❌ Ошибка изменения лимита")
+			return
+		}
+		recordAudit(admin, "setlimit", target.ID, "daily_units="+args[1])
+		if limit < 0 {
+			reply(fmt.Sprintf("✅ %s: дневной лимит по плану", formatUserRef(target)))
+		} else {
+			reply(fmt.Sprintf("✅ %s: дневной лимит %g ед.", formatUserRef(target), limit))
+		}
+
+	case "resetlimit":
+		if len(args) == 0 {
+			reply(adminHelp)
+			return
+		}
+
+		target, err := resolveUser(args[0])
+		if err != nil {
+			reply(fmt.Sprintf("❌ %v", err))
+			return
+		}
+
+		if err := resetUserUsage(target.ID); err != nil {
+			log.Printf("Ошибка сброса лимита: %v", err)
+			reply("❌ Ошибка сброса лимита")
+			return
+		}
+		recordAudit(admin, "resetlimit", target.ID, "")
+		reply(fmt.Sprintf("✅ %s: расход за сегодня обнулен", formatUserRef(target)))
+
+	case "broadcast":
+		text := strings.TrimSpace(message.CommandArguments())
+		if text == "" {
+			reply(adminHelp)
+			return
+		}
+
+		// Рассылка занимает ~50 мс на пользователя, поэтому идет в фоне и не держит очередь чата
+		reply("📣 Рассылка началась, пришлю итог, когда она закончится")
+		background.Go("broadcast", func(ctx context.Context) {
+			sent, failed, total, err := broadcast(ctx, bot, text)
+			details := fmt.Sprintf("sent=%d failed=%d total=%d text=%s", sent, failed, total, text)
+			switch {
+			case ctx.Err() != nil:
+				recordAudit(admin, "broadcast", 0, details+" interrupted=true")
+				reply(fmt.Sprintf("⚠️ Рассылка прервана остановкой бота: доставлено %d из %d, ошибок %d", sent, total, failed))
+			case err != nil:
+				log.Printf("Ошибка рассылки: %v", err)
+				reply("❌ Ошибка рассылки")
+			default:
+				recordAudit(admin, "broadcast", 0, details)
+				reply(fmt.Sprintf("📣 Рассылка завершена: доставлено %d, ошибок %d", sent, failed))
+			}
+		})
+	}
+}
+
+// checkRoleChange проверяет, может ли администратор назначить роль пользователю
+func checkRoleChange(admin, target *User, role Role) error {
+	if target.ID == admin.ID {
+		return fmt.Errorf("нельзя менять собственную роль")
+	}
+	if target.Role == RoleOwner {
+		return fmt.Errorf("роль владельца меняется только через BOT_OWNER_IDS")
+	}
+	// Администраторов назначает и снимает только владелец
+	if admin.Role != RoleOwner && (role == RoleAdmin || target.Role == RoleAdmin) {
+		return fmt.Errorf("управлять администраторами может только владелец")
+	}
+	return nil
+}
+
+// formatUserRef форматирует пользователя для ответов администратору
+func formatUserRef(u *User) string {
+	if u.Username != "" {
+		return fmt.Sprintf("@%s (%d)", u.Username, u.ID)
+	}
+	if u.FirstName != "" {
+		return fmt.Sprintf("%s (%d)", u.FirstName, u.ID)
+	}
+	return strconv.FormatInt(u.ID, 10)
+}
+
+// listUsers возвращает список пользователей с ролями, планами и расходом за сегодня
+func listUsers() (string, error) {
+	dayStart, _ := windowBounds("день", time.Now())
+
+	rows, err := db.Query(`
+	SELECT u.user_id, u.username, u.first_name, u.role, COALESCE(u.plan, ?),
+		(SELECT COALESCE(SUM(e.units), 0) FROM usage_events e
+			WHERE e.user_id = u.user_id AND e.timestamp >= MAX(?, COALESCE(l.usage_reset_at, '')))
+	FROM users u
+	LEFT JOIN user_limits l ON l.user_id = u.user_id
+	ORDER BY u.updated_at DESC
+	LIMIT 50
+	`, defaultPlan, dayStart.Format(sqliteTimeFormat))
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	var b strings.Builder
+	count := 0
+	for rows.Next() {
+		var u User
+		var username, firstName sql.NullString
+		var role, plan string
+		var used float64
+		if err := rows.Scan(&u.ID, &username, &firstName, &role, &plan, &used); err != nil {
+			return "", err
+		}
+		u.Username = username.String
+		u.FirstName = firstName.String
+		u.Role = Role(role)
+
+		fmt.Fprintf(&b, "• %s - %s, план %s, сегодня %.1f ед.\n", formatUserRef(&u), u.Role, plan, used)
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	if count == 0 {
+		return "Пользователей пока нет", nil
+	}
+	return fmt.Sprintf("👥 Пользователи (последние %d):\n\n%s", count, b.String()), nil
+}
+
+// setUserDailyLimit задает индивидуальный дневной лимит пользователя в единицах квоты.
+// Отрицательное значение возвращает лимит плана
+func setUserDailyLimit(u *User, limit float64) error {
+	var value interface{}
+	if limit >= 0 {
+		value = limit
+	}
+
+	_, err := db.Exec(`
+	INSERT INTO user_limits (user_id, username, date, request_count, daily_limit)
+	VALUES (?, ?, date('now'), 0, ?)
+	ON CONFLICT(user_id) DO UPDATE SET daily_limit = excluded.daily_limit
+	`, u.ID, u.DisplayName(), value)
+	return err
+}
+
+// broadcast отправляет сообщение всем незаблокированным пользователям.
+// При отмене ctx останавливается и возвращает, скольким успела отправить; total - всего получателей
+func broadcast(ctx context.Context, bot *tgbotapi.BotAPI, text string) (sent, failed, total int, err error) {
+	rows, err := db.Query(`SELECT user_id FROM users WHERE role != 'blocked'`)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, 0, 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		// В личном чате ID чата совпадает с ID пользователя
+		if _, err := bot.Send(tgbotapi.NewMessage(id, "📣 "+text)); err != nil {
+			log.Printf("Ошибка рассылки пользователю %d: %v", id, err)
+			failed++
+		} else {
+			sent++
+		}
+		// Telegram ограничивает рассылку ~30 сообщениями в секунду
+		select {
+		case <-ctx.Done():
+			log.Printf("🛑 Рассылка прервана: отправлено %d из %d", sent+failed, len(ids))
+			return sent, failed, len(ids), ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	return sent, failed, len(ids), nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestResolveUser(t *testing.T) {
+	openTestDB(t)
+	if _, err := db.Exec(`
+	INSERT INTO users (user_id, username, role) VALUES
+		(1, 'alice', 'member'), (2, 'Bob', 'member'), (3, 'bob', 'admin'), (4, NULL, 'member')
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ref  string
+		want int64
+		err  string
+	}{
+		{ref: "1", want: 1},
+		{ref: "@alice", want: 1},
+		{ref: "ALICE", want: 1},
+		{ref: " 4 ", want: 4},
+		// Username перешел к другому аккаунту - угадывать нельзя
+		{ref: "@bob", err: "укажите ID"},
+		{ref: "@carol", err: "не найден"},
+		{ref: "", err: "не указан"},
+	}
+
+	for _, tt := range tests {
+		user, err := resolveUser(tt.ref)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("resolveUser(%q) = %+v, %v; ожидалась ошибка %q", tt.ref, user, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || user.ID != tt.want {
+			t.Errorf("resolveUser(%q) = %+v, %v; ожидался пользователь %d", tt.ref, user, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AudioConverter готовит аудио TTS к отправке голосовым сообщением.
+// Telegram показывает волну и длительность только у OGG/Opus, поэтому
+// остальные форматы перекодируются локальным ffmpeg
+type AudioConverter struct {
+	ffmpeg  string // Путь к ffmpeg, пусто - ffmpeg не найден
+	bitrate string
+}
+
+// newAudioConverterFromConfig ищет ffmpeg (FFMPEG_PATH, по умолчанию в PATH)
+func newAudioConverterFromConfig() *AudioConverter {
+	c := &AudioConverter{bitrate: getEnv("VOICE_BITRATE", "48k")}
+
+	path, err := exec.LookPath(getEnv("FFMPEG_PATH", "ffmpeg"))
+	if err != nil {
+		log.Printf("⚠️  ffmpeg не найден, голос будет отправляться в формате провайдера TTS")
+		return c
+	}
+	c.ffmpeg = path
+	log.Printf("✅ ffmpeg: %s", path)
+	return c
+}
+
+// Available - найден ли ffmpeg
+func (c *AudioConverter) Available() bool {
+	return c != nil && c.ffmpeg != ""
+}
+
+// VoiceNote возвращает аудио в OGG/Opus с заполненной длительностью.
+// Если перекодировать нельзя, возвращает исходное аудио и ошибку
+func (c *AudioConverter) VoiceNote(ctx context.Context, audio *TTSAudio) (*TTSAudio, error) {
+	if audio.Format != "ogg" {
+		if c == nil || c.ffmpeg == "" {
+			return audio, fmt.Errorf("ffmpeg недоступен, формат %s не перекодирован", audio.Format)
+		}
+
+		data, err := c.toOggOpus(ctx, audio.Data)
+		if err != nil {
+			return audio, err
+		}
+		audio = &TTSAudio{Data: data, Format: "ogg", Provider: audio.Provider}
+	}
+
+	duration, err := oggOpusDuration(audio.Data)
+	if err != nil {
+		// Без длительности голосовое все равно отправится, Telegram посчитает ее сам
+		log.Printf("⚠️ Не удалось определить длительность голоса: %v", err)
+	}
+	audio.Duration = duration
+	return audio, nil
+}
+
+// toOggOpus перекодирует аудио любого формата в OGG/Opus (моно, 48 кГц, профиль для речи)
+func (c *AudioConverter) toOggOpus(ctx context.Context, data []byte) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.ffmpeg,
+		"-hide_banner", "-loglevel", "error",
+		"-i", "pipe:0",
+		"-vn", "-ac", "1", "-ar", "48000",
+		"-c:a", "libopus", "-b:a", c.bitrate, "-application", "voip",
+		"-f", "ogg", "pipe:1",
+	)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ошибка ffmpeg: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if stdout.Len() == 0 {
+		return nil, fmt.Errorf("ffmpeg вернул пустое аудио")
+	}
+	return stdout.Bytes(), nil
+}
+
+// Concat склеивает несколько частей в одно голосовое OGG/Opus.
+// ffmpeg читает входы только из файлов, поэтому части временно сохраняются в tempDir
+func (c *AudioConverter) Concat(ctx context.Context, parts []*TTSAudio) (*TTSAudio, error) {
+	if c == nil || c.ffmpeg == "" {
+		return nil, fmt.Errorf("ffmpeg недоступен")
+	}
+
+	args := []string{"-hide_banner", "-loglevel", "error"}
+	var filter strings.Builder
+	for i, part := range parts {
+		f, err := os.CreateTemp(tempDir, "voice-part-*."+part.Format)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка сохранения части: %v", err)
+		}
+		defer os.Remove(f.Name())
+
+		_, err = f.Write(part.Data)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("ошибка сохранения части: %v", err)
+		}
+
+		args = append(args, "-i", f.Name())
+		fmt.Fprintf(&filter, "[%d:a]", i)
+	}
+	fmt.Fprintf(&filter, "concat=n=%d:v=0:a=1", len(parts))
+
+	args = append(args,
+		"-filter_complex", filter.String(),
+		"-ac", "1", "-ar", "48000",
+		"-c:a", "libopus", "-b:a", c.bitrate, "-application", "voip",
+		"-f", "ogg", "pipe:1",
+	)
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.ffmpeg, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ошибка ffmpeg: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	audio := &TTSAudio{Data: stdout.Bytes(), Format: "ogg", Provider: parts[0].Provider}
+	duration, err := oggOpusDuration(audio.Data)
+	if err != nil {
+		log.Printf("⚠️ Не удалось определить длительность голоса: %v", err)
+	}
+	audio.Duration = duration
+	return audio, nil
+}
+
+// errNoAudio - в файле нет звуковой дорожки
+var errNoAudio = errors.New("в файле нет звуковой дорожки")
+
+// ExtractAudio извлекает звук из аудио или видео любого формата в OGG/Opus для распознавания
+// (моно, 16 кГц) и возвращает путь к файлу в tempDir и его длительность. Перекодируется не больше
+// maxDuration и еще секунды: превышение лимита видно по длительности, а длинный файл не обрабатывается целиком
+func (c *AudioConverter) ExtractAudio(ctx context.Context, inputPath string, maxDuration time.Duration) (string, time.Duration, error) {
+	if !c.Available() {
+		return "", 0, fmt.Errorf("ffmpeg недоступен")
+	}
+
+	out, err := os.CreateTemp(tempDir, "speech-*.ogg")
+	if err != nil {
+		return "", 0, fmt.Errorf("ошибка создания файла: %v", err)
+	}
+	out.Close()
+
+	args := []string{"-hide_banner", "-loglevel", "error", "-y", "-i", inputPath}
+	if maxDuration > 0 {
+		args = append(args, "-t", strconv.FormatFloat((maxDuration+time.Second).Seconds(), 'f', 0, 64))
+	}
+	args = append(args,
+		"-vn", "-map", "0:a:0", "-ac", "1", "-ar", "16000",
+		"-c:a", "libopus", "-b:a", "32k", "-application", "voip",
+		"-f", "ogg", out.Name(),
+	)
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.ffmpeg, args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		os.Remove(out.Name())
+		message := strings.TrimSpace(stderr.String())
+		if strings.Contains(message, "matches no streams") {
+			return "", 0, errNoAudio
+		}
+		return "", 0, fmt.Errorf("ошибка ffmpeg: %v: %s", err, message)
+	}
+
+	data, err := os.ReadFile(out.Name())
+	if err != nil {
+		os.Remove(out.Name())
+		return "", 0, fmt.Errorf("ошибка чтения аудио: %v", err)
+	}
+	duration, err := oggOpusDuration(data)
+	if err != nil {
+		os.Remove(out.Name())
+		return "", 0, errNoAudio
+	}
+	return out.Name(), duration, nil
+}
+
+// oggOpusDuration считает длительность OGG/Opus по заголовкам, без декодирования:
+// granule position последней страницы - число семплов 48 кГц, из него вычитается pre-skip
+func oggOpusDuration(data []byte) (time.Duration, error) {
+	capture := []byte("OggS")
+
+	// pre-skip - в заголовке OpusHead первого пакета
+	head := bytes.Index(data, []byte("OpusHead"))
+	if head < 0 || len(data) < head+12 {
+		return 0, fmt.Errorf("не найден заголовок OpusHead")
+	}
+	preSkip := int64(binary.LittleEndian.Uint16(data[head+10 : head+12]))
+
+	// Последняя страница содержит итоговую позицию. "OggS" может встретиться
+	// и внутри аудиоданных, поэтому проверяем версию формата сразу после него
+	last := bytes.LastIndex(data, capture)
+	for last >= 0 && (len(data) < last+14 || data[last+4] != 0) {
+		last = bytes.LastIndex(data[:last], capture)
+	}
+	if last < 0 {
+		return 0, fmt.Errorf("не найдена страница OGG")
+	}
+	granule := int64(binary.LittleEndian.Uint64(data[last+6 : last+14]))
+	if granule <= preSkip {
+		return 0, fmt.Errorf("некорректная позиция OGG: %d", granule)
+	}
+
+	samples := granule - preSkip
+	return time.Duration(samples) * time.Second / 48000, nil
+}
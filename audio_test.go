@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// oggPage - начало страницы OGG: сигнатура, версия, тип заголовка и granule position.
+// Остальные поля заголовка oggOpusDuration не читает
+func oggPage(granule uint64, payload []byte) []byte {
+	page := []byte("OggS\x00\x00")
+	page = binary.LittleEndian.AppendUint64(page, granule)
+	page = append(page, make([]byte, 13)...)
+	return append(page, payload...)
+}
+
+// opusHead - пакет заголовка Opus с указанным pre-skip
+func opusHead(preSkip uint16) []byte {
+	head := []byte("OpusHead\x01\x01")
+	head = binary.LittleEndian.AppendUint16(head, preSkip)
+	return append(head, make([]byte, 7)...)
+}
+
+func TestOggOpusDuration(t *testing.T) {
+	concat := func(parts ...[]byte) []byte {
+		var data []byte
+		for _, p := range parts {
+			data = append(data, p...)
+		}
+		return data
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    time.Duration
+		wantErr bool
+	}{
+		{
+			name: "одна секунда",
+			data: concat(oggPage(0, opusHead(312)), oggPage(48000+312, nil)),
+			want: time.Second,
+		},
+		{
+			name: "позиция берется с последней страницы",
+			data: concat(oggPage(0, opusHead(0)), oggPage(24000, []byte("audio")), oggPage(120000, []byte("audio"))),
+			want: 2500 * time.Millisecond,
+		},
+		{
+			// "OggS" внутри аудиоданных с ненулевой версией - не страница
+			name: "сигнатура внутри аудиоданных",
+			data: concat(oggPage(0, opusHead(0)), oggPage(96000, []byte("xxOggS\x07"+string(make([]byte, 12))))),
+			want: 2 * time.Second,
+		},
+		{
+			name:    "нет OpusHead",
+			data:    concat(oggPage(0, []byte("OpusTags")), oggPage(48000, nil)),
+			wantErr: true,
+		},
+		{
+			name:    "позиция меньше pre-skip",
+			data:    concat(oggPage(0, opusHead(312)), oggPage(100, nil)),
+			wantErr: true,
+		},
+		{
+			name:    "пустые данные",
+			data:    nil,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := oggOpusDuration(tt.data)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: ожидалась ошибка, получено %v", tt.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: неожиданная ошибка: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: %v; ожидалось %v", tt.name, got, tt.want)
+		}
+	}
+}
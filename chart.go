@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// Графики рисуются в PNG прямо в боте, без внешних сервисов. Шрифт Go встроен
+// в бинарник и содержит кириллицу, поэтому подписи категорий выводятся как есть
+
+const (
+	chartWidth  = 900
+	chartHeight = 500
+	chartGrid   = 5 // Горизонтальных линий сетки
+)
+
+var (
+	chartBackground = color.RGBA{255, 255, 255, 255}
+	chartAxis       = color.RGBA{120, 120, 120, 255}
+	chartGridColor  = color.RGBA{230, 230, 230, 255}
+	chartText       = color.RGBA{40, 40, 40, 255}
+	chartSeries     = color.RGBA{52, 120, 200, 255}
+)
+
+// chartFace - шрифт подписей, разбирается один раз
+var chartFace = sync.OnceValues(func() (font.Face, error) {
+	f, err := opentype.Parse(goregular.TTF)
+	if err != nil {
+		return nil, err
+	}
+	return opentype.NewFace(f, &opentype.FaceOptions{Size: 13, DPI: 72, Hinting: font.HintingFull})
+})
+
+// dateLabelFormats - подписи, по которым строится линейный график
+var dateLabelFormats = []string{"2006-01-02", "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02 15", "2006-01"}
+
+// chartKind - какой график подходит результату: "line" для дат, "bar" для категорий,
+// "" - результат не график. Нужны две колонки: подпись и число
+func chartKind(result *sqlResult) string {
+	if len(result.Columns) != 2 || len(result.Rows) < 2 {
+		return ""
+	}
+	dates := true
+	for _, row := range result.Rows {
+		if _, ok := chartValue(row[1]); !ok {
+			return ""
+		}
+		dates = dates && isDateLabel(row[0])
+	}
+	switch {
+	case dates:
+		return "line"
+	case len(result.Rows) <= sqlChartBars:
+		return "bar"
+	default:
+		return ""
+	}
+}
+
+// chartValue - числовое значение ячейки
+func chartValue(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	default:
+		return 0, false
+	}
+}
+
+// isDateLabel - подпись является датой или временем
+func isDateLabel(v interface{}) bool {
+	switch v := v.(type) {
+	case time.Time:
+		return true
+	case string:
+		for _, layout := range dateLabelFormats {
+			if _, err := time.Parse(layout, v); err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// renderChartAttachment - график результата как фото
+func renderChartAttachment(result *sqlResult, kind string) (*Attachment, error) {
+	data, err := renderChart(result, kind)
+	if err != nil {
+		return nil, err
+	}
+	return &Attachment{FileName: "chart.png", Data: data, Photo: true,
+		Caption: fmt.Sprintf("📊 %s по %s", result.Columns[1], result.Columns[0])}, nil
+}
+
+// renderChart рисует столбчатый ("bar") или линейный ("line") график в PNG
+func renderChart(result *sqlResult, kind string) ([]byte, error) {
+	face, err := chartFace()
+	if err != nil {
+		return nil, fmt.Errorf("ошибка загрузки шрифта графика: %v", err)
+	}
+
+	labels := make([]string, len(result.Rows))
+	values := make([]float64, len(result.Rows))
+	for i, row := range result.Rows {
+		labels[i] = formatSQLValue(row[0])
+		values[i], _ = chartValue(row[1])
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, chartWidth, chartHeight))
+	draw.Draw(img, img.Bounds(), image.NewUniform(chartBackground), image.Point{}, draw.Src)
+	plot := image.Rect(80, 40, chartWidth-30, chartHeight-60)
+
+	// Ось Y от нуля (или от минимума, если есть отрицательные) до максимума с запасом
+	low, high := 0.0, 0.0
+	for _, v := range values {
+		low, high = math.Min(low, v), math.Max(high, v)
+	}
+	if high == low {
+		high = low + 1
+	}
+	step := niceStep((high - low) / chartGrid)
+	low = math.Floor(low/step) * step
+	high = math.Ceil(high/step) * step
+	y := func(v float64) int {
+		return plot.Max.Y - int(math.Round((v-low)/(high-low)*float64(plot.Dy())))
+	}
+
+	for v := low; v <= high+step/2; v += step {
+		fillRect(img, image.Rect(plot.Min.X, y(v), plot.Max.X, y(v)+1), chartGridColor)
+		text := formatChartNumber(v)
+		drawText(img, face, text, plot.Min.X-8-font.MeasureString(face, text).Ceil(), y(v)+5)
+	}
+	drawText(img, face, result.Columns[1], plot.Min.X, plot.Min.Y-16)
+
+	// x - центр подписи i-го значения
+	var x func(i int) int
+	n := len(values)
+	switch kind {
+	case "line":
+		x = func(i int) int {
+			if n == 1 {
+				return plot.Min.X + plot.Dx()/2
+			}
+			return plot.Min.X + i*plot.Dx()/(n-1)
+		}
+		for i := 1; i < n; i++ {
+			drawLine(img, x(i-1), y(values[i-1]), x(i), y(values[i]), chartSeries)
+		}
+		if n <= 60 {
+			for i := range values {
+				fillRect(img, image.Rect(x(i)-3, y(values[i])-3, x(i)+4, y(values[i])+4), chartSeries)
+			}
+		}
+
+	default:
+		slot := float64(plot.Dx()) / float64(n)
+		x = func(i int) int { return plot.Min.X + int((float64(i)+0.5)*slot) }
+		half := int(slot * 0.35)
+		for i, v := range values {
+			top, bottom := y(v), y(math.Max(low, 0))
+			if top > bottom {
+				top, bottom = bottom, top
+			}
+			fillRect(img, image.Rect(x(i)-half, top, x(i)+half+1, bottom), chartSeries)
+			// Значение над столбцом, если помещается
+			text := formatChartNumber(v)
+			if w := font.MeasureString(face, text).Ceil(); w <= int(slot) {
+				drawText(img, face, text, x(i)-w/2, top-4)
+			}
+		}
+	}
+
+	fillRect(img, image.Rect(plot.Min.X, plot.Min.Y, plot.Min.X+1, plot.Max.Y), chartAxis)
+	fillRect(img, image.Rect(plot.Min.X, plot.Max.Y, plot.Max.X, plot.Max.Y+1), chartAxis)
+
+	// Подписи оси X: если не помещаются все, выводится каждая k-я
+	widest := 0
+	for _, l := range labels {
+		widest = max(widest, font.MeasureString(face, l).Ceil())
+	}
+	space := max(1, plot.Dx()/max(1, n-1))
+	if kind != "line" {
+		space = plot.Dx() / n
+	}
+	every := max(1, int(math.Ceil(float64(widest+10)/float64(space))))
+	maxWidth := space*every - 10
+	for i := 0; i < n; i += every {
+		text := fitText(face, labels[i], maxWidth)
+		w := font.MeasureString(face, text).Ceil()
+		left := min(max(x(i)-w/2, 0), chartWidth-w)
+		drawText(img, face, text, left, plot.Max.Y+20)
+	}
+	drawText(img, face, result.Columns[0], plot.Max.X-font.MeasureString(face, result.Columns[0]).Ceil(), chartHeight-12)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("ошибка кодирования графика: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// niceStep округляет шаг сетки до 1, 2 или 5 в нужном разряде
+func niceStep(raw float64) float64 {
+	magnitude := math.Pow(10, math.Floor(math.Log10(raw)))
+	for _, m := range []float64{1, 2, 5, 10} {
+		if raw <= m*magnitude {
+			return m * magnitude
+		}
+	}
+	return 10 * magnitude
+}
+
+// formatChartNumber - число для подписи: целые без дробной части, остальные - 3 значащие цифры
+func formatChartNumber(v float64) string {
+	if v == math.Trunc(v) && math.Abs(v) < 1e15 {
+		return strconv.FormatInt(int64(v), 10)
+	}
+	return strconv.FormatFloat(v, 'g', 3, 64)
+}
+
+// fitText обрезает подпись до ширины в пикселях
+func fitText(face font.Face, text string, width int) string {
+	if font.MeasureString(face, text).Ceil() <= width {
+		return text
+	}
+	runes := []rune(text)
+	for len(runes) > 1 {
+		runes = runes[:len(runes)-1]
+		if font.MeasureString(face, string(runes)+"…").Ceil() <= width {
+			break
+		}
+	}
+	return string(runes) + "…"
+}
+
+// drawText пишет текст с базовой линией в (x, y)
+func drawText(img *image.RGBA, face font.Face, text string, x, y int) {
+	d := font.Drawer{Dst: img, Src: image.NewUniform(chartText), Face: face, Dot: fixed.P(x, y)}
+	d.DrawString(text)
+}
+
+// fillRect закрашивает прямоугольник
+func fillRect(img *image.RGBA, r image.Rectangle, c color.Color) {
+	draw.Draw(img, r, image.NewUniform(c), image.Point{}, draw.Src)
+}
+
+// drawLine рисует отрезок толщиной 3 пикселя
+func drawLine(img *image.RGBA, x0, y0, x1, y1 int, c color.Color) {
+	steps := max(abs(x1-x0), abs(y1-y0), 1)
+	for i := 0; i <= steps; i++ {
+		x := x0 + (x1-x0)*i/steps
+		y := y0 + (y1-y0)*i/steps
+		fillRect(img, image.Rect(x-1, y-1, x+2, y+2), c)
+	}
+}
+
+// abs - модуль целого
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// chunkText делит текст на части не длиннее maxRunes символов для озвучивания.
+// Части собираются из целых предложений; слишком длинное предложение делится
+// по словам, а слишком длинное слово - по символам
+func chunkText(text string, maxRunes int) []string {
+	return chunkTextBy(text, maxRunes, func(rune) int { return 1 })
+}
+
+// chunkTextUTF16 делит текст так же, как chunkText, но длину считает в единицах UTF-16 -
+// так Telegram ограничивает длину сообщений и подписей
+func chunkTextUTF16(text string, maxUnits int) []string {
+	return chunkTextBy(text, maxUnits, utf16RuneLen)
+}
+
+// utf16Len возвращает длину строки в единицах UTF-16
+func utf16Len(s string) int {
+	return len(utf16.Encode([]rune(s)))
+}
+
+// utf16RuneLen возвращает, сколько единиц UTF-16 занимает символ
+func utf16RuneLen(r rune) int {
+	// Символы вне базовой плоскости (в том числе большинство эмодзи) кодируются суррогатной парой
+	if r > 0xFFFF && r <= unicode.MaxRune {
+		return 2
+	}
+	return 1
+}
+
+// chunkTextBy делит текст на части, длина которых (сумма runeSize по символам) не больше max
+func chunkTextBy(text string, max int, runeSize func(rune) int) []string {
+	size := func(s string) int {
+		n := 0
+		for _, r := range s {
+			n += runeSize(r)
+		}
+		return n
+	}
+
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return nil
+	}
+	if max <= 0 || size(text) <= max {
+		return []string{text}
+	}
+
+	var chunks []string
+	var current strings.Builder
+	currentLen := 0
+
+	flush := func() {
+		if current.Len() > 0 {
+			chunks = append(chunks, strings.TrimSpace(current.String()))
+			current.Reset()
+			currentLen = 0
+		}
+	}
+
+	add := func(piece string) {
+		n := size(piece)
+		if currentLen > 0 && currentLen+1+n > max {
+			flush()
+		}
+		if currentLen > 0 {
+			current.WriteByte(' ')
+			currentLen++
+		}
+		current.WriteString(piece)
+		currentLen += n
+	}
+
+	for _, sentence := range splitSentences(text) {
+		if size(sentence) <= max {
+			add(sentence)
+			continue
+		}
+
+		// Длинное предложение - по словам
+		for _, word := range strings.Fields(sentence) {
+			for size(word) > max {
+				flush()
+				// Отрезаем столько символов, сколько помещается (хотя бы один)
+				cut, n := 0, 0
+				for cut < len(word) {
+					r, width := utf8.DecodeRuneInString(word[cut:])
+					if cut > 0 && n+runeSize(r) > max {
+						break
+					}
+					n += runeSize(r)
+					cut += width
+				}
+				chunks = append(chunks, word[:cut])
+				word = word[cut:]
+			}
+			add(word)
+		}
+	}
+	flush()
+
+	return chunks
+}
+
+// splitSentences делит текст на предложения по . ! ? … и переводам строки
+func splitSentences(text string) []string {
+	var sentences []string
+	runes := []rune(text)
+	start := 0
+
+	for i, r := range runes {
+		end := false
+		switch r {
+		case '\n':
+			end = true
+		case '.', '!', '?', '…':
+			// Конец предложения - знак, за которым пробел или конец текста (не "3.14")
+			end = i+1 == len(runes) || unicode.IsSpace(runes[i+1])
+		}
+		if !end {
+			continue
+		}
+
+		if sentence := strings.TrimSpace(string(runes[start : i+1])); sentence != "" {
+			sentences = append(sentences, sentence)
+		}
+		start = i + 1
+	}
+
+	if sentence := strings.TrimSpace(string(runes[start:])); sentence != "" {
+		sentences = append(sentences, sentence)
+	}
+	return sentences
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitSentences(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"", nil},
+		{"Привет", []string{"Привет"}},
+		{"Привет. Как дела? Отлично!", []string{"Привет.", "Как дела?", "Отлично!"}},
+		{"Число 3.14 не делит предложение.", []string{"Число 3.14 не делит предложение."}},
+		{"Первая строка\nвторая строка", []string{"Первая строка", "вторая строка"}},
+		{"Ну… ладно", []string{"Ну…", "ладно"}},
+		{"Что?!  Да.", []string{"Что?!", "Да."}},
+		{"\n\n  Текст  \n", []string{"Текст"}},
+	}
+
+	for _, tt := range tests {
+		if got := splitSentences(tt.text); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitSentences(%q) = %q; ожидалось %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestChunkText(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		maxRunes int
+		want     []string
+	}{
+		{"пустой текст", "   ", 10, nil},
+		{"короткий текст целиком", "Один. Два.", 100, []string{"Один. Два."}},
+		{"без ограничения", "Один. Два.", 0, []string{"Один. Два."}},
+		{"по предложениям", "Раз два. Три четыре. Пять.", 12, []string{"Раз два.", "Три четыре.", "Пять."}},
+		{"предложения собираются вместе", "Аб. Вг. Де. Жз.", 7, []string{"Аб. Вг.", "Де. Жз."}},
+		{"длинное предложение по словам", "один два три четыре", 9, []string{"один два", "три", "четыре"}},
+		{"длинное слово по символам", "абвгдеёжз", 4, []string{"абвг", "деёж", "з"}},
+	}
+
+	for _, tt := range tests {
+		got := chunkText(tt.text, tt.maxRunes)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: chunkText(%q, %d) = %q; ожидалось %q", tt.name, tt.text, tt.maxRunes, got, tt.want)
+		}
+	}
+}
+
+func TestChunkTextLimit(t *testing.T) {
+	text := strings.Repeat("Это довольно длинное предложение для проверки деления на части. ", 40) +
+		strings.Repeat("слово", 100)
+
+	for _, maxRunes := range []int{20, 50, 400} {
+		chunks := chunkText(text, maxRunes)
+		for _, c := range chunks {
+			if n := utf8.RuneCountInString(c); n > maxRunes || n == 0 {
+				t.Errorf("chunkText(..., %d): часть длиной %d: %q", maxRunes, n, c)
+			}
+		}
+		// Деление не теряет слов
+		joined := strings.Join(chunks, "")
+		if strings.ReplaceAll(joined, " ", "") != strings.ReplaceAll(text, " ", "") {
+			t.Errorf("chunkText(..., %d): текст изменился после деления", maxRunes)
+		}
+	}
+}
+
+func TestChunkTextUTF16(t *testing.T) {
+	// Эмодзи занимает 2 единицы UTF-16, кириллица - одну
+	if n := utf16Len("Да 🔊"); n != 5 {
+		t.Errorf("utf16Len(\"Да 🔊\") = %d; ожидалось 5", n)
+	}
+
+	tests := []struct {
+		name     string
+		text     string
+		maxUnits int
+		want     []string
+	}{
+		{"помещается целиком", "🔊🔊 Да.", 8, []string{"🔊🔊 Да."}},
+		{"эмодзи считаются за два", "🔊🔊. Да.", 6, []string{"🔊🔊.", "Да."}},
+		{"слово из эмодзи не рвет пару", "🔊🔊🔊", 3, []string{"🔊", "🔊", "🔊"}},
+	}
+	for _, tt := range tests {
+		got := chunkTextUTF16(tt.text, tt.maxUnits)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: chunkTextUTF16(%q, %d) = %q; ожидалось %q", tt.name, tt.text, tt.maxUnits, got, tt.want)
+		}
+	}
+
+	// Ответ из эмодзи длиннее сообщения Telegram делится на допустимые части
+	text := "📝 " + strings.Repeat("🙂 ", 3000)
+	for _, c := range chunkTextUTF16(text, messageLimit) {
+		if n := utf16Len(c); n > messageLimit {
+			t.Errorf("часть длиной %d единиц UTF-16 > %d", n, messageLimit)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// httpClient - общий HTTP клиент для внешних API (ElevenLabs, OpenAI, скачивание файлов).
+// Timeout - верхняя граница на случай, если у запроса нет дедлайна в контексте
+var httpClient = &http.Client{Timeout: 2 * time.Minute}
+
+// getEnv возвращает значение переменной окружения или значение по умолчанию
+func getEnv(key, fallback string) string {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// getEnvInt возвращает целое значение переменной окружения или значение по умолчанию
+func getEnvInt(key string, fallback int) int {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return fallback
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("⚠️  Некорректное значение %s=%q, используется %d", key, value, fallback)
+		return fallback
+	}
+	return n
+}
+
+// getEnvBool возвращает логическое значение переменной окружения или значение по умолчанию
+func getEnvBool(key string, fallback bool) bool {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return fallback
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("⚠️  Некорректное значение %s=%q, используется %t", key, value, fallback)
+		return fallback
+	}
+	return b
+}
+
+// getEnvSeconds возвращает длительность, заданную в секундах, или значение по умолчанию.
+// 0 - без ограничения
+func getEnvSeconds(key string, fallback time.Duration) time.Duration {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return fallback
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f < 0 {
+		log.Printf("⚠️  Некорректное значение %s=%q, используется %v", key, value, fallback)
+		return fallback
+	}
+	return time.Duration(f * float64(time.Second))
+}
+
+// getEnvFloat возвращает дробное значение переменной окружения или значение по умолчанию
+func getEnvFloat(key string, fallback float64) float64 {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return fallback
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Printf("⚠️  Некорректное значение %s=%q, используется %g", key, value, fallback)
+		return fallback
+	}
+	return f
+}
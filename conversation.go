@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// ConversationMemory собирает контекст разговора для ChatGPT из истории messages.
+// В окно попадают последние реплики чата (не больше maxTurns и maxTokens),
+// а вытесненные из окна реплики сворачиваются в краткое содержание
+type ConversationMemory struct {
+	client    LLM
+	maxTurns  int  // 0 - память отключена
+	maxTokens int  // Приблизительный бюджет токенов на историю
+	summarize bool // Сворачивать вытесненные реплики в summary
+}
+
+// conversationTurn - один обмен репликами: вопрос пользователя и ответ бота
+type conversationTurn struct {
+	ID       int64
+	Input    string
+	Response string
+}
+
+// conversationSession - состояние разговора чата из conversation_sessions
+type conversationSession struct {
+	StartAfterID   int64
+	Summary        string
+	SummaryUntilID int64
+}
+
+// NewConversationMemory создает память разговора по настройкам из окружения
+func NewConversationMemory(client LLM) *ConversationMemory {
+	return &ConversationMemory{
+		client:    client,
+		maxTurns:  getEnvInt("CONVERSATION_MAX_TURNS", 10),
+		maxTokens: getEnvInt("CONVERSATION_MAX_TOKENS", 2000),
+		summarize: getEnvBool("CONVERSATION_SUMMARIZE", true),
+	}
+}
+
+// estimateTokens грубо оценивает число токенов: для русского текста ~3 символа на токен
+func estimateTokens(text string) int {
+	return utf8.RuneCountInString(text)/3 + 1
+}
+
+// loadSession возвращает состояние разговора чата (пустое, если его нет)
+func loadSession(chatID int64) (conversationSession, error) {
+	var session conversationSession
+	err := db.QueryRow(
+		`SELECT start_after_id, summary, summary_until_id FROM conversation_sessions WHERE chat_id = ?`,
+		chatID,
+	).Scan(&session.StartAfterID, &session.Summary, &session.SummaryUntilID)
+
+	if err == sql.ErrNoRows {
+		return session, nil
+	}
+	if err != nil {
+		return session, fmt.Errorf("ошибка чтения сессии разговора: %v", err)
+	}
+	return session, nil
+}
+
+// loadTurns возвращает реплики чата после указанного сообщения, от старых к новым
+func loadTurns(chatID, afterID int64, limit int) ([]conversationTurn, error) {
+	rows, err := db.Query(`
+	SELECT id, input_text, response_text FROM messages
+	WHERE chat_id = ? AND id > ? AND intent = 'chat'
+	ORDER BY id DESC
+	LIMIT ?
+	`, chatID, afterID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения истории: %v", err)
+	}
+	defer rows.Close()
+
+	var turns []conversationTurn
+	for rows.Next() {
+		var turn conversationTurn
+		var input, response sql.NullString
+		if err := rows.Scan(&turn.ID, &input, &response); err != nil {
+			return nil, fmt.Errorf("ошибка сканирования истории: %v", err)
+		}
+		turn.Input = input.String
+		turn.Response = response.String
+		turns = append(turns, turn)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Разворачиваем в хронологический порядок
+	for i, j := 0, len(turns)-1; i < j; i, j = i+1, j-1 {
+		turns[i], turns[j] = turns[j], turns[i]
+	}
+	return turns, nil
+}
+
+// splitWindow делит реплики на вытесненные (старые) и попадающие в окно (новые)
+func (m *ConversationMemory) splitWindow(turns []conversationTurn) (overflow, window []conversationTurn) {
+	tokens := 0
+	start := len(turns)
+
+	for i := len(turns) - 1; i >= 0; i-- {
+		cost := estimateTokens(turns[i].Input) + estimateTokens(turns[i].Response)
+		if len(turns)-i > m.maxTurns || tokens+cost > m.maxTokens {
+			break
+		}
+		tokens += cost
+		start = i
+	}
+
+	return turns[:start], turns[start:]
+}
+
+// History возвращает сообщения для ChatGPT: краткое содержание и последние реплики.
+// Токены на сжатие истории добавляются в usage
+func (m *ConversationMemory) History(ctx context.Context, chatID int64, usage *Usage) ([]openai.ChatCompletionMessage, error) {
+	if m == nil || m.maxTurns <= 0 {
+		return nil, nil
+	}
+
+	session, err := loadSession(chatID)
+	if err != nil {
+		return nil, err
+	}
+
+	afterID := session.StartAfterID
+	if session.SummaryUntilID > afterID {
+		afterID = session.SummaryUntilID
+	}
+
+	// Без summary старые реплики просто отбрасываются, поэтому лишние не читаем
+	limit := m.maxTurns
+	if m.summarize {
+		limit = m.maxTurns * 3
+	}
+
+	turns, err := loadTurns(chatID, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	overflow, window := m.splitWindow(turns)
+
+	if len(overflow) > 0 && m.summarize {
+		summary, err := m.summarizeTurns(ctx, usage, session.Summary, overflow)
+		if err != nil {
+			// Без summary разговор продолжится, просто без самых старых реплик
+			log.Printf("⚠️ Не удалось сжать историю чата %d: %v", chatID, err)
+		} else {
+			session.Summary = summary
+			if err := saveSummary(chatID, summary, overflow[len(overflow)-1].ID); err != nil {
+				log.Printf("⚠️ %v", err)
+			}
+		}
+	}
+
+	var messages []openai.ChatCompletionMessage
+	if session.Summary != "" {
+		messages = append(messages, openai.ChatCompletionMessage{
+			Role:    openai.ChatMessageRoleSystem,
+			Content: "Краткое содержание предыдущего разговора: " + session.Summary,
+		})
+	}
+	for _, turn := range window {
+		messages = append(messages,
+			openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: turn.Input},
+			openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: turn.Response},
+		)
+	}
+
+	return messages, nil
+}
+
+// summarizeTurns сворачивает старое summary и вытесненные реплики в новое summary
+func (m *ConversationMemory) summarizeTurns(ctx context.Context, usage *Usage, previous string, turns []conversationTurn) (string, error) {
+	model := os.Getenv("OPENAI_MODEL")
+	if model == "" {
+		model = "gpt-4o-mini"
+	}
+
+	var dialog strings.Builder
+	if previous != "" {
+		dialog.WriteString("Ранее: " + previous + "\n\n")
+	}
+	for _, turn := range turns {
+		fmt.Fprintf(&dialog, "Пользователь: %s\nБот: %s\n", turn.Input, turn.Response)
+	}
+
+	log.Printf("🗜️ Сжимаю %d старых реплик разговора", len(turns))
+
+	resp, err := createChatCompletion(
+		ctx,
+		m.client,
+		openai.ChatCompletionRequest{
+			Model: model,
+			Messages: []openai.ChatCompletionMessage{
+				{
+					Role: openai.ChatMessageRoleSystem,
+					Content: "Кратко перескажи разговор пользователя с ботом на русском языке (до 80 слов). " +
+						"Сохрани темы, факты о пользователе и договоренности, без вступлений.",
+				},
+				{
+					Role:    openai.ChatMessageRoleUser,
+					Content: dialog.String(),
+				},
+			},
+		},
+	)
+	if err != nil {
+		return "", fmt.Errorf("ошибка сжатия истории: %w", err)
+	}
+
+	usage.AddLLM(resp.Usage)
+
+	if len(resp.Choices) == 0 {
+		return "", fmt.Errorf("GPT не вернул краткое содержание")
+	}
+
+	return strings.TrimSpace(resp.Choices[0].Message.Content), nil
+}
+
+// saveSummary сохраняет краткое содержание разговора
+func saveSummary(chatID int64, summary string, untilID int64) error {
+	_, err := db.Exec(`
+	INSERT INTO conversation_sessions (chat_id, summary, summary_until_id, updated_at)
+	VALUES (?, ?, ?, datetime('now'))
+	ON CONFLICT(chat_id) DO UPDATE SET
+		summary = excluded.summary,
+		summary_until_id = excluded.summary_until_id,
+		updated_at = excluded.updated_at
+	`, chatID, summary, untilID)
+	if err != nil {
+		return fmt.Errorf("ошибка сохранения краткого содержания: %v", err)
+	}
+	return nil
+}
+
+// resetConversation начинает разговор в чате заново: старые реплики и summary забываются
+func resetConversation(chatID int64) error {
+	_, err := db.Exec(`
+	INSERT INTO conversation_sessions (chat_id, start_after_id, summary, summary_until_id, updated_at)
+	VALUES (?, (SELECT COALESCE(MAX(id), 0) FROM messages), '', 0, datetime('now'))
+	ON CONFLICT(chat_id) DO UPDATE SET
+		start_after_id = excluded.start_after_id,
+		summary = '',
+		summary_until_id = 0,
+		updated_at = excluded.updated_at
+	`, chatID)
+	if err != nil {
+		return fmt.Errorf("ошибка сброса разговора: %v", err)
+	}
+	log.Printf("🧹 Разговор в чате %d сброшен", chatID)
+	return nil
+}
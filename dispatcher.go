@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Dispatcher обрабатывает обновления (сообщения и нажатия кнопок) параллельно пулом воркеров.
+// Обновления одного чата стоят в своей очереди и обрабатываются строго по порядку,
+// разные чаты не блокируют друг друга
+type Dispatcher struct {
+	handle func(update *tgbotapi.Update)
+	reject func(update *tgbotapi.Update)
+
+	workers   int
+	maxQueued int
+
+	mu      sync.Mutex
+	pending map[int64][]*tgbotapi.Update // Очереди обновлений по чатам, первое - в работе
+	queued  int                          // Всего обновлений в очередях
+	ready   chan int64                   // Чаты, у которых есть необработанные обновления
+	skip    map[*tgbotapi.Update]bool    // Отмененные (/cancel) обновления, которые еще не начаты
+	running map[int64]bool               // Чаты, первое обновление которых сейчас обрабатывается
+	wg      sync.WaitGroup
+
+	closed  bool          // Shutdown вызван, новые обновления не принимаются
+	drained chan struct{} // Закрывается, когда после Shutdown очереди опустели
+}
+
+// NewDispatcher создает диспетчер. handle вызывается для каждого обновления,
+// reject - когда очередь заполнена и обновление не принято
+func NewDispatcher(workers, maxQueued int, handle, reject func(update *tgbotapi.Update)) *Dispatcher {
+	if workers < 1 {
+		workers = 1
+	}
+	if maxQueued < 1 {
+		maxQueued = 1
+	}
+
+	return &Dispatcher{
+		handle:    handle,
+		reject:    reject,
+		workers:   workers,
+		maxQueued: maxQueued,
+		pending:   make(map[int64][]*tgbotapi.Update),
+		skip:      make(map[*tgbotapi.Update]bool),
+		running:   make(map[int64]bool),
+		// В ready не может оказаться больше чатов, чем обновлений в очередях
+		ready:   make(chan int64, maxQueued),
+		drained: make(chan struct{}),
+	}
+}
+
+// Start запускает воркеры
+func (d *Dispatcher) Start() {
+	for i := 0; i < d.workers; i++ {
+		d.wg.Add(1)
+		go d.worker()
+	}
+	log.Printf("⚙️ Запущено воркеров: %d (очередь: %d обновлений)", d.workers, d.maxQueued)
+}
+
+// Submit ставит сообщение или нажатие кнопки в очередь его чата.
+// Возвращает false, если очередь переполнена и обновление отклонено
+func (d *Dispatcher) Submit(update *tgbotapi.Update) bool {
+	chatID := updateChatID(update)
+
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		log.Printf("🛑 Бот останавливается, обновление из чата %d не принято", chatID)
+		return false
+	}
+	if d.queued >= d.maxQueued {
+		d.mu.Unlock()
+		log.Printf("🚦 Очередь переполнена, обновление из чата %d отклонено", chatID)
+		d.reject(update)
+		return false
+	}
+
+	d.queued++
+	d.pending[chatID] = append(d.pending[chatID], update)
+	// Чат уже в работе или ждет воркера - обновление обработается после предыдущих
+	if len(d.pending[chatID]) == 1 {
+		d.ready <- chatID
+	}
+	d.mu.Unlock()
+
+	return true
+}
+
+// worker берет чат с необработанными обновлениями и обрабатывает первое из них
+func (d *Dispatcher) worker() {
+	defer d.wg.Done()
+
+	for chatID := range d.ready {
+		d.mu.Lock()
+		update := d.pending[chatID][0]
+		skip := d.skip[update]
+		delete(d.skip, update)
+		d.running[chatID] = true
+		d.mu.Unlock()
+
+		if !skip {
+			d.process(chatID, update)
+		}
+
+		d.mu.Lock()
+		delete(d.running, chatID)
+		d.queued--
+		d.pending[chatID] = d.pending[chatID][1:]
+		if len(d.pending[chatID]) == 0 {
+			delete(d.pending, chatID)
+		} else {
+			// Возвращаем чат в конец очереди, чтобы не занимать воркер надолго
+			d.ready <- chatID
+		}
+		if d.closed && d.queued == 0 {
+			close(d.drained)
+		}
+		d.mu.Unlock()
+	}
+}
+
+// Cancel отменяет сообщения чата, которые стоят в очереди и еще не начаты.
+// Нажатия кнопок не отменяются: они только меняют настройки.
+// Возвращает число отмененных сообщений
+func (d *Dispatcher) Cancel(chatID int64) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Сообщение, которое уже обрабатывается, отменяет Pipeline.Cancel
+	count := 0
+	for i, update := range d.pending[chatID] {
+		if (i == 0 && d.running[chatID]) || d.skip[update] || update.Message == nil {
+			continue
+		}
+		d.skip[update] = true
+		count++
+	}
+	return count
+}
+
+// Abort отменяет все обновления в очередях, которые еще не начаты. Вызывается при
+// остановке, когда ждать их обработки уже некогда. Возвращает число отмененных обновлений
+func (d *Dispatcher) Abort() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	count := 0
+	for chatID, updates := range d.pending {
+		for i, update := range updates {
+			if (i == 0 && d.running[chatID]) || d.skip[update] {
+				continue
+			}
+			d.skip[update] = true
+			count++
+		}
+	}
+	return count
+}
+
+// process обрабатывает обновление, не давая панике уронить воркер
+func (d *Dispatcher) process(chatID int64, update *tgbotapi.Update) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("💥 Паника при обработке обновления из чата %d: %v", chatID, r)
+		}
+	}()
+
+	d.handle(update)
+}
+
+// Shutdown перестает принимать обновления и ждет, пока воркеры обработают
+// уже принятые. Если ctx истек раньше, возвращает ошибку с числом необработанных обновлений
+func (d *Dispatcher) Shutdown(ctx context.Context) error {
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		if d.queued == 0 {
+			close(d.drained)
+		}
+	}
+	d.mu.Unlock()
+
+	select {
+	case <-d.drained:
+		// Очереди пусты и новых обновлений не будет - воркеры можно отпустить
+		close(d.ready)
+		d.wg.Wait()
+		return nil
+	case <-ctx.Done():
+		d.mu.Lock()
+		left := d.queued
+		d.mu.Unlock()
+		return fmt.Errorf("не дождались обработки %d обновлений: %v", left, ctx.Err())
+	}
+}
+
+// updateChatID - чат, в очередь которого встает обновление. Кнопка под сообщением
+// относится к его чату, кнопка без сообщения (inline-режим) - к личному чату нажавшего
+func updateChatID(update *tgbotapi.Update) int64 {
+	switch {
+	case update.Message != nil:
+		return update.Message.Chat.ID
+	case update.CallbackQuery != nil && update.CallbackQuery.Message != nil:
+		return update.CallbackQuery.Message.Chat.ID
+	case update.CallbackQuery != nil:
+		return update.CallbackQuery.From.ID
+	default:
+		return 0
+	}
+}
@@ -2,10 +2,12 @@ module telegram-bot
 
 go 1.21
 
-require github.com/go-telegram-bot-api/telegram-bot-api/v5 v5.5.1
-
 require (
-	github.com/joho/godotenv v1.5.1 // indirect
-	github.com/mattn/go-sqlite3 v1.14.32 // indirect
-	github.com/sashabaranov/go-openai v1.41.2 // indirect
+	github.com/go-telegram-bot-api/telegram-bot-api/v5 v5.5.1
+	github.com/joho/godotenv v1.5.1
+	github.com/mattn/go-sqlite3 v1.14.32
+	github.com/sashabaranov/go-openai v1.41.2
+	golang.org/x/image v0.18.0
 )
+
+require golang.org/x/text v0.16.0 // indirect
@@ -1,17 +1,17 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"database/sql"
-	"encoding/json"
 	"fmt"
-	"io"
 	"log"
-	"mime/multipart"
+	"math"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
@@ -26,19 +26,12 @@ const (
 
 var db *sql.DB
 
-type ElevenLabsRequest struct {
-	Text    string `json:"text"`
-	ModelID string `json:"model_id"`
-}
-
-type ElevenLabsSTTResponse struct {
-	Text string `json:"text"`
-}
-
-// initDB инициализирует подключение к базе данных
-func initDB() error {
+// openDB открывает подключение к базе данных без применения миграций
+func openDB() error {
 	var err error
-	db, err = sql.Open("sqlite3", DB_FILE)
+	// busy_timeout и WAL нужны, т.к. сообщения обрабатываются параллельно.
+	// _txlock=immediate: транзакция сразу берет блокировку на запись (резерв квоты)
+	db, err = sql.Open("sqlite3", DB_FILE+"?_busy_timeout=5000&_journal_mode=WAL&_txlock=immediate")
 	if err != nil {
 		return fmt.Errorf("ошибка открытия БД: %v", err)
 	}
@@ -48,65 +41,71 @@ func initDB() error {
 		return fmt.Errorf("ошибка подключения к БД: %v", err)
 	}
 
-	// Создаем таблицу мыслей если её нет
-	createThoughtsTableSQL := `
-	CREATE TABLE IF NOT EXISTS thoughts (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
-		thought_text TEXT NOT NULL,
-		category TEXT
-	);
-	`
+	return nil
+}
 
-	_, err = db.Exec(createThoughtsTableSQL)
-	if err != nil {
-		return fmt.Errorf("ошибка создания таблицы thoughts: %v", err)
+// initDB инициализирует подключение к базе данных и применяет миграции
+func initDB() error {
+	if err := openDB(); err != nil {
+		return err
 	}
 
-	// Создаем таблицу лимитов пользователей
-	createUserLimitsTableSQL := `
-	CREATE TABLE IF NOT EXISTS user_limits (
-		user_id INTEGER PRIMARY KEY,
-		username TEXT,
-		date DATE DEFAULT (date('now')),
-		request_count INTEGER DEFAULT 0
-	);
-	`
-
-	_, err = db.Exec(createUserLimitsTableSQL)
+	// Все таблицы бота создаются миграциями из каталога migrations/
+	count, err := migrateUp()
 	if err != nil {
-		return fmt.Errorf("ошибка создания таблицы user_limits: %v", err)
+		return fmt.Errorf("ошибка миграции БД: %v", err)
+	}
+
+	// Запросы на естественном языке ("база ...") идут через отдельное подключение только для чтения
+	// и видят только таблицы из nl_tables
+	if err := openReadDB(); err != nil {
+		return err
+	}
+	if nlSchema, err = loadNLSchema(); err != nil {
+		return err
 	}
 
 	log.Printf("💾 База данных подключена: %s", DB_FILE)
-	log.Printf("✅ Таблица 'thoughts' готова к работе")
-	log.Printf("✅ Таблица 'user_limits' готова к работе")
+	log.Printf("✅ Схема БД актуальна (применено новых миграций: %d)", count)
 	return nil
 }
 
+// MessageRecord - одна запись истории сообщений
+type MessageRecord struct {
+	ChatID       int64
+	UserID       int64
+	Username     string
+	MessageType  string // Тип входящего сообщения: text, voice, audio, video_note или document
+	Intent       string // Намерение: chat, thought, database
+	InputText    string
+	ResponseType string // Тип ответа: text или voice
+	ResponseText string
+}
+
 // saveMessage записывает сообщение в базу данных
-func saveMessage(userID int64, username, messageType, inputText, responseType, responseText string) error {
+func saveMessage(rec MessageRecord) error {
 	insertSQL := `
-	INSERT INTO messages (timestamp, user_id, username, message_type, input_text, response_type, response_text)
-	VALUES (datetime('now'), ?, ?, ?, ?, ?, ?)
+	INSERT INTO messages (timestamp, chat_id, user_id, username, message_type, intent, input_text, response_type, response_text)
+	VALUES (datetime('now'), ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 
-	_, err := db.Exec(insertSQL, userID, username, messageType, inputText, responseType, responseText)
+	_, err := db.Exec(insertSQL, rec.ChatID, rec.UserID, rec.Username, rec.MessageType, rec.Intent,
+		rec.InputText, rec.ResponseType, rec.ResponseText)
 	if err != nil {
 		return fmt.Errorf("ошибка записи в БД: %v", err)
 	}
-	log.Printf("💾 Сохранено в БД: user=%s, type=%s", username, messageType)
+	log.Printf("💾 Сохранено в БД: user=%s, type=%s", rec.Username, rec.MessageType)
 	return nil
 }
 
-// saveThought записывает мысль в базу данных
-func saveThought(thoughtText, category string) error {
+// saveThought записывает мысль пользователя в базу данных
+func saveThought(userID int64, thoughtText, category string) error {
 	insertSQL := `
-	INSERT INTO thoughts (timestamp, thought_text, category)
-	VALUES (datetime('now'), ?, ?)
+	INSERT INTO thoughts (timestamp, user_id, thought_text, category)
+	VALUES (datetime('now'), ?, ?, ?)
 	`
 
-	_, err := db.Exec(insertSQL, thoughtText, category)
+	_, err := db.Exec(insertSQL, userID, thoughtText, category)
 	if err != nil {
 		return fmt.Errorf("ошибка записи мысли в БД: %v", err)
 	}
@@ -114,190 +113,67 @@ func saveThought(thoughtText, category string) error {
 	return nil
 }
 
-// checkUserLimit проверяет, не превышен ли дневной лимит пользователя
-// Возвращает true если лимит превышен
-func checkUserLimit(userID int64, username string) bool {
-	// Владелец бота не имеет лимитов
-	if username == "roman8890" {
-		return false
-	}
-
-	const dailyLimit = 2
-
-	// Получаем счетчик запросов за сегодня
-	var requestCount int
-	var lastDate string
-
-	query := `SELECT request_count, date FROM user_limits WHERE user_id = ?`
-	err := db.QueryRow(query, userID).Scan(&requestCount, &lastDate)
-
-	if err == sql.ErrNoRows {
-		// Новый пользователь - создаем запись
-		insertSQL := `INSERT INTO user_limits (user_id, username, date, request_count) VALUES (?, ?, date('now'), 0)`
-		db.Exec(insertSQL, userID, username)
-		return false
-	}
-
-	if err != nil {
-		log.Printf("⚠️ Ошибка проверки лимита: %v", err)
-		return false // В случае ошибки разрешаем запрос
-	}
-
-	// Проверяем, сегодняшний ли день
-	today := strings.Split(lastDate, " ")[0] // Получаем только дату
-	currentDate := "" // Получим из БД
-	db.QueryRow(`SELECT date('now')`).Scan(&currentDate)
-
-	// Если дата изменилась - сбрасываем счетчик
-	if today != currentDate {
-		updateSQL := `UPDATE user_limits SET date = date('now'), request_count = 0 WHERE user_id = ?`
-		db.Exec(updateSQL, userID)
-		return false
-	}
-
-	// Проверяем лимит
-	if requestCount >= dailyLimit {
-		log.Printf("🚫 Пользователь %s (%d) превысил лимит: %d/%d", username, userID, requestCount, dailyLimit)
-		return true
-	}
-
-	return false
-}
-
-// incrementUserUsage увеличивает счетчик использования пользователя
-func incrementUserUsage(userID int64, username string) error {
-	// Владелец бота не имеет лимитов
-	if username == "roman8890" {
-		return nil
-	}
-
-	updateSQL := `
-	UPDATE user_limits
-	SET request_count = request_count + 1
-	WHERE user_id = ? AND date = date('now')
-	`
-
-	result, err := db.Exec(updateSQL, userID)
-	if err != nil {
-		return fmt.Errorf("ошибка увеличения счетчика: %v", err)
-	}
-
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected == 0 {
-		// Если записи нет, создаем ее
-		insertSQL := `INSERT INTO user_limits (user_id, username, date, request_count) VALUES (?, ?, date('now'), 1)`
-		_, err = db.Exec(insertSQL, userID, username)
-		if err != nil {
-			return fmt.Errorf("ошибка создания записи лимита: %v", err)
-		}
-	}
-
-	// Получаем текущий счетчик для лога
-	var count int
-	db.QueryRow(`SELECT request_count FROM user_limits WHERE user_id = ?`, userID).Scan(&count)
-	log.Printf("📊 Пользователь %s: запрос %d/2", username, count)
-
-	return nil
-}
-
-// generateSQL генерирует SQL запрос из текста пользователя через GPT
-func generateSQL(client *openai.Client, userQuery string) (string, error) {
-	ctx := context.Background()
-
+// generateSQL генерирует SQL запрос из текста пользователя через GPT.
+// attempts - предыдущие запросы с ошибками: модель видит их и исправляет запрос
+func generateSQL(ctx context.Context, client LLM, usage *Usage, userQuery string, attempts []sqlAttempt) (string, error) {
 	model := os.Getenv("OPENAI_MODEL")
 	if model == "" {
 		model = "gpt-4o-mini"
 	}
 
+	// Таблицы, колонки и примеры берутся из схемы БД и nl_tables/nl_columns (см. nlschema.go)
 	systemPrompt := `Ты эксперт SQL. Преобразуй запрос пользователя в SQL запрос для SQLite базы данных.
 
-База данных содержит ДВЕ таблицы:
-
-1. Таблица messages (история сообщений):
-- id (INTEGER PRIMARY KEY)
-- timestamp (DATETIME)
-- user_id (INTEGER)
-- username (TEXT)
-- message_type (TEXT) - тип сообщения: 'text' или 'voice'
-- input_text (TEXT) - текст входящего сообщения
-- response_type (TEXT) - тип ответа
-- response_text (TEXT) - текст ответа
-
-2. Таблица thoughts (мысли/заметки):
-- id (INTEGER PRIMARY KEY)
-- timestamp (DATETIME)
-- thought_text (TEXT) - текст мысли
-- category (TEXT) - категория мысли
-
+` + nlSchema.Describe() + `
 ВАЖНО:
 1. Отвечай ТОЛЬКО SQL запросом, без объяснений
 2. Используй SELECT запросы
 3. Ограничивай результаты через LIMIT если нужно
 4. НЕ используй DELETE, DROP, UPDATE, INSERT
 5. По умолчанию НЕ включай в SELECT поля user_id и username (если пользователь явно не спрашивает про пользователей)
-6. Используй LIMIT 10 по умолчанию для запросов "покажи записи"
-
-ШАБЛОНЫ ЗАПРОСОВ:
-
-Подсчет:
-- "сколько сообщений" → SELECT COUNT(*) as count FROM messages
-- "сколько голосовых" → SELECT COUNT(*) as count FROM messages WHERE message_type='voice'
-- "сколько текстовых" → SELECT COUNT(*) as count FROM messages WHERE message_type='text'
-
-Последние записи:
-- "последние N записей" → SELECT id, timestamp, message_type, input_text, response_text FROM messages ORDER BY timestamp DESC LIMIT N
-- "последнее сообщение" → SELECT id, timestamp, message_type, input_text, response_text FROM messages ORDER BY timestamp DESC LIMIT 1
-
-Поиск по содержанию:
-- "найди сообщения про [тема]" → SELECT id, timestamp, input_text FROM messages WHERE input_text LIKE '%тема%' LIMIT 10
-
-Статистика по типам:
-- "статистика по типам" → SELECT message_type, COUNT(*) as count FROM messages GROUP BY message_type
-
-Временные запросы:
-- "сегодняшние сообщения" → SELECT COUNT(*) as count FROM messages WHERE DATE(timestamp) = DATE('now')
-- "за последний час" → SELECT COUNT(*) as count FROM messages WHERE timestamp >= datetime('now', '-1 hour')
-
-ЗАПРОСЫ К ТАБЛИЦЕ МЫСЛЕЙ (thoughts):
-
-Подсчет мыслей:
-- "сколько мыслей" → SELECT COUNT(*) as count FROM thoughts
-- "сколько мыслей по категории [название]" → SELECT COUNT(*) as count FROM thoughts WHERE category='название'
-
-Последние мысли:
-- "последние N мыслей" → SELECT id, timestamp, thought_text, category FROM thoughts ORDER BY timestamp DESC LIMIT N
-- "последняя мысль" → SELECT id, timestamp, thought_text, category FROM thoughts ORDER BY timestamp DESC LIMIT 1
+6. Используй LIMIT 10 по умолчанию для запросов "покажи записи"`
 
-Поиск мыслей:
-- "найди мысли про [тема]" → SELECT id, timestamp, thought_text FROM thoughts WHERE thought_text LIKE '%тема%' LIMIT 10
-
-Мысли по категориям:
-- "покажи все категории мыслей" → SELECT DISTINCT category FROM thoughts WHERE category IS NOT NULL
-- "мысли категории [название]" → SELECT id, timestamp, thought_text FROM thoughts WHERE category='название' LIMIT 10`
+	messages := []openai.ChatCompletionMessage{
+		{
+			Role:    openai.ChatMessageRoleSystem,
+			Content: systemPrompt,
+		},
+		{
+			Role:    openai.ChatMessageRoleUser,
+			Content: userQuery,
+		},
+	}
+	for _, a := range attempts {
+		messages = append(messages,
+			openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: a.SQL},
+			openai.ChatCompletionMessage{
+				Role: openai.ChatMessageRoleUser,
+				Content: fmt.Sprintf("Этот запрос не выполнен: %s\n\nИсправь запрос. Используй только таблицы, "+
+					"колонки и функции из описания базы данных. Отвечай ТОЛЬКО SQL запросом", a.Error),
+			})
+	}
 
-	log.Printf("🔍 Генерирую SQL запрос для: %s", userQuery)
+	if len(attempts) == 0 {
+		log.Printf("🔍 Генерирую SQL запрос для: %s", userQuery)
+	} else {
+		log.Printf("🔁 Исправляю SQL запрос (попытка %d)", len(attempts)+1)
+	}
 
-	resp, err := client.CreateChatCompletion(
+	resp, err := createChatCompletion(
 		ctx,
+		client,
 		openai.ChatCompletionRequest{
-			Model: model,
-			Messages: []openai.ChatCompletionMessage{
-				{
-					Role:    openai.ChatMessageRoleSystem,
-					Content: systemPrompt,
-				},
-				{
-					Role:    openai.ChatMessageRoleUser,
-					Content: userQuery,
-				},
-			},
+			Model:    model,
+			Messages: messages,
 		},
 	)
 
 	if err != nil {
-		return "", fmt.Errorf("ошибка генерации SQL: %v", err)
+		return "", fmt.Errorf("ошибка генерации SQL: %w", err)
 	}
 
+	usage.AddLLM(resp.Usage)
+
 	if len(resp.Choices) == 0 {
 		return "", fmt.Errorf("GPT не вернул SQL запрос")
 	}
@@ -313,78 +189,34 @@ func generateSQL(client *openai.Client, userQuery string) (string, error) {
 	return sqlQuery, nil
 }
 
-// executeSQL выполняет SQL запрос и возвращает результаты в виде текста
-func executeSQL(sqlQuery string) (string, error) {
-	// Проверяем, что это SELECT запрос
-	upperQuery := strings.ToUpper(strings.TrimSpace(sqlQuery))
-	if !strings.HasPrefix(upperQuery, "SELECT") {
-		return "", fmt.Errorf("разрешены только SELECT запросы")
-	}
-
-	log.Printf("⚡ Выполняю SQL запрос...")
-
-	rows, err := db.Query(sqlQuery)
-	if err != nil {
-		return "", fmt.Errorf("ошибка выполнения SQL: %v", err)
+// sqlResultText - первые limit строк результата в виде текста для formatSQLResults
+func sqlResultText(result *sqlResult, limit int) string {
+	if len(result.Rows) == 0 {
+		return "Запрос выполнен успешно, но результатов не найдено."
 	}
-	defer rows.Close()
 
-	// Получаем названия колонок
-	columns, err := rows.Columns()
-	if err != nil {
-		return "", fmt.Errorf("ошибка получения колонок: %v", err)
-	}
-
-	// Формируем результат
-	var results []map[string]interface{}
-
-	for rows.Next() {
-		// Создаем слайс для сканирования значений
-		values := make([]interface{}, len(columns))
-		valuePtrs := make([]interface{}, len(columns))
-		for i := range values {
-			valuePtrs[i] = &values[i]
-		}
-
-		if err := rows.Scan(valuePtrs...); err != nil {
-			return "", fmt.Errorf("ошибка сканирования строки: %v", err)
-		}
-
-		// Формируем map для строки
-		row := make(map[string]interface{})
-		for i, col := range columns {
-			val := values[i]
-			if b, ok := val.([]byte); ok {
-				row[col] = string(b)
-			} else {
-				row[col] = val
-			}
-		}
-		results = append(results, row)
+	// Форматируем результаты в читаемый текст
+	rows := result.Rows
+	resultText := fmt.Sprintf("Найдено записей: %d\n\n", len(rows))
+	if len(rows) > limit {
+		rows = rows[:limit]
+		resultText = fmt.Sprintf("Найдено записей: %d, показаны первые %d\n\n", len(result.Rows), limit)
 	}
-
-	if len(results) == 0 {
-		return "Запрос выполнен успешно, но результатов не найдено.", nil
+	if result.Truncated {
+		resultText = fmt.Sprintf("Найдено больше %d записей, показаны первые %d\n\n", len(result.Rows), len(rows))
 	}
-
-	// Форматируем результаты в читаемый текст
-	resultText := fmt.Sprintf("Найдено записей: %d\n\n", len(results))
-	for i, row := range results {
+	for i, row := range rows {
 		resultText += fmt.Sprintf("Запись %d:\n", i+1)
-		for col, val := range row {
-			resultText += fmt.Sprintf("  %s: %v\n", col, val)
+		for j, col := range result.Columns {
+			resultText += fmt.Sprintf("  %s: %s\n", col, formatSQLValue(row[j]))
 		}
 		resultText += "\n"
 	}
-
-	log.Printf("✅ SQL выполнен успешно, записей: %d", len(results))
-	return resultText, nil
+	return resultText
 }
 
 // formatSQLResults форматирует результаты SQL через GPT для голосового ответа
-func formatSQLResults(client *openai.Client, userQuery, sqlResults string) (string, error) {
-	ctx := context.Background()
-
+func formatSQLResults(ctx context.Context, client LLM, usage *Usage, userQuery, sqlResults string) (string, error) {
 	model := os.Getenv("OPENAI_MODEL")
 	if model == "" {
 		model = "gpt-4o-mini"
@@ -402,8 +234,9 @@ func formatSQLResults(client *openai.Client, userQuery, sqlResults string) (stri
 
 	log.Printf("💬 Форматирую ответ для пользователя...")
 
-	resp, err := client.CreateChatCompletion(
+	resp, err := createChatCompletion(
 		ctx,
+		client,
 		openai.ChatCompletionRequest{
 			Model: model,
 			Messages: []openai.ChatCompletionMessage{
@@ -420,9 +253,11 @@ func formatSQLResults(client *openai.Client, userQuery, sqlResults string) (stri
 	)
 
 	if err != nil {
-		return "", fmt.Errorf("ошибка форматирования ответа: %v", err)
+		return "", fmt.Errorf("ошибка форматирования ответа: %w", err)
 	}
 
+	usage.AddLLM(resp.Usage)
+
 	if len(resp.Choices) == 0 {
 		return "Не удалось сформировать ответ.", nil
 	}
@@ -432,40 +267,60 @@ func formatSQLResults(client *openai.Client, userQuery, sqlResults string) (stri
 	return answer, nil
 }
 
-// getChatGPTResponse отправляет запрос к ChatGPT и возвращает ответ
-func getChatGPTResponse(client *openai.Client, userMessage string) (string, error) {
-	ctx := context.Background()
+// getChatGPTResponse отправляет запрос к ChatGPT с историей разговора и возвращает ответ.
+// Системный промпт, модель и параметры генерации берутся из персоны чата
+func getChatGPTResponse(ctx context.Context, client LLM, usage *Usage, persona *Persona, history []openai.ChatCompletionMessage, userMessage string) (string, error) {
+	if persona == nil {
+		persona = builtinPersona
+	}
 
-	model := os.Getenv("OPENAI_MODEL")
+	model := persona.Model
+	if model == "" {
+		model = os.Getenv("OPENAI_MODEL")
+	}
 	if model == "" {
 		model = "gpt-4o-mini"
 	}
 
-	log.Printf("🤖 Отправляю запрос в ChatGPT (модель: %s)", model)
-	log.Printf("📝 Сообщение пользователя: %s", userMessage)
+	log.Printf("🤖 Отправляю запрос в ChatGPT (модель: %s, персона: %s)", model, persona.Name)
+	log.Printf("📝 Сообщение пользователя: %s (реплик в истории: %d)", userMessage, len(history))
 
-	resp, err := client.CreateChatCompletion(
+	messages := []openai.ChatCompletionMessage{
+		{
+			Role:    openai.ChatMessageRoleSystem,
+			Content: persona.SystemPrompt,
+		},
+	}
+	messages = append(messages, history...)
+	messages = append(messages, openai.ChatCompletionMessage{
+		Role:    openai.ChatMessageRoleUser,
+		Content: userMessage,
+	})
+
+	// go-openai не отправляет нулевую температуру, поэтому 0 заменяется на минимальную положительную
+	temperature := 0.0
+	if persona.Temperature != nil {
+		temperature = math.Max(*persona.Temperature, math.SmallestNonzeroFloat32)
+	}
+
+	resp, err := createChatCompletion(
 		ctx,
+		client,
 		openai.ChatCompletionRequest{
-			Model: model,
-			Messages: []openai.ChatCompletionMessage{
-				{
-					Role:    openai.ChatMessageRoleSystem,
-					Content: "Ты эксперт IT Go Backend, отвечай коротко и по делу. Меньше 20 слов в ответе.",
-				},
-				{
-					Role:    openai.ChatMessageRoleUser,
-					Content: userMessage,
-				},
-			},
+			Model:       model,
+			Messages:    messages,
+			Temperature: float32(temperature),
+			MaxTokens:   persona.MaxTokens,
 		},
 	)
 
 	if err != nil {
 		log.Printf("❌ Ошибка от ChatGPT API: %v", err)
-		return "", fmt.Errorf("ошибка ChatGPT: %v", err)
+		return "", fmt.Errorf("ошибка ChatGPT: %w", err)
 	}
 
+	usage.AddLLM(resp.Usage)
+
 	if len(resp.Choices) == 0 {
 		log.Printf("⚠️  ChatGPT вернул пустой ответ")
 		return "Извините, не удалось получить ответ.", nil
@@ -477,118 +332,39 @@ func getChatGPTResponse(client *openai.Client, userMessage string) (string, erro
 	return answer, nil
 }
 
-// speechToText преобразует аудиофайл в текст с помощью ElevenLabs STT
-func speechToText(audioPath string) (string, error) {
-	// Открываем аудио файл
-	file, err := os.Open(audioPath)
-	if err != nil {
-		return "", fmt.Errorf("ошибка открытия файла: %v", err)
-	}
-	defer file.Close()
-
-	// Создаем multipart form
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
-
-	// Добавляем файл
-	part, err := writer.CreateFormFile("file", "audio.ogg")
-	if err != nil {
-		return "", fmt.Errorf("ошибка создания form file: %v", err)
-	}
-	if _, err := io.Copy(part, file); err != nil {
-		return "", fmt.Errorf("ошибка копирования файла: %v", err)
-	}
-
-	// Добавляем модель для STT
-	writer.WriteField("model_id", "scribe_v2") // Самая новая модель для распознавания
-
-	writer.Close()
-
-	// Отправляем запрос к ElevenLabs Speech-to-Text API
-	url := "https://api.elevenlabs.io/v1/speech-to-text"
-	req, err := http.NewRequest("POST", url, body)
-	if err != nil {
-		return "", fmt.Errorf("ошибка создания запроса: %v", err)
-	}
-
-	req.Header.Set("xi-api-key", os.Getenv("ELEVENLABS_API_KEY"))
-	req.Header.Set("Content-Type", writer.FormDataContentType())
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("ошибка отправки запроса: %v", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("ошибка API (статус %d): %s", resp.StatusCode, string(bodyBytes))
-	}
-
-	// Парсим ответ
-	var result ElevenLabsSTTResponse
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return "", fmt.Errorf("ошибка декодирования ответа: %v", err)
-	}
-
-	return result.Text, nil
-}
-
-// Функция для преобразования текста в голос через ElevenLabs
-func textToSpeech(text string) ([]byte, error) {
-	url := fmt.Sprintf("https://api.elevenlabs.io/v1/text-to-speech/%s", ELEVENLABS_VOICE)
-
-	requestBody := ElevenLabsRequest{
-		Text:    text,
-		ModelID: "eleven_multilingual_v2", // Поддержка русского языка
-	}
-
-	jsonData, err := json.Marshal(requestBody)
-	if err != nil {
-		return nil, fmt.Errorf("ошибка создания JSON: %v", err)
-	}
-
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+func main() {
+	// Загружаем переменные окружения из .env файла
+	err := godotenv.Load()
 	if err != nil {
-		return nil, fmt.Errorf("ошибка создания запроса: %v", err)
+		log.Fatal("Ошибка загрузки .env файла")
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("xi-api-key", os.Getenv("ELEVENLABS_API_KEY"))
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("ошибка отправки запроса: %v", err)
+	// Подкоманда управления миграциями: ./telegram-bot migrate [up|status]
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrateCommand(os.Args[2:]); err != nil {
+			log.Fatalf("❌ Ошибка миграции: %v", err)
+		}
+		return
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("ошибка API (статус %d): %s", resp.StatusCode, string(body))
+	// Инициализируем базу данных
+	if err := initDB(); err != nil {
+		log.Fatalf("❌ Ошибка инициализации БД: %v", err)
 	}
 
-	audioData, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("ошибка чтения аудио: %v", err)
+	if err := initTempDir(); err != nil {
+		log.Fatalf("❌ %v", err)
 	}
 
-	return audioData, nil
-}
-
-func main() {
-	// Загружаем переменные окружения из .env файла
-	err := godotenv.Load()
-	if err != nil {
-		log.Fatal("Ошибка загрузки .env файла")
+	configureQuota()
+	if err := releaseStaleReservations(); err != nil {
+		log.Printf("⚠️ %v", err)
 	}
 
-	// Инициализируем базу данных
-	if err := initDB(); err != nil {
-		log.Fatalf("❌ Ошибка инициализации БД: %v", err)
+	// Назначаем владельцев бота из конфигурации
+	if err := bootstrapOwners(); err != nil {
+		log.Fatalf("❌ Ошибка настройки владельцев: %v", err)
 	}
-	defer db.Close()
 
 	// Проверяем наличие ключей
 	openaiKey := os.Getenv("OPENAI_API_KEY")
@@ -597,11 +373,12 @@ func main() {
 	}
 	log.Printf("✅ OpenAI API ключ загружен (длина: %d)", len(openaiKey))
 
-	elevenlabsKey := os.Getenv("ELEVENLABS_API_KEY")
-	if elevenlabsKey == "" {
-		log.Fatal("❌ ELEVENLABS_API_KEY не найден в .env файле")
+	// Ключ ElevenLabs нужен только если выбраны провайдеры elevenlabs
+	if os.Getenv("ELEVENLABS_API_KEY") != "" {
+		log.Printf("✅ ElevenLabs API ключ загружен")
+	} else {
+		log.Printf("⚠️  ELEVENLABS_API_KEY не задан, провайдеры ElevenLabs недоступны")
 	}
-	log.Printf("✅ ElevenLabs API ключ загружен")
 
 	model := os.Getenv("OPENAI_MODEL")
 	if model == "" {
@@ -611,517 +388,331 @@ func main() {
 		log.Printf("✅ Модель OpenAI: %s", model)
 	}
 
-	// Создаем экземпляр бота
-	bot, err := tgbotapi.NewBotAPI(os.Getenv("TELEGRAM_BOT_TOKEN"))
+	// Ограничиваем время ответа внешних API, чтобы зависший сервис не останавливал бота
+	httpClient.Timeout = getEnvSeconds("HTTP_TIMEOUT", httpClient.Timeout)
+	// Временные ошибки (429, 5xx, сеть) повторяются с паузой, не доходя до пользователя
+	httpClient.Transport = newRetryTransportFromEnv(http.DefaultTransport)
+
+	// Создаем экземпляр бота. Long polling держит запрос до 60 секунд, поэтому у Telegram свой таймаут
+	bot, err := tgbotapi.NewBotAPIWithClient(os.Getenv("TELEGRAM_BOT_TOKEN"), tgbotapi.APIEndpoint,
+		&http.Client{Timeout: 90 * time.Second})
 	if err != nil {
 		log.Panic(err)
 	}
 
 	// Создаем клиент OpenAI
-	openaiClient := openai.NewClient(openaiKey)
+	openaiConfig := openai.DefaultConfig(openaiKey)
+	openaiConfig.HTTPClient = httpClient
+	openaiClient := openai.NewClientWithConfig(openaiConfig)
+
+	// Настраиваем распознавание речи (основной провайдер + запасные)
+	stt, err := newSTTFromConfig(openaiClient)
+	if err != nil {
+		log.Fatalf("❌ Ошибка настройки STT: %v", err)
+	}
+	sttLanguage := getEnv("STT_LANGUAGE", "ru")
+	if sttLanguage == "auto" {
+		sttLanguage = ""
+	}
+	log.Printf("✅ STT провайдер: %s (язык: %s)", stt.Name(), sttLanguage)
+
+	// Настраиваем синтез речи (основной провайдер + запасные)
+	tts, err := newTTSFromConfig(openaiClient)
+	if err != nil {
+		log.Fatalf("❌ Ошибка настройки TTS: %v", err)
+	}
+	log.Printf("✅ TTS провайдер: %s", tts.Name())
 
 	bot.Debug = false
 
 	log.Printf("🤖 Авторизован как %s", bot.Self.UserName)
 	log.Printf("🎙️ Бот с голосовыми сообщениями и ChatGPT запущен!")
 
-	// Настройка получения обновлений
-	u := tgbotapi.NewUpdate(0)
-	u.Timeout = 60
+	pipeline := NewPipeline(bot, openaiClient, stt, tts, sttLanguage)
 
-	updates := bot.GetUpdatesChan(u)
+	// Сообщения разных чатов обрабатываются параллельно, одного чата - по порядку
+	dispatcher := NewDispatcher(
+		getEnvInt("WORKER_COUNT", 4),
+		getEnvInt("QUEUE_SIZE", 100),
+		func(update *tgbotapi.Update) {
+			if update.CallbackQuery != nil {
+				handleCallback(bot, pipeline, update.CallbackQuery)
+				return
+			}
+			handleMessage(bot, pipeline, update.Message)
+		},
+		func(update *tgbotapi.Update) {
+			if update.CallbackQuery != nil {
+				bot.Request(tgbotapi.NewCallback(update.CallbackQuery.ID,
+					"⏳ Бот сейчас перегружен, попробуйте ещё раз через минуту"))
+				return
+			}
+			bot.Send(tgbotapi.NewMessage(update.Message.Chat.ID,
+				"⏳ Бот сейчас перегружен, попробуйте ещё раз через минуту"))
+		},
+	)
+	dispatcher.Start()
 
-	// Обработка входящих сообщений
-	for update := range updates {
+	// Получаем обновления через long polling или webhook (BOT_MODE)
+	source, err := newUpdateSourceFromConfig(bot)
+	if err != nil {
+		log.Fatalf("❌ Ошибка настройки получения обновлений: %v", err)
+	}
+	log.Printf("📡 Режим получения обновлений: %s", source.Name())
+
+	// По SIGINT/SIGTERM перестаем принимать обновления и дожидаемся обработки принятых
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	submit := func(update tgbotapi.Update) {
+		// Нажатия кнопок ходят в БД и к TTS (список голосов), поэтому тоже встают
+		// в очередь чата: цикл приема обновлений не должен ждать сеть.
+		// Порядок сохраняется - сообщение после нажатия увидит новые настройки
+		if update.CallbackQuery != nil {
+			dispatcher.Submit(&update)
+			return
+		}
 		if update.Message == nil {
-			continue
+			return
 		}
-
-		// Проверяем лимит запросов (кроме команд /start и /help)
-		if !update.Message.IsCommand() || (update.Message.IsCommand() && update.Message.Command() != "start" && update.Message.Command() != "help") {
-			// Получаем username, если нет - используем FirstName
-			username := update.Message.From.UserName
-			if username == "" {
-				username = update.Message.From.FirstName
-			}
-			userID := update.Message.From.ID
-
-			// Проверяем лимит
-			if checkUserLimit(userID, username) {
-				msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-					"⏳ Вы достигли дневного лимита запросов (2 запроса в день).\n\n"+
-						"Лимит обновляется каждый день в 00:00 UTC.\n"+
-						"Спасибо за понимание! 🙏")
-				bot.Send(msg)
-				log.Printf("🚫 Запрос от %s отклонен - лимит превышен", username)
-				continue
+		// /cancel не встает в очередь чата, иначе он дождется отменяемого запроса
+		if update.Message.IsCommand() && update.Message.Command() == "cancel" {
+			handleCancel(bot, pipeline, dispatcher, update.Message)
+			return
+		}
+		dispatcher.Submit(&update)
+	}
+
+	// Обработка входящих сообщений одинакова в обоих режимах
+	updates := source.Updates()
+receive:
+	for {
+		select {
+		case <-ctx.Done():
+			break receive
+		case update, ok := <-updates:
+			if !ok {
+				break receive
 			}
-
-			// Увеличиваем счетчик использования
-			incrementUserUsage(userID, username)
+			submit(update)
 		}
+	}
 
-		// Обработка голосовых сообщений
-		if update.Message.Voice != nil {
-			username := update.Message.From.UserName
-			if username == "" {
-				username = update.Message.From.FirstName
-			}
-			log.Printf("🎤 [%s] Получено голосовое сообщение", username)
-
-			// Отправляем уведомление
-			statusMsg := tgbotapi.NewMessage(update.Message.Chat.ID, "🎧 Распознаю голос...")
-			bot.Send(statusMsg)
-
-			// Получаем информацию о файле
-			fileConfig := tgbotapi.FileConfig{FileID: update.Message.Voice.FileID}
-			file, err := bot.GetFile(fileConfig)
-			if err != nil {
-				log.Printf("Ошибка получения файла: %v", err)
-				msg := tgbotapi.NewMessage(update.Message.Chat.ID, "❌ Ошибка получения голосового файла")
-				bot.Send(msg)
-				continue
-			}
+	// Повторный сигнал завершит процесс сразу
+	stop()
+	log.Printf("🛑 Останавливаю прием обновлений")
+	source.Stop()
+	drainUpdates(updates, submit)
 
-			// Скачиваем файл
-			fileURL := file.Link(os.Getenv("TELEGRAM_BOT_TOKEN"))
-			resp, err := http.Get(fileURL)
-			if err != nil {
-				log.Printf("Ошибка скачивания: %v", err)
-				continue
-			}
-			defer resp.Body.Close()
+	shutdown(dispatcher, pipeline, time.Duration(getEnvInt("SHUTDOWN_TIMEOUT", 25))*time.Second)
+	log.Printf("👋 Бот остановлен")
+}
 
-			// Сохраняем во временный файл
-			tmpFile, err := os.CreateTemp("", "voice-*.ogg")
-			if err != nil {
-				log.Printf("Ошибка создания файла: %v", err)
-				continue
-			}
-			tmpFileName := tmpFile.Name()
-			defer os.Remove(tmpFileName)
+// handleMessage проверяет доступ и лимит и передает сообщение в команду или pipeline
+func handleMessage(bot *tgbotapi.BotAPI, pipeline *Pipeline, message *tgbotapi.Message) {
+	if message.From == nil {
+		return
+	}
 
-			if _, err := io.Copy(tmpFile, resp.Body); err != nil {
-				log.Printf("Ошибка сохранения: %v", err)
-				tmpFile.Close()
-				continue
-			}
-			tmpFile.Close()
-
-			// Распознаем голос через ElevenLabs STT
-			recognizedText, err := speechToText(tmpFileName)
-			if err != nil {
-				log.Printf("Ошибка распознавания: %v", err)
-				msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-					fmt.Sprintf("❌ Ошибка распознавания: %v", err))
-				bot.Send(msg)
-				continue
-			}
+	user, err := ensureUser(message.From)
+	if err != nil {
+		log.Printf("Ошибка регистрации пользователя: %v", err)
+		bot.Send(tgbotapi.NewMessage(message.Chat.ID, "❌ Внутренняя ошибка, попробуйте позже"))
+		return
+	}
 
-			log.Printf("📝 Распознано: %s", recognizedText)
-
-			var gptResponse string
-
-			// Проверяем ключевые слова
-			lowerText := strings.ToLower(strings.TrimSpace(recognizedText))
-			if strings.HasPrefix(lowerText, "мысль") {
-				// Проверяем права доступа
-				if update.Message.From.UserName != "roman8890" {
-					msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-						"❌ У вас нет доступа к этой функции")
-					bot.Send(msg)
-					log.Printf("🚫 Попытка сохранить мысль от пользователя %s", update.Message.From.UserName)
-					continue
-				}
-
-				// Убираем слово "мысль" из текста
-				thoughtText := strings.TrimSpace(strings.TrimPrefix(lowerText, "мысль"))
-
-				if thoughtText == "" {
-					msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-						"❌ Укажите текст мысли после слова 'мысль'")
-					bot.Send(msg)
-					continue
-				}
-
-				log.Printf("💭 Сохраняю мысль: %s", thoughtText)
-
-				// Сохраняем мысль в БД
-				err := saveThought(thoughtText, "general")
-				if err != nil {
-					log.Printf("Ошибка сохранения мысли: %v", err)
-					msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-						fmt.Sprintf("❌ Ошибка сохранения: %v", err))
-					bot.Send(msg)
-					continue
-				}
-
-				// Озвучиваем подтверждение
-				gptResponse = "Мысль сохранена"
-
-			} else if strings.HasPrefix(lowerText, "база") {
-				// Убираем слово "база" из запроса
-				userQuery := strings.TrimSpace(strings.TrimPrefix(lowerText, "база"))
-
-				log.Printf("💾 Обработка запроса к базе данных: %s", userQuery)
-
-				// Отправляем уведомление
-				statusMsg2 := tgbotapi.NewMessage(update.Message.Chat.ID,
-					"💾 Обрабатываю запрос к базе данных...")
-				bot.Send(statusMsg2)
-
-				// 1. Генерируем SQL запрос через GPT
-				sqlQuery, err := generateSQL(openaiClient, userQuery)
-				if err != nil {
-					log.Printf("Ошибка генерации SQL: %v", err)
-					msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-						fmt.Sprintf("❌ Ошибка генерации SQL: %v", err))
-					bot.Send(msg)
-					continue
-				}
-
-				// 2. Выполняем SQL запрос
-				sqlResults, err := executeSQL(sqlQuery)
-				if err != nil {
-					log.Printf("Ошибка выполнения SQL: %v", err)
-					msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-						fmt.Sprintf("❌ Ошибка выполнения запроса: %v", err))
-					bot.Send(msg)
-					continue
-				}
-
-				// 3. Форматируем результаты через GPT
-				gptResponse, err = formatSQLResults(openaiClient, userQuery, sqlResults)
-				if err != nil {
-					log.Printf("Ошибка форматирования ответа: %v", err)
-					msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-						fmt.Sprintf("❌ Ошибка форматирования: %v", err))
-					bot.Send(msg)
-					continue
-				}
-			} else {
-				// Обычный режим - отправляем вопрос в ChatGPT
-				statusMsg2 := tgbotapi.NewMessage(update.Message.Chat.ID,
-					fmt.Sprintf("🤖 Вы сказали: \"%s\"\n\nДумаю над ответом...", recognizedText))
-				bot.Send(statusMsg2)
-
-				gptResponse, err = getChatGPTResponse(openaiClient, recognizedText)
-				if err != nil {
-					log.Printf("Ошибка ChatGPT: %v", err)
-					msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-						fmt.Sprintf("❌ Ошибка получения ответа от ChatGPT: %v", err))
-					bot.Send(msg)
-					continue
-				}
-			}
+	if user.Role == RoleBlocked {
+		log.Printf("🚫 Сообщение от заблокированного пользователя %s (%d)", user.DisplayName(), user.ID)
+		bot.Send(tgbotapi.NewMessage(message.Chat.ID, "🚫 Доступ к боту заблокирован"))
+		return
+	}
 
-			log.Printf("💬 GPT ответ: %s", gptResponse)
+	// Голосовые и текстовые сообщения проходят через общий pipeline
+	if message.IsCommand() {
+		handleCommand(bot, pipeline, user, message)
+	} else if mediaFromMessage(message) != nil || message.Text != "" {
+		handlePipelineRequest(bot, pipeline, user, newRequest(user, message))
+	}
+}
 
-			// Ограничение длины для озвучивания
-			if len(gptResponse) > 500 {
-				msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-					fmt.Sprintf("📝 Ответ:\n%s\n\n⚠️ Ответ слишком длинный для озвучивания", gptResponse))
-				bot.Send(msg)
-				continue
-			}
+// handlePipelineRequest резервирует квоту пользователя и запускает pipeline.
+// Pipeline заменяет резерв фактическим расходом или возвращает его при ошибке
+func handlePipelineRequest(bot *tgbotapi.BotAPI, pipeline *Pipeline, user *User, req *Request) {
+	reservation, exceeded, err := reserveQuota(user, req.MessageType)
+	if err != nil {
+		// В случае ошибки разрешаем запрос
+		log.Printf("⚠️ Ошибка проверки квоты: %v", err)
+	}
+	if exceeded != nil {
+		bot.Send(tgbotapi.NewMessage(req.ChatID, formatQuotaExceeded(exceeded)))
+		log.Printf("🚫 Запрос от %s отклонен - квота исчерпана", user.DisplayName())
+		return
+	}
 
-			// Отправляем уведомление о генерации голоса
-			statusMsg3 := tgbotapi.NewMessage(update.Message.Chat.ID, "🎤 Генерирую голосовое сообщение...")
-			bot.Send(statusMsg3)
-
-			// Преобразуем ответ в голос через ElevenLabs TTS
-			audioData, err := textToSpeech(gptResponse)
-			if err != nil {
-				log.Printf("Ошибка TTS: %v", err)
-				msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-					fmt.Sprintf("📝 %s\n\n❌ Ошибка генерации голоса: %v", gptResponse, err))
-				bot.Send(msg)
-				continue
-			}
+	prefs, err := getPreferences(user.ID)
+	if err != nil {
+		// Без настроек отвечаем как по умолчанию
+		log.Printf("⚠️ %v", err)
+	}
 
-			// Сохраняем и отправляем голосовое сообщение
-			tmpFile2, err := os.CreateTemp("", "voice-response-*.mp3")
-			if err != nil {
-				log.Printf("Ошибка создания файла: %v", err)
-				continue
-			}
-			defer os.Remove(tmpFile2.Name())
-
-			tmpFile2.Write(audioData)
-			tmpFile2.Close()
-
-			voice := tgbotapi.NewVoice(update.Message.Chat.ID, tgbotapi.FilePath(tmpFile2.Name()))
-			voice.Caption = fmt.Sprintf("🔊 %s", gptResponse)
-			if _, err := bot.Send(voice); err != nil {
-				log.Printf("Ошибка отправки голоса: %v", err)
-			} else {
-				// Сохраняем в БД только при успешной отправке
-				username := update.Message.From.UserName
-				if username == "" {
-					username = update.Message.From.FirstName
-				}
-				saveMessage(
-					update.Message.From.ID,
-					username,
-					"voice",
-					recognizedText,
-					"voice",
-					gptResponse,
-				)
-			}
+	persona, err := chatPersona(req.ChatID)
+	if err != nil {
+		log.Printf("⚠️ %v", err)
+	}
+
+	req.Quota = reservation
+	req.Prefs = prefs
+	req.Persona = persona
+	pipeline.Handle(req)
+}
+
+// handleCancel отменяет текущий запрос чата и сообщения, ждущие в очереди
+func handleCancel(bot *tgbotapi.BotAPI, pipeline *Pipeline, dispatcher *Dispatcher, message *tgbotapi.Message) {
+	chatID := message.Chat.ID
+	dropped := dispatcher.Cancel(chatID)
+	active := pipeline.Cancel(chatID)
+	log.Printf("🛑 /cancel в чате %d: текущий запрос %t, из очереди %d", chatID, active, dropped)
+
+	switch {
+	case dropped > 0:
+		bot.Send(tgbotapi.NewMessage(chatID, fmt.Sprintf("🛑 Отменено сообщений в очереди: %d", dropped)))
+	case !active:
+		bot.Send(tgbotapi.NewMessage(chatID, "🤷 Сейчас нечего отменять"))
+	}
+	// Об отмене текущего запроса сообщает сам pipeline
+}
+
+// handleCallback передает нажатие inline-кнопки меню, которому она принадлежит
+func handleCallback(bot *tgbotapi.BotAPI, pipeline *Pipeline, query *tgbotapi.CallbackQuery) {
+	if query.Message == nil {
+		bot.Request(tgbotapi.NewCallback(query.ID, ""))
+		return
+	}
+
+	user, err := ensureUser(query.From)
+	if err != nil {
+		log.Printf("Ошибка регистрации пользователя: %v", err)
+		bot.Request(tgbotapi.NewCallback(query.ID, "❌ Внутренняя ошибка, попробуйте позже"))
+		return
+	}
+	if user.Role == RoleBlocked {
+		bot.Request(tgbotapi.NewCallback(query.ID, "🚫 Доступ к боту заблокирован"))
+		return
+	}
+
+	switch {
+	case strings.HasPrefix(query.Data, "set:"):
+		handleSettingsCallback(bot, pipeline, user, query)
+	case strings.HasPrefix(query.Data, "persona:"):
+		handlePersonaCallback(bot, user, query)
+	default:
+		bot.Request(tgbotapi.NewCallback(query.ID, ""))
+	}
+}
 
-			log.Printf("✅ Голосовое сообщение успешно обработано")
-			continue
+// handleCommand обрабатывает команды бота
+func handleCommand(bot *tgbotapi.BotAPI, pipeline *Pipeline, user *User, message *tgbotapi.Message) {
+	if adminCommands[message.Command()] {
+		handleAdminCommand(bot, user, message)
+		return
+	}
+	if personaCommands[message.Command()] {
+		handlePersonaCommand(bot, pipeline, user, message)
+		return
+	}
+
+	switch message.Command() {
+	case "start":
+		msg := tgbotapi.NewMessage(message.Chat.ID,
+			"🎙️ Привет! Я голосовой бот с ChatGPT!\n\n"+
+				"✨ Что я умею:\n"+
+				"🎤 Голос → GPT → Голос\n"+
+				"📝 Текст → GPT → Голос\n"+
+				"🔊 /voice [текст] → Голос\n\n"+
+				"Команды:\n"+
+				"/voice [текст] - просто озвучить текст\n"+
+				"/reset - начать разговор заново\n"+
+				"/cancel - отменить текущий запрос\n"+
+				"/settings - голос и вид ответа\n"+
+				"/persona - стиль ответов (персона)\n"+
+				"/quota - остаток лимита\n"+
+				"/help - помощь\n\n"+
+				"💡 Попробуйте задать любой вопрос!\n\n"+
+				"Пишите или говорите - я отвечу голосом! 🤖🔊")
+		bot.Send(msg)
+
+	case "help":
+		// Провайдеры выбираются через STT_PROVIDERS/TTS_PROVIDERS, поэтому берем их имена из пайплайна
+		sttName, ttsName := pipeline.stt.Name(), pipeline.tts.Name()
+		msg := tgbotapi.NewMessage(message.Chat.ID,
+			"🎙️ Как я работаю:\n\n"+
+				"1️⃣ 🎤 ГОЛОСОВОЕ сообщение:\n"+
+				"   → STT → ChatGPT → TTS\n\n"+
+				"2️⃣ 📝 ТЕКСТ:\n"+
+				"   → ChatGPT → TTS\n\n"+
+				"3️⃣ 🔊 /voice [текст]:\n"+
+				"   → Просто озвучивает текст\n\n"+
+				"🧠 Я помню последние реплики разговора,\n"+
+				"   /reset - начать заново\n\n"+
+				"🛑 /cancel - отменить запрос, который я сейчас обрабатываю\n\n"+
+				"⚙️ /settings - выбрать голос, его настройки и вид ответа (голос, текст или оба)\n\n"+
+				"🎭 /persona - выбрать персону чата: стиль ответов ChatGPT и голос\n\n"+
+				"Технологии:\n"+
+				"🤖 ChatGPT (gpt-4o-mini)\n"+
+				"🎤 STT: "+sttName+"\n"+
+				"🔊 TTS: "+ttsName+"\n\n"+
+				"⏳ Лимиты: /quota")
+		bot.Send(msg)
+
+		if user.Can(PermAdmin) {
+			bot.Send(tgbotapi.NewMessage(message.Chat.ID, adminHelp))
+		}
+		if user.Can(PermPersonas) {
+			bot.Send(tgbotapi.NewMessage(message.Chat.ID, personaHelp))
 		}
 
-		// Обработка команд
-		if update.Message.IsCommand() {
-			switch update.Message.Command() {
-			case "start":
-				msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-					"🎙️ Привет! Я голосовой бот с ChatGPT и ElevenLabs!\n\n"+
-						"✨ Что я умею:\n"+
-						"🎤 Голос → GPT → Голос\n"+
-						"📝 Текст → GPT → Голос\n"+
-						"🔊 /voice [текст] → Голос\n\n"+
-						"Команды:\n"+
-						"/voice [текст] - просто озвучить текст\n"+
-						"/help - помощь\n\n"+
-						"💡 Попробуйте задать любой вопрос!\n\n"+
-						"Пишите или говорите - я отвечу голосом! 🤖🔊")
-				bot.Send(msg)
-
-			case "help":
-				msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-					"🎙️ Как я работаю:\n\n"+
-						"1️⃣ 🎤 ГОЛОСОВОЕ сообщение:\n"+
-						"   → ElevenLabs STT → ChatGPT → ElevenLabs TTS\n\n"+
-						"2️⃣ 📝 ТЕКСТ:\n"+
-						"   → ChatGPT → ElevenLabs TTS\n\n"+
-						"3️⃣ 🔊 /voice [текст]:\n"+
-						"   → Просто озвучивает текст\n\n"+
-						"Технологии:\n"+
-						"🤖 ChatGPT (gpt-4o-mini)\n"+
-						"🎤 ElevenLabs STT (scribe_v2)\n"+
-						"🔊 ElevenLabs TTS (multilingual_v2)\n\n"+
-						"⏳ Лимит: 2 запроса в день")
-				bot.Send(msg)
-
-			case "voice":
-				// Получаем текст после команды
-				text := strings.TrimSpace(strings.TrimPrefix(update.Message.Text, "/voice"))
-				if text == "" {
-					msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-						"Укажите текст после команды:\n/voice Ваш текст здесь")
-					bot.Send(msg)
-					continue
-				}
-
-				// Отправляем уведомление о генерации
-				statusMsg := tgbotapi.NewMessage(update.Message.Chat.ID,
-					"🎤 Генерирую голосовое сообщение...")
-				bot.Send(statusMsg)
-
-				// Преобразуем текст в голос
-				audioData, err := textToSpeech(text)
-				if err != nil {
-					log.Printf("Ошибка ElevenLabs: %v", err)
-					msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-						fmt.Sprintf("❌ Ошибка генерации голоса: %v", err))
-					bot.Send(msg)
-					continue
-				}
-
-				// Сохраняем во временный файл
-				tmpFile, err := os.CreateTemp("", "voice-*.mp3")
-				if err != nil {
-					log.Printf("Ошибка создания файла: %v", err)
-					continue
-				}
-				defer os.Remove(tmpFile.Name())
-
-				if _, err := tmpFile.Write(audioData); err != nil {
-					log.Printf("Ошибка записи файла: %v", err)
-					tmpFile.Close()
-					continue
-				}
-				tmpFile.Close()
-
-				// Отправляем голосовое сообщение
-				voice := tgbotapi.NewVoice(update.Message.Chat.ID, tgbotapi.FilePath(tmpFile.Name()))
-				voice.Caption = fmt.Sprintf("🔊 %s", text)
-				if _, err := bot.Send(voice); err != nil {
-					log.Printf("Ошибка отправки голоса: %v", err)
-					msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-						"❌ Ошибка отправки голосового сообщения")
-					bot.Send(msg)
-				}
-
-			default:
-				msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-					"Неизвестная команда. Используйте /help")
-				bot.Send(msg)
-			}
-		} else if update.Message.Text != "" {
-			// Обычные текстовые сообщения
-			username := update.Message.From.UserName
-			if username == "" {
-				username = update.Message.From.FirstName
-			}
-			userText := update.Message.Text
-			log.Printf("[%s] %s", username, userText)
-
-			var gptResponse string
-
-			// Проверяем ключевые слова
-			lowerText := strings.ToLower(strings.TrimSpace(userText))
-			if strings.HasPrefix(lowerText, "мысль") {
-				// Проверяем права доступа
-				if update.Message.From.UserName != "roman8890" {
-					msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-						"❌ У вас нет доступа к этой функции")
-					bot.Send(msg)
-					log.Printf("🚫 Попытка сохранить мысль от пользователя %s", update.Message.From.UserName)
-					continue
-				}
-
-				// Убираем слово "мысль" из текста
-				thoughtText := strings.TrimSpace(strings.TrimPrefix(lowerText, "мысль"))
-
-				if thoughtText == "" {
-					msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-						"❌ Укажите текст мысли после слова 'мысль'")
-					bot.Send(msg)
-					continue
-				}
-
-				log.Printf("💭 Сохраняю мысль: %s", thoughtText)
-
-				// Сохраняем мысль в БД
-				err := saveThought(thoughtText, "general")
-				if err != nil {
-					log.Printf("Ошибка сохранения мысли: %v", err)
-					msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-						fmt.Sprintf("❌ Ошибка сохранения: %v", err))
-					bot.Send(msg)
-					continue
-				}
-
-				// Озвучиваем подтверждение
-				gptResponse = "Мысль сохранена"
-
-			} else if strings.HasPrefix(lowerText, "база") {
-				// Убираем слово "база" из запроса
-				userQuery := strings.TrimSpace(strings.TrimPrefix(lowerText, "база"))
-
-				log.Printf("💾 Обработка запроса к базе данных: %s", userQuery)
-
-				// Отправляем уведомление
-				statusMsg := tgbotapi.NewMessage(update.Message.Chat.ID,
-					"💾 Обрабатываю запрос к базе данных...")
-				bot.Send(statusMsg)
-
-				// 1. Генерируем SQL запрос через GPT
-				sqlQuery, err := generateSQL(openaiClient, userQuery)
-				if err != nil {
-					log.Printf("Ошибка генерации SQL: %v", err)
-					msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-						fmt.Sprintf("❌ Ошибка генерации SQL: %v", err))
-					bot.Send(msg)
-					continue
-				}
-
-				// 2. Выполняем SQL запрос
-				sqlResults, err := executeSQL(sqlQuery)
-				if err != nil {
-					log.Printf("Ошибка выполнения SQL: %v", err)
-					msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-						fmt.Sprintf("❌ Ошибка выполнения запроса: %v", err))
-					bot.Send(msg)
-					continue
-				}
-
-				// 3. Форматируем результаты через GPT
-				gptResponse, err = formatSQLResults(openaiClient, userQuery, sqlResults)
-				if err != nil {
-					log.Printf("Ошибка форматирования ответа: %v", err)
-					msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-						fmt.Sprintf("❌ Ошибка форматирования: %v", err))
-					bot.Send(msg)
-					continue
-				}
-			} else {
-				// Обычный режим - получаем ответ от ChatGPT
-				statusMsg := tgbotapi.NewMessage(update.Message.Chat.ID,
-					"🤖 Думаю над ответом...")
-				bot.Send(statusMsg)
-
-				gptResponse, err = getChatGPTResponse(openaiClient, userText)
-				if err != nil {
-					log.Printf("Ошибка ChatGPT: %v", err)
-					msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-						fmt.Sprintf("❌ Ошибка получения ответа от ChatGPT: %v", err))
-					bot.Send(msg)
-					continue
-				}
-			}
+	case "voice":
+		// Получаем текст после команды
+		text := strings.TrimSpace(message.CommandArguments())
+		if text == "" {
+			msg := tgbotapi.NewMessage(message.Chat.ID,
+				"Укажите текст после команды:\n/voice Ваш текст здесь")
+			bot.Send(msg)
+			return
+		}
 
-			log.Printf("💬 GPT ответ: %s", gptResponse)
+		// Озвучиваем текст через тот же pipeline, минуя GPT
+		req := newRequest(user, message)
+		req.Intent = IntentSpeak
+		req.Payload = text
+		handlePipelineRequest(bot, pipeline, user, req)
 
-			// Ограничение длины текста для озвучивания
-			if len(gptResponse) > 500 {
-				// Отправляем текстовый ответ, если слишком длинный
-				msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-					fmt.Sprintf("📝 %s\n\n⚠️ Ответ слишком длинный для озвучивания (макс. 500 символов)", gptResponse))
-				bot.Send(msg)
-				continue
-			}
+	case "settings":
+		handleSettingsCommand(bot, pipeline, user, message)
 
-			// Генерируем голос
-			statusMsg2 := tgbotapi.NewMessage(update.Message.Chat.ID,
-				"🎤 Генерирую голосовое сообщение...")
-			bot.Send(statusMsg2)
-
-			audioData, err := textToSpeech(gptResponse)
-			if err != nil {
-				log.Printf("Ошибка ElevenLabs: %v", err)
-				// Отправляем хотя бы текстовый ответ
-				msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-					fmt.Sprintf("📝 %s\n\n❌ Ошибка генерации голоса: %v", gptResponse, err))
-				bot.Send(msg)
-				continue
-			}
+	case "persona":
+		handlePersonaSwitch(bot, user, message)
 
-			// Сохраняем и отправляем
-			tmpFile, err := os.CreateTemp("", "voice-*.mp3")
-			if err != nil {
-				log.Printf("Ошибка создания файла: %v", err)
-				continue
-			}
-			defer os.Remove(tmpFile.Name())
-
-			tmpFile.Write(audioData)
-			tmpFile.Close()
-
-			voice := tgbotapi.NewVoice(update.Message.Chat.ID, tgbotapi.FilePath(tmpFile.Name()))
-			voice.Caption = fmt.Sprintf("🔊 %s", gptResponse)
-			if _, err := bot.Send(voice); err != nil {
-				log.Printf("Ошибка отправки голоса: %v", err)
-			} else {
-				// Сохраняем в БД только при успешной отправке
-				username := update.Message.From.UserName
-				if username == "" {
-					username = update.Message.From.FirstName
-				}
-				saveMessage(
-					update.Message.From.ID,
-					username,
-					"text",
-					userText,
-					"voice",
-					gptResponse,
-				)
-			}
+	case "quota":
+		text, err := formatQuota(user)
+		if err != nil {
+			log.Printf("Ошибка получения квоты: %v", err)
+			bot.Send(tgbotapi.NewMessage(message.Chat.ID, "❌ Не удалось получить квоту"))
+			return
 		}
+		bot.Send(tgbotapi.NewMessage(message.Chat.ID, text))
+
+	case "reset":
+		if err := resetConversation(message.Chat.ID); err != nil {
+			log.Printf("Ошибка сброса разговора: %v", err)
+			bot.Send(tgbotapi.NewMessage(message.Chat.ID, "❌ Не удалось сбросить разговор"))
+			return
+		}
+		bot.Send(tgbotapi.NewMessage(message.Chat.ID, "🧹 Начинаем разговор заново"))
+
+	default:
+		msg := tgbotapi.NewMessage(message.Chat.ID,
+			"Неизвестная команда. Используйте /help")
+		bot.Send(msg)
 	}
 }
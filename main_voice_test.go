@@ -0,0 +1,41 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+// openTestDB создает БД во временном каталоге теста, как initDB: применяет миграции,
+// открывает подключение только для чтения и загружает nlSchema.
+// Глобальные db, readDB и nlSchema восстанавливаются после теста
+func openTestDB(t *testing.T) {
+	t.Helper()
+
+	prevDB, prevReadDB, prevSchema := db, readDB, nlSchema
+	t.Cleanup(func() {
+		if readDB != nil {
+			readDB.Close()
+		}
+		db.Close()
+		db, readDB, nlSchema = prevDB, prevReadDB, prevSchema
+	})
+
+	path := filepath.Join(t.TempDir(), "bot_test.db")
+	var err error
+	db, err = sql.Open("sqlite3", path+"?_busy_timeout=5000&_journal_mode=WAL&_txlock=immediate")
+	if err != nil {
+		t.Fatalf("ошибка открытия БД: %v", err)
+	}
+	if _, err := migrateUp(); err != nil {
+		t.Fatalf("ошибка миграции БД: %v", err)
+	}
+
+	readDB, err = sql.Open(readDriver, "file:"+path+"?mode=ro&_query_only=true&_busy_timeout=5000")
+	if err != nil {
+		t.Fatalf("ошибка открытия БД для чтения: %v", err)
+	}
+	if nlSchema, err = loadNLSchema(); err != nil {
+		t.Fatalf("ошибка загрузки схемы: %v", err)
+	}
+}
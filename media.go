@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// MediaInput - входящее аудио или видео, из которого распознается речь
+type MediaInput struct {
+	Kind     string // voice, audio, video_note или document
+	FileID   string
+	FileName string // Имя файла у audio и document, по нему определяется расширение
+	MimeType string
+	Size     int64         // Размер по данным Telegram, 0 - неизвестен
+	Duration time.Duration // Длительность по данным Telegram, 0 - неизвестна (document)
+}
+
+// IsVideo - у файла есть видеодорожка, звук из него можно только извлечь
+func (m *MediaInput) IsVideo() bool {
+	return m.Kind == "video_note" || strings.HasPrefix(m.MimeType, "video/")
+}
+
+// Ext - расширение файла для сохранения на диск
+func (m *MediaInput) Ext() string {
+	if ext := filepath.Ext(m.FileName); ext != "" {
+		return strings.ToLower(ext)
+	}
+	switch {
+	case m.Kind == "voice":
+		return ".ogg"
+	case m.IsVideo():
+		return ".mp4"
+	case m.MimeType == "audio/mpeg":
+		return ".mp3"
+	case m.MimeType == "audio/ogg":
+		return ".ogg"
+	default:
+		return ".bin"
+	}
+}
+
+// mediaFromMessage находит в сообщении голосовое, аудио, видеосообщение или аудио/видео документ.
+// nil - распознавать нечего
+func mediaFromMessage(message *tgbotapi.Message) *MediaInput {
+	switch {
+	case message.Voice != nil:
+		v := message.Voice
+		return &MediaInput{Kind: "voice", FileID: v.FileID, MimeType: v.MimeType,
+			Size: int64(v.FileSize), Duration: time.Duration(v.Duration) * time.Second}
+	case message.Audio != nil:
+		a := message.Audio
+		return &MediaInput{Kind: "audio", FileID: a.FileID, FileName: a.FileName, MimeType: a.MimeType,
+			Size: int64(a.FileSize), Duration: time.Duration(a.Duration) * time.Second}
+	case message.VideoNote != nil:
+		v := message.VideoNote
+		return &MediaInput{Kind: "video_note", FileID: v.FileID, MimeType: "video/mp4",
+			Size: int64(v.FileSize), Duration: time.Duration(v.Duration) * time.Second}
+	case message.Document != nil:
+		d := message.Document
+		if !strings.HasPrefix(d.MimeType, "audio/") && !strings.HasPrefix(d.MimeType, "video/") {
+			return nil
+		}
+		return &MediaInput{Kind: "document", FileID: d.FileID, FileName: d.FileName, MimeType: d.MimeType,
+			Size: int64(d.FileSize)}
+	}
+	return nil
+}
+
+// mediaLimits - ограничения на входящие файлы
+type mediaLimits struct {
+	MaxBytes    int64         // Telegram Bot API отдает файлы не больше 20 МБ
+	MaxDuration time.Duration // Дольше - не распознается
+}
+
+// mediaLimitsFromEnv читает ограничения из MEDIA_MAX_MB и MEDIA_MAX_DURATION
+func mediaLimitsFromEnv() mediaLimits {
+	return mediaLimits{
+		MaxBytes:    int64(getEnvFloat("MEDIA_MAX_MB", 20) * 1024 * 1024),
+		MaxDuration: getEnvSeconds("MEDIA_MAX_DURATION", 10*time.Minute),
+	}
+}
+
+// check проверяет файл по данным Telegram, до скачивания
+func (l mediaLimits) check(m *MediaInput) error {
+	if l.MaxBytes > 0 && m.Size > l.MaxBytes {
+		return fmt.Errorf("файл слишком большой (%.1f МБ, максимум %.3g МБ)",
+			float64(m.Size)/1024/1024, float64(l.MaxBytes)/1024/1024)
+	}
+	if l.MaxDuration > 0 && m.Duration > l.MaxDuration {
+		return l.durationError(m.Duration)
+	}
+	return nil
+}
+
+// durationError - сообщение о превышении длительности
+func (l mediaLimits) durationError(d time.Duration) error {
+	return fmt.Errorf("запись слишком длинная (%s, максимум %s)", formatDuration(d), formatDuration(l.MaxDuration))
+}
+
+// formatDuration - длительность в виде м:сс
+func formatDuration(d time.Duration) string {
+	seconds := int(d.Round(time.Second).Seconds())
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Файлы миграций встраиваются в бинарник, поэтому в Docker образ
+// достаточно скопировать только сам бот
+//
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+// migration описывает один шаг схемы: migrations/0001_initial.sql
+type migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// migrationRecord описывает уже применённую миграцию из schema_migrations
+type migrationRecord struct {
+	Version   int
+	Name      string
+	AppliedAt string
+}
+
+// loadMigrations читает встроенные миграции и сортирует их по версии
+func loadMigrations() ([]migration, error) {
+	files, err := fs.Glob(migrationsFS, "migrations/*.sql")
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения списка миграций: %v", err)
+	}
+
+	var migrations []migration
+	seen := make(map[int]string)
+
+	for _, file := range files {
+		base := strings.TrimSuffix(path.Base(file), ".sql")
+		prefix, name, ok := strings.Cut(base, "_")
+		if !ok {
+			return nil, fmt.Errorf("некорректное имя миграции %s: ожидается NNNN_name.sql", file)
+		}
+
+		version, err := strconv.Atoi(prefix)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("некорректная версия миграции %s", file)
+		}
+		if other, dup := seen[version]; dup {
+			return nil, fmt.Errorf("дублирующаяся версия миграции %d: %s и %s", version, other, file)
+		}
+		seen[version] = file
+
+		content, err := migrationsFS.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка чтения миграции %s: %v", file, err)
+		}
+
+		migrations = append(migrations, migration{
+			Version: version,
+			Name:    name,
+			SQL:     string(content),
+		})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// ensureMigrationsTable создает служебную таблицу schema_migrations
+func ensureMigrationsTable() error {
+	createSQL := `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	`
+
+	if _, err := db.Exec(createSQL); err != nil {
+		return fmt.Errorf("ошибка создания таблицы schema_migrations: %v", err)
+	}
+	return nil
+}
+
+// appliedMigrations возвращает уже применённые миграции по версиям
+func appliedMigrations() (map[int]migrationRecord, error) {
+	rows, err := db.Query(`SELECT version, name, applied_at FROM schema_migrations ORDER BY version`)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения schema_migrations: %v", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]migrationRecord)
+	for rows.Next() {
+		var rec migrationRecord
+		if err := rows.Scan(&rec.Version, &rec.Name, &rec.AppliedAt); err != nil {
+			return nil, fmt.Errorf("ошибка сканирования schema_migrations: %v", err)
+		}
+		applied[rec.Version] = rec
+	}
+	return applied, rows.Err()
+}
+
+// applyMigration выполняет одну миграцию и записывает её версию в одной транзакции
+func applyMigration(m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("ошибка начала транзакции: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(m.SQL); err != nil {
+		return fmt.Errorf("ошибка применения миграции %04d_%s: %v", m.Version, m.Name, err)
+	}
+
+	if _, err := tx.Exec(
+		`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, datetime('now'))`,
+		m.Version, m.Name,
+	); err != nil {
+		return fmt.Errorf("ошибка записи версии миграции %d: %v", m.Version, err)
+	}
+
+	return tx.Commit()
+}
+
+// migrateUp применяет все ещё не применённые миграции по порядку.
+// Возвращает количество применённых миграций
+func migrateUp() (int, error) {
+	if err := ensureMigrationsTable(); err != nil {
+		return 0, err
+	}
+
+	migrations, err := loadMigrations()
+	if err != nil {
+		return 0, err
+	}
+
+	applied, err := appliedMigrations()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+
+		if err := applyMigration(m); err != nil {
+			return count, err
+		}
+		log.Printf("🧱 Применена миграция %04d_%s", m.Version, m.Name)
+		count++
+	}
+
+	return count, nil
+}
+
+// printMigrationStatus выводит список миграций и их состояние
+func printMigrationStatus() error {
+	if err := ensureMigrationsTable(); err != nil {
+		return err
+	}
+
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	applied, err := appliedMigrations()
+	if err != nil {
+		return err
+	}
+
+	pending := 0
+	for _, m := range migrations {
+		if rec, ok := applied[m.Version]; ok {
+			fmt.Printf("✅ %04d_%s (применена %s)\n", m.Version, m.Name, rec.AppliedAt)
+		} else {
+			fmt.Printf("⏳ %04d_%s (ожидает)\n", m.Version, m.Name)
+			pending++
+		}
+	}
+
+	fmt.Printf("\nВсего миграций: %d, ожидают применения: %d\n", len(migrations), pending)
+	return nil
+}
+
+// runMigrateCommand обрабатывает подкоманду `migrate [up|status]`
+func runMigrateCommand(args []string) error {
+	if err := openDB(); err != nil {
+		return err
+	}
+	defer db.Close()
+
+	action := "up"
+	if len(args) > 0 {
+		action = args[0]
+	}
+
+	switch action {
+	case "up":
+		count, err := migrateUp()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Применено миграций: %d\n", count)
+		return nil
+	case "status":
+		return printMigrationStatus()
+	default:
+		return fmt.Errorf("неизвестное действие %q, используйте: migrate [up|status]", action)
+	}
+}
@@ -0,0 +1,30 @@
+-- Базовая схема бота: история сообщений, мысли и дневные лимиты.
+-- IF NOT EXISTS нужен для баз, созданных до появления миграций.
+
+CREATE TABLE IF NOT EXISTS messages (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
+	user_id INTEGER,
+	username TEXT,
+	message_type TEXT,
+	input_text TEXT,
+	response_type TEXT,
+	response_text TEXT
+);
+
+CREATE INDEX IF NOT EXISTS idx_messages_user_id ON messages(user_id);
+CREATE INDEX IF NOT EXISTS idx_messages_timestamp ON messages(timestamp);
+
+CREATE TABLE IF NOT EXISTS thoughts (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
+	thought_text TEXT NOT NULL,
+	category TEXT
+);
+
+CREATE TABLE IF NOT EXISTS user_limits (
+	user_id INTEGER PRIMARY KEY,
+	username TEXT,
+	date DATE DEFAULT (date('now')),
+	request_count INTEGER DEFAULT 0
+);
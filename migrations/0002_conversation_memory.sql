@@ -0,0 +1,15 @@
+-- Память разговора: сообщения привязываются к чату и намерению,
+-- а по каждому чату хранится курсор сброса и краткое содержание старых реплик.
+
+ALTER TABLE messages ADD COLUMN chat_id INTEGER;
+ALTER TABLE messages ADD COLUMN intent TEXT;
+
+CREATE INDEX IF NOT EXISTS idx_messages_chat_id ON messages(chat_id);
+
+CREATE TABLE IF NOT EXISTS conversation_sessions (
+	chat_id INTEGER PRIMARY KEY,
+	start_after_id INTEGER NOT NULL DEFAULT 0,   -- Сообщения с id <= start_after_id не входят в разговор (/reset)
+	summary TEXT NOT NULL DEFAULT '',            -- Краткое содержание реплик, вытесненных из окна
+	summary_until_id INTEGER NOT NULL DEFAULT 0, -- Последнее сообщение, вошедшее в summary
+	updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,13 @@
+-- Пользователи бота и их роли. Права определяются по Telegram user ID,
+-- а не по username, который можно сменить или передать другому.
+
+CREATE TABLE IF NOT EXISTS users (
+	user_id INTEGER PRIMARY KEY,
+	username TEXT,
+	first_name TEXT,
+	role TEXT NOT NULL DEFAULT 'member' CHECK (role IN ('owner', 'admin', 'member', 'blocked')),
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_users_role ON users(role);
@@ -0,0 +1,16 @@
+-- Индивидуальные дневные лимиты и журнал действий администраторов.
+
+-- NULL - лимит по умолчанию
+ALTER TABLE user_limits ADD COLUMN daily_limit INTEGER;
+
+CREATE TABLE IF NOT EXISTS admin_audit_log (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
+	admin_id INTEGER NOT NULL,
+	admin_username TEXT,
+	action TEXT NOT NULL,
+	target_user_id INTEGER,
+	details TEXT
+);
+
+CREATE INDEX IF NOT EXISTS idx_admin_audit_log_timestamp ON admin_audit_log(timestamp);
@@ -0,0 +1,32 @@
+-- Тарифные планы квот и журнал расхода в единицах стоимости.
+-- Единицы считаются из секунд распознавания, токенов LLM и символов озвучивания.
+
+CREATE TABLE IF NOT EXISTS quota_plans (
+	name TEXT PRIMARY KEY,
+	description TEXT,
+	hourly_units REAL,  -- NULL - без ограничения
+	daily_units REAL,   -- NULL - без ограничения
+	monthly_units REAL  -- NULL - без ограничения
+);
+
+INSERT OR IGNORE INTO quota_plans (name, description, hourly_units, daily_units, monthly_units) VALUES
+	('free', 'Бесплатный: пара голосовых диалогов в день', NULL, 5, 60),
+	('basic', 'Базовый', 10, 30, 500),
+	('pro', 'Расширенный', 50, 200, 3000),
+	('unlimited', 'Без ограничений', NULL, NULL, NULL);
+
+-- NULL - план по умолчанию (QUOTA_DEFAULT_PLAN)
+ALTER TABLE users ADD COLUMN plan TEXT REFERENCES quota_plans(name);
+
+CREATE TABLE IF NOT EXISTS usage_events (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
+	user_id INTEGER NOT NULL,
+	kind TEXT NOT NULL,                 -- Намерение запроса или 'adjustment' для ручной корректировки
+	stt_seconds REAL NOT NULL DEFAULT 0,
+	llm_tokens INTEGER NOT NULL DEFAULT 0,
+	tts_chars INTEGER NOT NULL DEFAULT 0,
+	units REAL NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS idx_usage_events_user_time ON usage_events(user_id, timestamp);
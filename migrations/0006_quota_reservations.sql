@@ -0,0 +1,8 @@
+-- Резервирование квоты: единицы списываются до обработки запроса
+-- и возвращаются, если запрос завершился ошибкой.
+-- reserved - запрос обрабатывается, committed - фактический расход, refunded - возвращено
+
+ALTER TABLE usage_events ADD COLUMN status TEXT NOT NULL DEFAULT 'committed'
+	CHECK (status IN ('reserved', 'committed', 'refunded'));
+
+CREATE INDEX IF NOT EXISTS idx_usage_events_status ON usage_events(status);
@@ -0,0 +1,17 @@
+-- Кэш озвучивания: готовые голосовые по хэшу текста, голоса, модели и настроек.
+-- file_id - голосовое уже загружено в Telegram и отправляется без повторной загрузки
+
+CREATE TABLE IF NOT EXISTS tts_cache (
+	key TEXT PRIMARY KEY,           -- sha256 от (провайдер, голос, модель, настройки, текст)
+	provider TEXT NOT NULL,
+	format TEXT NOT NULL,
+	duration_ms INTEGER NOT NULL DEFAULT 0,
+	data BLOB NOT NULL,
+	size INTEGER NOT NULL,
+	file_id TEXT,                   -- NULL - еще не отправлялось
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	last_used_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	hits INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS idx_tts_cache_last_used ON tts_cache(last_used_at);
@@ -0,0 +1,14 @@
+-- Настройки озвучивания пользователя (/settings).
+-- NULL - значение по умолчанию провайдера и голоса
+
+CREATE TABLE IF NOT EXISTS user_preferences (
+	user_id INTEGER PRIMARY KEY REFERENCES users(user_id),
+	voice_provider TEXT,            -- Провайдер TTS, к которому относится voice_id
+	voice_id TEXT,
+	voice_name TEXT,
+	stability REAL,
+	similarity REAL,
+	speed REAL,
+	reply_mode TEXT NOT NULL DEFAULT 'voice' CHECK (reply_mode IN ('voice', 'text', 'both')),
+	updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
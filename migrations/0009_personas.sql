@@ -0,0 +1,26 @@
+-- Персоны ChatGPT: системный промпт, модель и голос. Персона выбирается для чата (/persona),
+-- владелец создает и редактирует персоны командами без передеплоя
+
+CREATE TABLE IF NOT EXISTS personas (
+	name TEXT PRIMARY KEY,
+	description TEXT,
+	system_prompt TEXT NOT NULL,
+	model TEXT,                     -- NULL - OPENAI_MODEL
+	temperature REAL,               -- NULL - по умолчанию модели
+	max_tokens INTEGER,             -- NULL - без ограничения
+	voice_provider TEXT,            -- Провайдер TTS, к которому относится voice_id
+	voice_id TEXT,                  -- NULL - голос из конфигурации; настройка пользователя важнее
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT OR IGNORE INTO personas (name, description, system_prompt) VALUES
+	('default', 'Эксперт Go Backend, коротко и по делу',
+	 'Ты эксперт IT Go Backend, отвечай коротко и по делу. Меньше 20 слов в ответе.');
+
+-- Выбранная персона чата, нет записи - default
+CREATE TABLE IF NOT EXISTS chat_personas (
+	chat_id INTEGER PRIMARY KEY,
+	persona TEXT NOT NULL REFERENCES personas(name),
+	updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,6 @@
+-- Автор мысли: запросы "база ..." показывают мысли только автору.
+-- Мысли, сохраненные раньше, остаются без автора и видны владельцу бота.
+
+ALTER TABLE thoughts ADD COLUMN user_id INTEGER;
+
+CREATE INDEX IF NOT EXISTS idx_thoughts_user_id ON thoughts(user_id);
@@ -0,0 +1,67 @@
+-- Схема для запросов "база ..." на естественном языке. Промпт generateSQL строится из
+-- sqlite_master/PRAGMA table_info, а отсюда берутся список открытых таблиц и описания.
+-- Новая таблица становится доступна запросам только после записи в nl_tables;
+-- миграция, добавляющая колонку в открытую таблицу, добавляет и ее описание в nl_columns.
+
+CREATE TABLE IF NOT EXISTS nl_tables (
+	table_name TEXT PRIMARY KEY,
+	description TEXT NOT NULL DEFAULT '',
+	examples TEXT NOT NULL DEFAULT ''   -- Примеры "вопрос → SQL" для промпта
+);
+
+-- Описания колонок. Колонки без описания тоже доступны, в промпте у них только тип
+CREATE TABLE IF NOT EXISTS nl_columns (
+	table_name TEXT NOT NULL REFERENCES nl_tables(table_name),
+	column_name TEXT NOT NULL,
+	description TEXT NOT NULL DEFAULT '',
+	PRIMARY KEY (table_name, column_name)
+);
+
+INSERT OR IGNORE INTO nl_tables (table_name, description, examples) VALUES
+	('messages', 'история сообщений', 'Подсчет:
+- "сколько сообщений" → SELECT COUNT(*) as count FROM messages
+- "сколько голосовых" → SELECT COUNT(*) as count FROM messages WHERE message_type=''voice''
+- "сколько текстовых" → SELECT COUNT(*) as count FROM messages WHERE message_type=''text''
+
+Последние записи:
+- "последние N записей" → SELECT id, timestamp, message_type, input_text, response_text FROM messages ORDER BY timestamp DESC LIMIT N
+- "последнее сообщение" → SELECT id, timestamp, message_type, input_text, response_text FROM messages ORDER BY timestamp DESC LIMIT 1
+
+Поиск по содержанию:
+- "найди сообщения про [тема]" → SELECT id, timestamp, input_text FROM messages WHERE input_text LIKE ''%тема%'' LIMIT 10
+
+Статистика по типам:
+- "статистика по типам" → SELECT message_type, COUNT(*) as count FROM messages GROUP BY message_type
+
+Временные запросы:
+- "сегодняшние сообщения" → SELECT COUNT(*) as count FROM messages WHERE DATE(timestamp) = DATE(''now'')
+- "за последний час" → SELECT COUNT(*) as count FROM messages WHERE timestamp >= datetime(''now'', ''-1 hour'')'),
+	('thoughts', 'мысли/заметки', 'Подсчет мыслей:
+- "сколько мыслей" → SELECT COUNT(*) as count FROM thoughts
+- "сколько мыслей по категории [название]" → SELECT COUNT(*) as count FROM thoughts WHERE category=''название''
+
+Последние мысли:
+- "последние N мыслей" → SELECT id, timestamp, thought_text, category FROM thoughts ORDER BY timestamp DESC LIMIT N
+- "последняя мысль" → SELECT id, timestamp, thought_text, category FROM thoughts ORDER BY timestamp DESC LIMIT 1
+
+Поиск мыслей:
+- "найди мысли про [тема]" → SELECT id, timestamp, thought_text FROM thoughts WHERE thought_text LIKE ''%тема%'' LIMIT 10
+
+Мысли по категориям:
+- "покажи все категории мыслей" → SELECT DISTINCT category FROM thoughts WHERE category IS NOT NULL
+- "мысли категории [название]" → SELECT id, timestamp, thought_text FROM thoughts WHERE category=''название'' LIMIT 10');
+
+INSERT OR IGNORE INTO nl_columns (table_name, column_name, description) VALUES
+	('messages', 'timestamp', 'время сообщения (UTC)'),
+	('messages', 'chat_id', 'ID чата Telegram'),
+	('messages', 'user_id', 'ID пользователя Telegram'),
+	('messages', 'username', 'имя пользователя'),
+	('messages', 'message_type', 'тип сообщения: ''text'', ''voice'', ''audio'', ''video_note'' или ''document'''),
+	('messages', 'intent', 'намерение: ''chat'', ''thought'', ''database'' или ''speak'''),
+	('messages', 'input_text', 'текст входящего сообщения'),
+	('messages', 'response_type', 'тип ответа: ''text'' или ''voice'''),
+	('messages', 'response_text', 'текст ответа'),
+	('thoughts', 'timestamp', 'время сохранения (UTC)'),
+	('thoughts', 'user_id', 'ID автора мысли'),
+	('thoughts', 'thought_text', 'текст мысли'),
+	('thoughts', 'category', 'категория мысли');
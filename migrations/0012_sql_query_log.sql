@@ -0,0 +1,19 @@
+-- Журнал запросов "база ...": вопрос, итоговый SQL, попытки исправления и результат.
+-- Нужен, чтобы подбирать описания схемы и примеры в nl_tables/nl_columns.
+
+CREATE TABLE IF NOT EXISTS sql_query_log (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
+	chat_id INTEGER,
+	user_id INTEGER,
+	question TEXT NOT NULL,
+	final_sql TEXT,                 -- Последний запрос модели, NULL - модель не ответила
+	attempts INTEGER NOT NULL,      -- Сколько запросов составила модель
+	history TEXT,                   -- JSON: [{"sql": "...", "error": "..."}] по каждой попытке
+	outcome TEXT NOT NULL,          -- ok, invalid (все попытки с ошибкой), error или canceled
+	error TEXT,
+	row_count INTEGER,
+	duration_ms INTEGER
+);
+
+CREATE INDEX IF NOT EXISTS idx_sql_query_log_timestamp ON sql_query_log(timestamp);
@@ -0,0 +1,13 @@
+-- /resetlimit обнуляет только дневной расход: дневное окно считается с момента сброса.
+-- Раньше сброс записывался отрицательным событием 'adjustment', которое уменьшало
+-- и часовое, и месячное окно. Сегодняшние корректировки переносятся в отметку сброса.
+
+ALTER TABLE user_limits ADD COLUMN usage_reset_at DATETIME;
+
+INSERT INTO user_limits (user_id, usage_reset_at)
+SELECT user_id, MAX(timestamp) FROM usage_events
+WHERE kind = 'adjustment' AND timestamp >= date('now')
+GROUP BY user_id
+ON CONFLICT(user_id) DO UPDATE SET usage_reset_at = excluded.usage_reset_at;
+
+DELETE FROM usage_events WHERE kind = 'adjustment';
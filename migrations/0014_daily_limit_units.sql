@@ -0,0 +1,18 @@
+-- /setlimit задает дневной лимит в единицах квоты, а не в числе запросов.
+-- Лимиты, заданные раньше в запросах, в единицы не переводятся - они сбрасываются
+-- на лимит плана, и администратор задает их заново. Колонка пересоздается как REAL.
+
+CREATE TABLE user_limits_new (
+	user_id INTEGER PRIMARY KEY,
+	username TEXT,
+	date DATE DEFAULT (date('now')),
+	request_count INTEGER DEFAULT 0,
+	daily_limit REAL,       -- Единицы квоты, NULL - лимит плана
+	usage_reset_at DATETIME -- Последний /resetlimit
+);
+
+INSERT INTO user_limits_new (user_id, username, date, request_count, daily_limit, usage_reset_at)
+SELECT user_id, username, date, request_count, NULL, usage_reset_at FROM user_limits;
+
+DROP TABLE user_limits;
+ALTER TABLE user_limits_new RENAME TO user_limits;
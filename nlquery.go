@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+)
+
+// sqlAttempt - одна попытка: запрос модели и ошибка его выполнения
+type sqlAttempt struct {
+	SQL   string `json:"sql"`
+	Error string `json:"error,omitempty"`
+}
+
+// runNLQuery составляет SQL по вопросу пользователя и выполняет его. Если запрос не прошел
+// проверку или SQLite вернул ошибку, модель получает ошибку вместе со схемой и исправляет запрос -
+// не больше limits.Repairs раз. Каждая попытка проверяется заново. Итог пишется в sql_query_log
+func runNLQuery(ctx context.Context, client LLM, req *Request, limits sqlLimits) (*sqlResult, error) {
+	scope := newSQLScope(req.User)
+	start := time.Now()
+
+	var attempts []sqlAttempt
+	var result *sqlResult
+	var err error
+	for len(attempts) <= limits.Repairs {
+		var query string
+		query, err = generateSQL(ctx, client, &req.Usage, req.Payload, attempts)
+		if err != nil {
+			break
+		}
+
+		result, err = queryReadOnly(ctx, query, scope, limits)
+		attempt := sqlAttempt{SQL: query}
+		if err != nil {
+			attempt.Error = err.Error()
+		}
+		attempts = append(attempts, attempt)
+
+		// Ошибки подключения и отмену запроса модель не исправит
+		var queryErr *sqlQueryError
+		if err == nil || !errors.As(err, &queryErr) || ctx.Err() != nil {
+			break
+		}
+		log.Printf("⚠️ SQL не выполнен (попытка %d): %v", len(attempts), err)
+	}
+
+	logSQLQuery(ctx, req, attempts, result, err, time.Since(start))
+	if err == nil {
+		log.Printf("✅ SQL выполнен успешно, записей: %d, попыток: %d", len(result.Rows), len(attempts))
+	}
+	return result, err
+}
+
+// sqlOutcome - итог запроса для sql_query_log
+func sqlOutcome(ctx context.Context, err error) string {
+	var queryErr *sqlQueryError
+	switch {
+	case err == nil:
+		return "ok"
+	case ctx.Err() != nil:
+		return "canceled"
+	case errors.As(err, &queryErr):
+		return "invalid"
+	default:
+		return "error"
+	}
+}
+
+// logSQLQuery записывает запрос в sql_query_log. Запись идет без контекста: отмененный
+// запрос тоже записывается. Ошибка записи только логируется
+func logSQLQuery(ctx context.Context, req *Request, attempts []sqlAttempt, result *sqlResult, err error, duration time.Duration) {
+	var finalSQL, history, errText, rowCount interface{}
+	if len(attempts) > 0 {
+		finalSQL = attempts[len(attempts)-1].SQL
+		if data, jsonErr := json.Marshal(attempts); jsonErr == nil {
+			history = string(data)
+		}
+	}
+	if err != nil {
+		errText = err.Error()
+	}
+	if result != nil {
+		rowCount = len(result.Rows)
+	}
+
+	outcome := sqlOutcome(ctx, err)
+	_, dbErr := db.Exec(`
+	INSERT INTO sql_query_log (timestamp, chat_id, user_id, question, final_sql, attempts, history, outcome, error, row_count, duration_ms)
+	VALUES (datetime('now'), ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, req.ChatID, req.UserID, req.Payload, finalSQL, len(attempts), history, outcome, errText, rowCount, duration.Milliseconds())
+	if dbErr != nil {
+		log.Printf("⚠️ Ошибка записи в журнал SQL запросов: %v", dbErr)
+	}
+}
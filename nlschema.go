@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// NLSchema - таблицы, доступные запросам "база ..." на естественном языке.
+// Колонки и типы читаются из самой БД (PRAGMA table_info), поэтому после миграции
+// промпт и белые списки обновляются сами; список таблиц и описания - в nl_tables и nl_columns
+type NLSchema struct {
+	Tables []*NLTable // По имени
+}
+
+// NLTable - открытая таблица
+type NLTable struct {
+	Name        string
+	Description string
+	Examples    string // Примеры "вопрос → SQL" для промпта
+	Columns     []NLColumn
+}
+
+// NLColumn - колонка открытой таблицы
+type NLColumn struct {
+	Name        string
+	Type        string
+	PrimaryKey  bool
+	Description string
+}
+
+// nlSchema загружается при запуске, после миграций
+var nlSchema = &NLSchema{}
+
+// loadNLSchema читает открытые таблицы из nl_tables и их колонки из схемы БД
+func loadNLSchema() (*NLSchema, error) {
+	rows, err := db.Query(`SELECT table_name, description, examples FROM nl_tables ORDER BY table_name`)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения nl_tables: %v", err)
+	}
+	schema := &NLSchema{}
+	for rows.Next() {
+		t := &NLTable{}
+		if err := rows.Scan(&t.Name, &t.Description, &t.Examples); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("ошибка чтения nl_tables: %v", err)
+		}
+		schema.Tables = append(schema.Tables, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ошибка чтения nl_tables: %v", err)
+	}
+
+	for _, t := range schema.Tables {
+		if err := t.loadColumns(); err != nil {
+			return nil, err
+		}
+		if len(t.Columns) == 0 {
+			return nil, fmt.Errorf("таблица %s из nl_tables не найдена в БД", t.Name)
+		}
+	}
+	return schema, nil
+}
+
+// loadColumns читает колонки таблицы из PRAGMA table_info и описания из nl_columns
+func (t *NLTable) loadColumns() error {
+	descriptions := make(map[string]string)
+	rows, err := db.Query(`SELECT column_name, description FROM nl_columns WHERE table_name = ?`, t.Name)
+	if err != nil {
+		return fmt.Errorf("ошибка чтения nl_columns: %v", err)
+	}
+	for rows.Next() {
+		var name, description string
+		if err := rows.Scan(&name, &description); err != nil {
+			rows.Close()
+			return fmt.Errorf("ошибка чтения nl_columns: %v", err)
+		}
+		descriptions[strings.ToLower(name)] = description
+	}
+	rows.Close()
+
+	rows, err = db.Query(`SELECT name, type, pk FROM pragma_table_info(?) ORDER BY cid`, t.Name)
+	if err != nil {
+		return fmt.Errorf("ошибка чтения колонок %s: %v", t.Name, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c NLColumn
+		var pk int
+		if err := rows.Scan(&c.Name, &c.Type, &pk); err != nil {
+			return fmt.Errorf("ошибка чтения колонок %s: %v", t.Name, err)
+		}
+		c.PrimaryKey = pk > 0
+		c.Description = descriptions[strings.ToLower(c.Name)]
+		t.Columns = append(t.Columns, c)
+	}
+	return rows.Err()
+}
+
+// Table - открытая таблица по имени, nil - таблица недоступна
+func (s *NLSchema) Table(name string) *NLTable {
+	for _, t := range s.Tables {
+		if strings.EqualFold(t.Name, name) {
+			return t
+		}
+	}
+	return nil
+}
+
+// HasColumn - есть ли в таблице колонка
+func (t *NLTable) HasColumn(name string) bool {
+	for _, c := range t.Columns {
+		if strings.EqualFold(c.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// ColumnNames - имена колонок в порядке таблицы
+func (t *NLTable) ColumnNames() []string {
+	names := make([]string, len(t.Columns))
+	for i, c := range t.Columns {
+		names[i] = c.Name
+	}
+	return names
+}
+
+// Describe - описание таблиц и примеры запросов для промпта generateSQL
+func (s *NLSchema) Describe() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "База данных содержит таблицы (%d):\n", len(s.Tables))
+	for i, t := range s.Tables {
+		fmt.Fprintf(&sb, "\n%d. Таблица %s", i+1, t.Name)
+		if t.Description != "" {
+			fmt.Fprintf(&sb, " (%s)", t.Description)
+		}
+		sb.WriteString(":\n")
+		for _, c := range t.Columns {
+			typ := c.Type
+			if c.PrimaryKey {
+				typ += " PRIMARY KEY"
+			}
+			fmt.Fprintf(&sb, "- %s (%s)", c.Name, strings.TrimSpace(typ))
+			if c.Description != "" {
+				fmt.Fprintf(&sb, " - %s", c.Description)
+			}
+			sb.WriteString("\n")
+		}
+	}
+
+	var examples []string
+	for _, t := range s.Tables {
+		if t.Examples != "" {
+			examples = append(examples, fmt.Sprintf("Таблица %s:\n\n%s", t.Name, strings.TrimSpace(t.Examples)))
+		}
+	}
+	if len(examples) > 0 {
+		sb.WriteString("\nШАБЛОНЫ ЗАПРОСОВ:\n\n")
+		sb.WriteString(strings.Join(examples, "\n\n"))
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Persona - персона ChatGPT из таблицы personas
+type Persona struct {
+	Name          string
+	Description   string
+	SystemPrompt  string
+	Model         string   // Пусто - OPENAI_MODEL
+	Temperature   *float64 // nil - по умолчанию модели
+	MaxTokens     int      // 0 - без ограничения
+	VoiceProvider string   // Провайдер TTS, к которому относится VoiceID
+	VoiceID       string   // Пусто - голос из конфигурации
+}
+
+// defaultPersonaName - персона чатов, которые не выбирали свою
+const defaultPersonaName = "default"
+
+// builtinPersona - персона на случай, если БД недоступна
+var builtinPersona = &Persona{
+	Name:         defaultPersonaName,
+	SystemPrompt: "Ты эксперт IT Go Backend, отвечай коротко и по делу. Меньше 20 слов в ответе.",
+}
+
+// personaNamePattern - допустимое имя персоны: оно же используется в командах и кнопках
+var personaNamePattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// applyVoice применяет голос персоны, если пользователь не выбрал свой в /settings
+func (p *Persona) applyVoice(opts TTSOptions) TTSOptions {
+	if p == nil || p.VoiceID == "" || opts.Voice != "" {
+		return opts
+	}
+	opts.Provider, opts.Voice = p.VoiceProvider, p.VoiceID
+	return opts
+}
+
+// getPersona возвращает персону по имени
+func getPersona(name string) (*Persona, error) {
+	p := &Persona{Name: name}
+	var description, model, voiceProvider, voiceID sql.NullString
+	var temperature sql.NullFloat64
+	var maxTokens sql.NullInt64
+
+	err := db.QueryRow(`
+	SELECT description, system_prompt, model, temperature, max_tokens, voice_provider, voice_id
+	FROM personas WHERE name = ?`, name,
+	).Scan(&description, &p.SystemPrompt, &model, &temperature, &maxTokens, &voiceProvider, &voiceID)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("персона %s не найдена", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения персоны: %v", err)
+	}
+
+	p.Description = description.String
+	p.Model = model.String
+	p.Temperature = nullFloat(temperature)
+	p.MaxTokens = int(maxTokens.Int64)
+	p.VoiceProvider = voiceProvider.String
+	p.VoiceID = voiceID.String
+	return p, nil
+}
+
+// listPersonas возвращает все персоны по алфавиту
+func listPersonas() ([]*Persona, error) {
+	rows, err := db.Query(`SELECT name FROM personas ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения персон: %v", err)
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("ошибка чтения персон: %v", err)
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+
+	personas := make([]*Persona, 0, len(names))
+	for _, name := range names {
+		p, err := getPersona(name)
+		if err != nil {
+			return nil, err
+		}
+		personas = append(personas, p)
+	}
+	return personas, nil
+}
+
+// chatPersona возвращает персону чата, а если она не выбрана или удалена - default
+func chatPersona(chatID int64) (*Persona, error) {
+	name := defaultPersonaName
+	err := db.QueryRow(`SELECT persona FROM chat_personas WHERE chat_id = ?`, chatID).Scan(&name)
+	if err != nil && err != sql.ErrNoRows {
+		return builtinPersona, fmt.Errorf("ошибка чтения персоны чата: %v", err)
+	}
+
+	p, err := getPersona(name)
+	if err != nil && name != defaultPersonaName {
+		p, err = getPersona(defaultPersonaName)
+	}
+	if err != nil {
+		return builtinPersona, err
+	}
+	return p, nil
+}
+
+// setChatPersona выбирает персону для чата
+func setChatPersona(chatID int64, name string) error {
+	if _, err := getPersona(name); err != nil {
+		return err
+	}
+	_, err := db.Exec(`
+	INSERT INTO chat_personas (chat_id, persona, updated_at) VALUES (?, ?, datetime('now'))
+	ON CONFLICT(chat_id) DO UPDATE SET persona = excluded.persona, updated_at = excluded.updated_at
+	`, chatID, name)
+	if err != nil {
+		return fmt.Errorf("ошибка выбора персоны: %v", err)
+	}
+	return nil
+}
+
+// savePersona создает персону или обновляет все ее поля
+func savePersona(p *Persona) error {
+	var maxTokens interface{}
+	if p.MaxTokens > 0 {
+		maxTokens = p.MaxTokens
+	}
+
+	_, err := db.Exec(`
+	INSERT INTO personas (name, description, system_prompt, model, temperature, max_tokens, voice_provider, voice_id, created_at, updated_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, datetime('now'), datetime('now'))
+	ON CONFLICT(name) DO UPDATE SET
+		description = excluded.description,
+		system_prompt = excluded.system_prompt,
+		model = excluded.model,
+		temperature = excluded.temperature,
+		max_tokens = excluded.max_tokens,
+		voice_provider = excluded.voice_provider,
+		voice_id = excluded.voice_id,
+		updated_at = excluded.updated_at
+	`, p.Name, nullString(p.Description), p.SystemPrompt, nullString(p.Model), p.Temperature, maxTokens,
+		nullString(p.VoiceProvider), nullString(p.VoiceID))
+	if err != nil {
+		return fmt.Errorf("ошибка сохранения персоны: %v", err)
+	}
+	return nil
+}
+
+// deletePersona удаляет персону. Чаты, где она была выбрана, возвращаются к default
+func deletePersona(name string) error {
+	if name == defaultPersonaName {
+		return fmt.Errorf("персону %s удалить нельзя", defaultPersonaName)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("ошибка удаления персоны: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM chat_personas WHERE persona = ?`, name); err != nil {
+		return fmt.Errorf("ошибка удаления персоны: %v", err)
+	}
+	result, err := tx.Exec(`DELETE FROM personas WHERE name = ?`, name)
+	if err != nil {
+		return fmt.Errorf("ошибка удаления персоны: %v", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("персона %s не найдена", name)
+	}
+	return tx.Commit()
+}
+
+// formatPersona - описание персоны для владельца
+func formatPersona(p *Persona) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "🎭 %s", p.Name)
+	if p.Description != "" {
+		fmt.Fprintf(&sb, " - %s", p.Description)
+	}
+	fmt.Fprintf(&sb, "\n\n📜 %s\n\n", p.SystemPrompt)
+
+	model := p.Model
+	if model == "" {
+		model = "по умолчанию"
+	}
+	temperature := "по умолчанию"
+	if p.Temperature != nil {
+		temperature = strconv.FormatFloat(*p.Temperature, 'f', -1, 64)
+	}
+	maxTokens := "без ограничения"
+	if p.MaxTokens > 0 {
+		maxTokens = strconv.Itoa(p.MaxTokens)
+	}
+	voice := "по умолчанию"
+	if p.VoiceID != "" {
+		voice = p.VoiceProvider + ":" + p.VoiceID
+	}
+
+	fmt.Fprintf(&sb, "🤖 model: %s\n🌡 temperature: %s\n📏 max_tokens: %s\n🗣 voice: %s",
+		model, temperature, maxTokens, voice)
+	return sb.String()
+}
+
+// --- Выбор персоны чата ---
+
+// handlePersonaSwitch обрабатывает /persona: без аргумента показывает список с кнопками,
+// с именем - выбирает персону для чата
+func handlePersonaSwitch(bot *tgbotapi.BotAPI, user *User, message *tgbotapi.Message) {
+	chatID := message.Chat.ID
+	reply := func(text string) {
+		bot.Send(tgbotapi.NewMessage(chatID, text))
+	}
+
+	if name := strings.ToLower(strings.TrimSpace(message.CommandArguments())); name != "" {
+		if err := setChatPersona(chatID, name); err != nil {
+			reply(fmt.Sprintf("❌ %v", err))
+			return
+		}
+		log.Printf("🎭 %s выбрал персону %s в чате %d", user.DisplayName(), name, chatID)
+		reply(fmt.Sprintf("🎭 Персона чата: %s", name))
+		return
+	}
+
+	text, keyboard, err := personaMenu(chatID)
+	if err != nil {
+		log.Printf("Ошибка списка персон: %v", err)
+		reply("❌ Не удалось загрузить персоны")
+		return
+	}
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ReplyMarkup = keyboard
+	bot.Send(msg)
+}
+
+// handlePersonaCallback выбирает персону по кнопке "persona:<имя>"
+func handlePersonaCallback(bot *tgbotapi.BotAPI, user *User, query *tgbotapi.CallbackQuery) {
+	answer := func(text string) {
+		if _, err := bot.Request(tgbotapi.NewCallback(query.ID, text)); err != nil {
+			log.Printf("Ошибка ответа на callback: %v", err)
+		}
+	}
+
+	chatID := query.Message.Chat.ID
+	name := strings.TrimPrefix(query.Data, "persona:")
+	if err := setChatPersona(chatID, name); err != nil {
+		answer(fmt.Sprintf("❌ %v", err))
+		return
+	}
+	log.Printf("🎭 %s выбрал персону %s в чате %d", user.DisplayName(), name, chatID)
+	answer("🎭 Персона: " + name)
+
+	text, keyboard, err := personaMenu(chatID)
+	if err != nil {
+		log.Printf("Ошибка списка персон: %v", err)
+		return
+	}
+	bot.Send(tgbotapi.NewEditMessageTextAndMarkup(chatID, query.Message.MessageID, text, keyboard))
+}
+
+// personaMenu - список персон с отмеченной текущей и кнопки выбора
+func personaMenu(chatID int64) (string, tgbotapi.InlineKeyboardMarkup, error) {
+	personas, err := listPersonas()
+	if err != nil {
+		return "", tgbotapi.InlineKeyboardMarkup{}, err
+	}
+	current, err := chatPersona(chatID)
+	if err != nil {
+		log.Printf("⚠️ %v", err)
+	}
+
+	var sb strings.Builder
+	sb.WriteString("🎭 Персоны (стиль ответов ChatGPT и голос):\n")
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for _, p := range personas {
+		mark := "▫️"
+		if p.Name == current.Name {
+			mark = "✅"
+		}
+		fmt.Fprintf(&sb, "\n%s %s", mark, p.Name)
+		if p.Description != "" {
+			fmt.Fprintf(&sb, " - %s", p.Description)
+		}
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(mark+" "+p.Name, "persona:"+p.Name),
+		))
+	}
+	return sb.String(), tgbotapi.NewInlineKeyboardMarkup(rows...), nil
+}
+
+// --- Управление персонами (владелец) ---
+
+// personaCommands - команды управления персонами, доступные только владельцу
+var personaCommands = map[string]bool{
+	"newpersona":  true,
+	"editpersona": true,
+	"delpersona":  true,
+	"personainfo": true,
+}
+
+// personaHelp - справка по командам управления персонами
+const personaHelp = "🎭 Управление персонами:\n\n" +
+	"/newpersona <имя> <системный промпт> - создать персону (или заменить промпт)\n" +
+	"/editpersona <имя> <поле> <значение> - изменить поле: prompt, description, model, temperature, max_tokens, voice. " +
+	"Значение default сбрасывает поле\n" +
+	"/delpersona <имя> - удалить персону, чаты с ней вернутся к default\n" +
+	"/personainfo <имя> - настройки персоны\n\n" +
+	"Имя - латиница в нижнем регистре, цифры, _ и -"
+
+// handlePersonaCommand обрабатывает команды владельца для персон
+func handlePersonaCommand(bot *tgbotapi.BotAPI, pipeline *Pipeline, owner *User, message *tgbotapi.Message) {
+	reply := func(text string) {
+		bot.Send(tgbotapi.NewMessage(message.Chat.ID, text))
+	}
+
+	if !owner.Can(PermPersonas) {
+		log.Printf("🚫 Пользователь %s (%d) пытался выполнить /%s", owner.DisplayName(), owner.ID, message.Command())
+		reply("❌ У вас нет доступа к этой функции")
+		return
+	}
+
+	// Промпт может содержать переводы строк, поэтому отделяем только первые слова
+	name, rest := cutWord(message.CommandArguments())
+	name = strings.ToLower(name)
+	if name == "" {
+		reply(personaHelp)
+		return
+	}
+
+	switch message.Command() {
+	case "newpersona":
+		if rest == "" {
+			reply(personaHelp)
+			return
+		}
+		if !personaNamePattern.MatchString(name) {
+			reply("❌ Недопустимое имя персоны: латиница в нижнем регистре, цифры, _ и -")
+			return
+		}
+
+		p, err := getPersona(name)
+		if err != nil {
+			p = &Persona{Name: name}
+		}
+		p.SystemPrompt = rest
+		if err := savePersona(p); err != nil {
+			log.Printf("Ошибка сохранения персоны: %v", err)
+			reply("❌ Ошибка сохранения персоны")
+			return
+		}
+		recordAudit(owner, "newpersona", 0, name)
+		reply("✅ Персона сохранена\n\n" + formatPersona(p))
+
+	case "editpersona":
+		field, value := cutWord(rest)
+		if value == "" {
+			reply(personaHelp)
+			return
+		}
+		p, err := getPersona(name)
+		if err != nil {
+			reply(fmt.Sprintf("❌ %v", err))
+			return
+		}
+
+		if err := setPersonaField(pipeline, p, strings.ToLower(field), value); err != nil {
+			reply(fmt.Sprintf("❌ %v", err))
+			return
+		}
+		if err := savePersona(p); err != nil {
+			log.Printf("Ошибка сохранения персоны: %v", err)
+			reply("❌ Ошибка сохранения персоны")
+			return
+		}
+		recordAudit(owner, "editpersona", 0, fmt.Sprintf("%s %s=%s", name, field, value))
+		reply("✅ Персона изменена\n\n" + formatPersona(p))
+
+	case "delpersona":
+		if err := deletePersona(name); err != nil {
+			reply(fmt.Sprintf("❌ %v", err))
+			return
+		}
+		recordAudit(owner, "delpersona", 0, name)
+		reply(fmt.Sprintf("🗑 Персона %s удалена", name))
+
+	case "personainfo":
+		p, err := getPersona(name)
+		if err != nil {
+			reply(fmt.Sprintf("❌ %v", err))
+			return
+		}
+		reply(formatPersona(p))
+	}
+}
+
+// cutWord отделяет первое слово от остального текста, сохраняя переводы строк в остатке
+func cutWord(s string) (word, rest string) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, unicode.IsSpace)
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], strings.TrimSpace(s[i:])
+}
+
+// setPersonaField изменяет одно поле персоны. "default" сбрасывает необязательные поля
+func setPersonaField(pipeline *Pipeline, p *Persona, field, value string) error {
+	if value == "" {
+		return fmt.Errorf("не указано значение")
+	}
+	reset := value == "default"
+
+	switch field {
+	case "prompt":
+		if reset {
+			return fmt.Errorf("промпт нельзя сбросить, укажите новый")
+		}
+		p.SystemPrompt = value
+
+	case "description":
+		if reset {
+			value = ""
+		}
+		p.Description = value
+
+	case "model":
+		if reset {
+			value = ""
+		}
+		p.Model = value
+
+	case "temperature":
+		if reset {
+			p.Temperature = nil
+			return nil
+		}
+		t, err := strconv.ParseFloat(value, 64)
+		if err != nil || t < 0 || t > 2 {
+			return fmt.Errorf("temperature - число от 0 до 2")
+		}
+		p.Temperature = &t
+
+	case "max_tokens":
+		if reset {
+			p.MaxTokens = 0
+			return nil
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("max_tokens - положительное целое число")
+		}
+		p.MaxTokens = n
+
+	case "voice":
+		if reset {
+			p.VoiceProvider, p.VoiceID = "", ""
+			return nil
+		}
+		provider := ttsProviderName(pipeline.tts)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		voices, err := pipeline.tts.Voices(ctx)
+		if err != nil {
+			return fmt.Errorf("не удалось проверить голос: %v", err)
+		}
+		// Провайдер без списка голосов (local) голос не выбирает
+		if len(voices) == 0 {
+			return fmt.Errorf("у провайдера %s нет выбора голоса", provider)
+		}
+		for _, v := range voices {
+			if v.ID == value || strings.EqualFold(v.Name, value) {
+				p.VoiceProvider, p.VoiceID = provider, v.ID
+				return nil
+			}
+		}
+		return fmt.Errorf("голос %s не найден у провайдера %s", value, provider)
+
+	default:
+		return fmt.Errorf("неизвестное поле %s (prompt, description, model, temperature, max_tokens, voice)", field)
+	}
+	return nil
+}
@@ -0,0 +1,906 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// Messenger - часть Telegram API, которая нужна pipeline.
+// *tgbotapi.BotAPI реализует его напрямую
+type Messenger interface {
+	Send(c tgbotapi.Chattable) (tgbotapi.Message, error)
+	GetFileDirectURL(fileID string) (string, error)
+}
+
+// LLM - языковая модель: ответы в чате, составление SQL и краткое содержание разговора.
+// *openai.Client реализует его напрямую
+type LLM interface {
+	CreateChatCompletion(ctx context.Context, request openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error)
+}
+
+// Intent - намерение пользователя, определяемое по ключевому слову
+type Intent string
+
+const (
+	IntentChat     Intent = "chat"     // Обычный вопрос в ChatGPT
+	IntentThought  Intent = "thought"  // "мысль ..." - сохранить заметку
+	IntentDatabase Intent = "database" // "база ..." - запрос к БД на естественном языке
+	IntentSpeak    Intent = "speak"    // /voice - озвучить текст без GPT
+)
+
+// Request - состояние одного входящего сообщения, проходящего через pipeline
+type Request struct {
+	ChatID      int64
+	UserID      int64
+	Username    string       // Username, а если его нет - имя пользователя
+	User        *User        // Пользователь с ролью, по ней проверяются права
+	Prefs       *Preferences // Настройки озвучивания и вид ответа (/settings), nil - по умолчанию
+	Persona     *Persona     // Персона чата (/persona), nil - встроенная
+	MessageType string       // Тип входящего сообщения: text, voice, audio, video_note или document
+	Media       *MediaInput  // Голосовое, аудио или видео для распознавания, nil - текст
+
+	AudioPath string // Скачанный голосовой файл
+	InputText string // Текст запроса или распознанный текст из голоса
+	Intent    Intent
+	Payload   string // Текст запроса без ключевого слова
+
+	Response     string      // Текстовый ответ
+	Attachment   *Attachment // Таблица, файл или график результата запроса к БД, nil - нет
+	Notice       string      // Пояснение к текстовому ответу, если голос не отправлен
+	Audio        []*TTSAudio // Озвученный ответ: одно голосовое или части по порядку
+	ResponseType string      // Тип отправленного ответа: text или voice
+	Usage        Usage       // Расход ресурсов для квоты
+
+	Quota *QuotaReservation // Резерв квоты: подтверждается в persist, возвращается при ошибке
+
+	tempFiles []string
+}
+
+// newRequest создает запрос pipeline из сообщения Telegram
+func newRequest(user *User, message *tgbotapi.Message) *Request {
+	req := &Request{
+		ChatID:      message.Chat.ID,
+		UserID:      user.ID,
+		Username:    user.DisplayName(),
+		User:        user,
+		MessageType: "text",
+		InputText:   message.Text,
+	}
+
+	if media := mediaFromMessage(message); media != nil {
+		req.MessageType = media.Kind
+		req.Media = media
+		req.InputText = ""
+	}
+
+	return req
+}
+
+// stageError - ошибка этапа pipeline с текстом для пользователя
+type stageError struct {
+	userText string
+	err      error
+}
+
+func (e *stageError) Error() string {
+	if e.err == nil {
+		return e.userText
+	}
+	return e.err.Error()
+}
+
+// failStage прерывает pipeline и отправляет пользователю userText
+func failStage(userText string, err error) error {
+	return &stageError{userText: userText, err: err}
+}
+
+// Pipeline обрабатывает голосовые и текстовые сообщения одинаково:
+// ingest → transcribe → route → generate → synthesize → deliver → persist
+type Pipeline struct {
+	bot         Messenger
+	llm         LLM
+	stt         STTProvider
+	tts         TTSProvider
+	memory      *ConversationMemory
+	converter   *AudioConverter // Готовит голос TTS к отправке как OGG/Opus и извлекает звук из входящих файлов
+	media       mediaLimits     // Ограничения размера и длительности входящих файлов
+	cache       *TTSCache       // Кэш готовых голосовых, nil - выключен
+	sql         sqlLimits       // Ограничения запросов к базе на естественном языке
+	sqlFile     string          // Формат файла с большим результатом запроса: csv или xlsx
+	sttLanguage string
+
+	voiceLimits map[Role]int // Максимальная длина ответа (в символах) для озвучивания по ролям
+	chunkChars  int          // Длина части, на которые делится длинный ответ
+	ttsParallel int          // Сколько частей синтезируется одновременно
+	concatVoice bool         // Склеивать части в одно голосовое (нужен ffmpeg)
+
+	// timeouts - дедлайн каждого этапа, этапы без записи не ограничены
+	timeouts map[string]time.Duration
+
+	// active - отмена запроса, который сейчас обрабатывается в чате (/cancel).
+	// Сообщения одного чата обрабатываются по очереди, поэтому активный запрос в чате один.
+	// stopping - бот останавливается и все запросы отменены (CancelAll)
+	mu       sync.Mutex
+	active   map[int64]context.CancelFunc
+	stopping bool
+
+	// saveMessage записывает историю, в тестах можно подменить
+	saveMessage func(rec MessageRecord) error
+}
+
+// voiceLimitsFromEnv читает максимальную длину озвучиваемого ответа для каждой роли
+func voiceLimitsFromEnv() map[Role]int {
+	return map[Role]int{
+		RoleOwner:  getEnvInt("VOICE_MAX_CHARS_OWNER", 4000),
+		RoleAdmin:  getEnvInt("VOICE_MAX_CHARS_ADMIN", 4000),
+		RoleMember: getEnvInt("VOICE_MAX_CHARS_MEMBER", 1500),
+	}
+}
+
+// stageTimeoutsFromEnv читает дедлайны этапов из окружения (в секундах, 0 - без ограничения)
+func stageTimeoutsFromEnv() map[string]time.Duration {
+	return map[string]time.Duration{
+		"ingest":     getEnvSeconds("TIMEOUT_DOWNLOAD", 30*time.Second),
+		"transcribe": getEnvSeconds("TIMEOUT_STT", 60*time.Second),
+		"generate":   getEnvSeconds("TIMEOUT_LLM", 90*time.Second),
+		"synthesize": getEnvSeconds("TIMEOUT_TTS", 60*time.Second),
+	}
+}
+
+// stageTitles - названия этапов для сообщений пользователю
+var stageTitles = map[string]string{
+	"ingest":     "загрузка аудио",
+	"transcribe": "распознавание речи",
+	"generate":   "подготовка ответа",
+	"synthesize": "озвучивание",
+}
+
+// NewPipeline создает pipeline с зависимостями по умолчанию
+func NewPipeline(bot Messenger, llm LLM, stt STTProvider, tts TTSProvider, sttLanguage string) *Pipeline {
+	return &Pipeline{
+		bot:         bot,
+		llm:         llm,
+		stt:         stt,
+		tts:         tts,
+		memory:      NewConversationMemory(llm),
+		converter:   newAudioConverterFromConfig(),
+		cache:       newTTSCacheFromConfig(),
+		media:       mediaLimitsFromEnv(),
+		sql:         sqlLimitsFromEnv(),
+		sqlFile:     getEnv("SQL_FILE_FORMAT", "csv"),
+		sttLanguage: sttLanguage,
+		voiceLimits: voiceLimitsFromEnv(),
+		chunkChars:  getEnvInt("TTS_CHUNK_CHARS", 400),
+		ttsParallel: getEnvInt("TTS_PARALLEL", 3),
+		concatVoice: getEnv("TTS_LONG_REPLY", "concat") == "concat",
+		timeouts:    stageTimeoutsFromEnv(),
+		active:      make(map[int64]context.CancelFunc),
+		saveMessage: saveMessage,
+	}
+}
+
+type pipelineStage struct {
+	name string
+	run  func(ctx context.Context, req *Request) error
+}
+
+// Cancel отменяет запрос, который сейчас обрабатывается в чате.
+// Возвращает false, если отменять нечего
+func (p *Pipeline) Cancel(chatID int64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	cancel, ok := p.active[chatID]
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// CancelAll отменяет все запросы, которые сейчас обрабатываются, и сразу отменяет
+// новые. Вызывается при остановке бота, когда ждать их уже некогда.
+// Возвращает число отмененных запросов
+func (p *Pipeline) CancelAll() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.stopping = true
+	for _, cancel := range p.active {
+		cancel()
+	}
+	return len(p.active)
+}
+
+// Handle прогоняет запрос через все этапы pipeline.
+// Каждый этап получает контекст запроса со своим дедлайном
+func (p *Pipeline) Handle(req *Request) {
+	defer p.cleanup(req)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p.mu.Lock()
+	p.active[req.ChatID] = cancel
+	stopping := p.stopping
+	p.mu.Unlock()
+	if stopping {
+		cancel()
+	}
+	defer func() {
+		p.mu.Lock()
+		delete(p.active, req.ChatID)
+		p.mu.Unlock()
+		cancel()
+	}()
+
+	stages := []pipelineStage{
+		{"ingest", p.ingest},
+		{"transcribe", p.transcribe},
+		{"route", p.route},
+		{"generate", p.generate},
+		{"synthesize", p.synthesize},
+		{"deliver", p.deliver},
+		{"persist", p.persist},
+	}
+
+	for _, stage := range stages {
+		stageCtx, stageCancel := ctx, context.CancelFunc(func() {})
+		if timeout := p.timeouts[stage.name]; timeout > 0 {
+			stageCtx, stageCancel = context.WithTimeout(ctx, timeout)
+		}
+		// После /cancel новые этапы не запускаются; persist сохраняет уже доставленный ответ
+		err := ctx.Err()
+		if err == nil || stage.name == "persist" {
+			err = stage.run(stageCtx, req)
+		}
+		ctxErr := stageCtx.Err()
+		stageCancel()
+
+		if err != nil {
+			log.Printf("❌ [%s] Этап %s: %v", req.Username, stage.name, err)
+			switch {
+			case ctx.Err() == context.Canceled && p.isStopping():
+				p.notify(req, "🛑 Бот перезапускается, запрос прерван. Отправьте его ещё раз через минуту")
+			case ctx.Err() == context.Canceled:
+				p.notify(req, "🛑 Запрос отменен")
+			case ctxErr == context.DeadlineExceeded:
+				p.notify(req, fmt.Sprintf("⏱ Сервис не ответил вовремя (%s). Попробуйте ещё раз чуть позже", stageTitles[stage.name]))
+			default:
+				if se, ok := err.(*stageError); ok && se.userText != "" {
+					p.notify(req, se.userText)
+				}
+			}
+			// Неудачный запрос не должен стоить пользователю квоты
+			if err := req.Quota.Refund(); err != nil {
+				log.Printf("⚠️ %v", err)
+			}
+			return
+		}
+	}
+
+	log.Printf("✅ Сообщение от %s обработано (%s → %s)", req.Username, req.MessageType, req.ResponseType)
+}
+
+// isStopping - запросы отменены остановкой бота, а не командой /cancel
+func (p *Pipeline) isStopping() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stopping
+}
+
+// notify отправляет пользователю служебное текстовое сообщение
+func (p *Pipeline) notify(req *Request, text string) {
+	if _, err := p.bot.Send(tgbotapi.NewMessage(req.ChatID, text)); err != nil {
+		log.Printf("Ошибка отправки сообщения: %v", err)
+	}
+}
+
+// cleanup удаляет временные файлы запроса
+func (p *Pipeline) cleanup(req *Request) {
+	for _, name := range req.tempFiles {
+		os.Remove(name)
+	}
+	req.tempFiles = nil
+}
+
+// ingest скачивает голосовое, аудио или видео. Все, кроме голосовых, перекодируется
+// через ffmpeg в OGG/Opus: так из видео извлекается звук, а STT получает один формат
+func (p *Pipeline) ingest(ctx context.Context, req *Request) error {
+	media := req.Media
+	if media == nil {
+		log.Printf("[%s] %s", req.Username, req.InputText)
+		return nil
+	}
+
+	log.Printf("🎤 [%s] Получено: %s (%s, %d байт, %v)", req.Username, media.Kind, media.MimeType, media.Size, media.Duration)
+	if err := p.media.check(media); err != nil {
+		return failStage(fmt.Sprintf("⚠️ Не могу распознать: %v", err), err)
+	}
+
+	if media.Kind == "voice" {
+		p.notify(req, "🎧 Распознаю голос...")
+	} else {
+		p.notify(req, "🎧 Извлекаю звук и распознаю речь...")
+	}
+
+	path, err := p.download(ctx, req, media)
+	if err != nil {
+		return err
+	}
+
+	// Голосовые Telegram уже в OGG/Opus
+	if media.Kind == "voice" {
+		req.AudioPath = path
+		return nil
+	}
+
+	if !p.converter.Available() {
+		if media.IsVideo() {
+			return failStage("❌ Не могу извлечь звук из видео: на сервере нет ffmpeg", nil)
+		}
+		// Распространенные аудиоформаты STT понимает и без перекодирования
+		log.Printf("⚠️ ffmpeg недоступен, распознаю исходный файл %s", media.Ext())
+		req.AudioPath = path
+		return nil
+	}
+
+	speech, duration, err := p.converter.ExtractAudio(ctx, path, p.media.MaxDuration)
+	if errors.Is(err, errNoAudio) {
+		return failStage("🔇 В файле нет звука", err)
+	}
+	if err != nil {
+		return failStage("❌ Не удалось извлечь звук из файла", err)
+	}
+	req.tempFiles = append(req.tempFiles, speech)
+
+	if p.media.MaxDuration > 0 && duration > p.media.MaxDuration {
+		err := p.media.durationError(duration)
+		return failStage(fmt.Sprintf("⚠️ Не могу распознать: %v", err), err)
+	}
+
+	req.AudioPath = speech
+	return nil
+}
+
+// download скачивает файл из Telegram во временный файл, не больше лимита размера
+func (p *Pipeline) download(ctx context.Context, req *Request, media *MediaInput) (string, error) {
+	fileURL, err := p.bot.GetFileDirectURL(media.FileID)
+	if err != nil {
+		return "", failStage("❌ Ошибка получения файла", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", fileURL, nil)
+	if err != nil {
+		return "", failStage("❌ Ошибка скачивания файла", err)
+	}
+	resp, err := httpClient.Do(httpReq)
+	if err != nil {
+		return "", failStage("❌ Ошибка скачивания файла", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", failStage("❌ Ошибка скачивания файла", newAPIStatusError(resp))
+	}
+
+	tmpFile, err := os.CreateTemp(tempDir, "input-*"+media.Ext())
+	if err != nil {
+		return "", failStage("❌ Ошибка сохранения файла", err)
+	}
+	req.tempFiles = append(req.tempFiles, tmpFile.Name())
+	defer tmpFile.Close()
+
+	// Размер в Telegram бывает неизвестен (документы), поэтому лимит проверяется и при скачивании
+	body := io.Reader(resp.Body)
+	if p.media.MaxBytes > 0 {
+		body = io.LimitReader(resp.Body, p.media.MaxBytes+1)
+	}
+	n, err := io.Copy(tmpFile, body)
+	if err != nil {
+		return "", failStage("❌ Ошибка сохранения файла", err)
+	}
+	if p.media.MaxBytes > 0 && n > p.media.MaxBytes {
+		err := fmt.Errorf("файл больше %.3g МБ", float64(p.media.MaxBytes)/1024/1024)
+		return "", failStage(fmt.Sprintf("⚠️ Не могу распознать: %v", err), err)
+	}
+
+	return tmpFile.Name(), nil
+}
+
+// transcribe распознает голос в текст
+func (p *Pipeline) transcribe(ctx context.Context, req *Request) error {
+	if req.AudioPath == "" {
+		return nil
+	}
+
+	result, err := p.stt.Transcribe(ctx, req.AudioPath, p.sttLanguage)
+	if err != nil {
+		return failStage(friendlyError("распознать голос", err), err)
+	}
+
+	req.InputText = result.Text
+	req.Usage.STTSeconds += result.Duration.Seconds()
+	log.Printf("📝 Распознано (%s, язык: %s, %.1fс, уверенность: %.2f): %s",
+		result.Provider, result.Language, result.Duration.Seconds(), result.Confidence, result.Text)
+	return nil
+}
+
+// routeIntent определяет намерение по ключевому слову в начале текста
+func routeIntent(text string) (Intent, string) {
+	trimmed := strings.TrimSpace(text)
+	lower := strings.ToLower(trimmed)
+
+	for keyword, intent := range map[string]Intent{
+		"мысль": IntentThought,
+		"база":  IntentDatabase,
+	} {
+		if strings.HasPrefix(lower, keyword) {
+			// Отрезаем ключевое слово по длине в нижнем регистре: для кириллицы она совпадает
+			return intent, strings.TrimSpace(trimmed[len(keyword):])
+		}
+	}
+
+	return IntentChat, trimmed
+}
+
+// route определяет, что делать с запросом, и проверяет права пользователя
+func (p *Pipeline) route(ctx context.Context, req *Request) error {
+	if req.Intent != IntentSpeak {
+		if strings.TrimSpace(req.InputText) == "" {
+			return failStage("❌ Не удалось распознать текст сообщения", fmt.Errorf("пустой текст запроса"))
+		}
+		req.Intent, req.Payload = routeIntent(req.InputText)
+	}
+
+	if !req.User.Can(intentPermission[req.Intent]) {
+		log.Printf("🚫 Пользователь %s (%d) не имеет права %s", req.Username, req.UserID, intentPermission[req.Intent])
+		return failStage("❌ У вас нет доступа к этой функции", nil)
+	}
+	return nil
+}
+
+// generate формирует текстовый ответ в зависимости от намерения
+func (p *Pipeline) generate(ctx context.Context, req *Request) error {
+	switch req.Intent {
+	case IntentSpeak:
+		req.Response = req.Payload
+		return nil
+
+	case IntentThought:
+		if req.Payload == "" {
+			return failStage("❌ Укажите текст мысли после слова 'мысль'", nil)
+		}
+
+		log.Printf("💭 Сохраняю мысль: %s", req.Payload)
+		if err := saveThought(req.UserID, req.Payload, "general"); err != nil {
+			return failStage(fmt.Sprintf("❌ Ошибка сохранения: %v", err), err)
+		}
+
+		// Озвучиваем подтверждение
+		req.Response = "Мысль сохранена"
+		return nil
+
+	case IntentDatabase:
+		// "... таблицей" или "... графиком" выбирает вид результата и в вопрос не входит
+		var view ResultView
+		req.Payload, view = parseResultView(req.Payload)
+
+		log.Printf("💾 Обработка запроса к базе данных: %s", req.Payload)
+		p.notify(req, "💾 Обрабатываю запрос к базе данных...")
+
+		// 1. Генерируем SQL запрос через GPT и выполняем его, исправляя после ошибок
+		result, err := runNLQuery(ctx, p.llm, req, p.sql)
+		if err != nil {
+			var queryErr *sqlQueryError
+			if errors.As(err, &queryErr) {
+				return failStage(fmt.Sprintf("❌ Не удалось составить корректный запрос к базе данных: %v", err), err)
+			}
+			return failStage(friendlyError("составить запрос к базе данных", err), err)
+		}
+
+		// 2. Форматируем результаты через GPT
+		sqlResults := sqlResultText(result, sqlSummaryRows)
+		req.Response, err = formatSQLResults(ctx, p.llm, &req.Usage, req.Payload, sqlResults)
+		if err != nil {
+			return failStage(friendlyError("оформить ответ", err), err)
+		}
+
+		// 3. Таблица, файл или график - дополнение к ответу, без них ответ все равно полезен
+		if req.Attachment, err = renderSQLResult(result, view, p.sqlFile); err != nil {
+			log.Printf("⚠️ Ошибка оформления результата запроса: %v", err)
+		}
+		return nil
+
+	default:
+		if req.Media != nil {
+			p.notify(req, fmt.Sprintf("🤖 Вы сказали: \"%s\"\n\nДумаю над ответом...", req.InputText))
+		} else {
+			p.notify(req, "🤖 Думаю над ответом...")
+		}
+
+		// Без истории ответ всё равно можно получить, поэтому ошибку только логируем
+		history, err := p.memory.History(ctx, req.ChatID, &req.Usage)
+		if err != nil {
+			log.Printf("⚠️ Ошибка загрузки истории разговора: %v", err)
+		}
+
+		response, err := getChatGPTResponse(ctx, p.llm, &req.Usage, req.Persona, history, req.Payload)
+		if err != nil {
+			return failStage(friendlyError("получить ответ от ChatGPT", err), err)
+		}
+		req.Response = response
+		return nil
+	}
+}
+
+// synthesize озвучивает ответ. Длинный ответ делится на части по предложениям,
+// которые синтезируются параллельно. Ошибка синтеза не прерывает pipeline:
+// пользователь получит хотя бы текстовый ответ
+func (p *Pipeline) synthesize(ctx context.Context, req *Request) error {
+	log.Printf("💬 Ответ: %s", req.Response)
+
+	// Пользователь выбрал ответы текстом. /voice озвучивает всегда - это его единственная задача
+	if req.replyMode() == ReplyText && req.Intent != IntentSpeak {
+		return nil
+	}
+
+	// Ограничение длины для озвучивания зависит от роли
+	length := utf8.RuneCountInString(req.Response)
+	if limit := p.voiceLimit(req.User); length > limit {
+		req.Notice = fmt.Sprintf("⚠️ Ответ слишком длинный для озвучивания (макс. %d символов)", limit)
+		return nil
+	}
+
+	opts := req.Persona.applyVoice(req.Prefs.TTSOptions())
+	identity := p.tts.Identity(opts)
+	chunks := chunkText(req.Response, p.chunkChars)
+
+	// Склеенный длинный ответ кэшируется целиком: повторный запрос не требует ни синтеза, ни ffmpeg
+	joinedKey := ""
+	if len(chunks) > 1 && p.concatVoice {
+		joinedKey = ttsCacheKey(identity, fmt.Sprintf("concat:%d", p.chunkChars), req.Response)
+		if cached, ok := p.cache.Get(joinedKey); ok {
+			log.Printf("🗄 Ответ озвучен из кэша")
+			cached.Text = req.Response
+			req.Audio = []*TTSAudio{cached}
+			return nil
+		}
+	}
+
+	if len(chunks) > 1 {
+		p.notify(req, fmt.Sprintf("🎤 Генерирую голосовое сообщение (%d части)...", len(chunks)))
+	} else {
+		p.notify(req, "🎤 Генерирую голосовое сообщение...")
+	}
+
+	parts, synthesized, err := p.synthesizeChunks(ctx, identity, opts, chunks)
+	if err != nil {
+		log.Printf("Ошибка TTS: %v", err)
+		switch ctx.Err() {
+		case context.Canceled:
+			// /cancel - ответ не нужен совсем
+			return err
+		case context.DeadlineExceeded:
+			req.Notice = "⏱ Озвучивание заняло слишком много времени, отвечаю текстом"
+		default:
+			// Провайдеры озвучивания недоступны - отвечаем текстом без технических подробностей
+			var openErr *circuitOpenError
+			if errors.As(err, &openErr) {
+				req.Notice = "🔇 Озвучивание временно недоступно, поэтому отвечаю текстом"
+			} else {
+				req.Notice = "🔇 Не удалось озвучить ответ, поэтому отвечаю текстом"
+			}
+		}
+		return nil
+	}
+
+	// Части склеиваются в одно голосовое, а если не вышло - уходят по очереди
+	if len(parts) > 1 && p.concatVoice {
+		joined, err := p.converter.Concat(ctx, parts)
+		if err != nil {
+			log.Printf("⚠️ Части ответа не склеены, отправлю по очереди: %v", err)
+		} else {
+			if allCacheable(identity, parts) {
+				p.cache.Put(joinedKey, joined)
+			}
+			joined.Text = req.Response
+			parts = []*TTSAudio{joined}
+		}
+	}
+
+	req.Audio = parts
+	// Квота расходуется только на действительно синтезированный текст, кэш бесплатен
+	req.Usage.TTSChars += synthesized
+	return nil
+}
+
+// replyMode - вид ответа, выбранный пользователем
+func (req *Request) replyMode() ReplyMode {
+	if req.Prefs == nil {
+		return ReplyVoice
+	}
+	return req.Prefs.ReplyMode
+}
+
+// voiceLimit возвращает максимальную длину озвучиваемого ответа для пользователя
+func (p *Pipeline) voiceLimit(user *User) int {
+	role := RoleMember
+	if user != nil {
+		role = user.Role
+	}
+	return p.voiceLimits[role]
+}
+
+// allCacheable - все части озвучены основным провайдером
+func allCacheable(identity string, parts []*TTSAudio) bool {
+	for _, part := range parts {
+		if !cacheableBy(identity, part) {
+			return false
+		}
+	}
+	return true
+}
+
+// synthesizeChunks параллельно (не больше ttsParallel одновременно) озвучивает части ответа
+// и готовит из них голосовые. Части, которые уже есть в кэше, не синтезируются.
+// Возвращает голосовые и число синтезированных символов. Ошибка любой части отменяет остальные
+func (p *Pipeline) synthesizeChunks(ctx context.Context, identity string, opts TTSOptions, chunks []string) ([]*TTSAudio, int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	parallel := p.ttsParallel
+	if parallel < 1 {
+		parallel = 1
+	}
+	slots := make(chan struct{}, parallel)
+
+	parts := make([]*TTSAudio, len(chunks))
+	errs := make([]error, len(chunks))
+	var synthesized atomic.Int64
+	var wg sync.WaitGroup
+
+	for i, chunk := range chunks {
+		wg.Add(1)
+		go func(i int, chunk string) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			if ctx.Err() != nil {
+				errs[i] = ctx.Err()
+				return
+			}
+
+			key := ttsCacheKey(identity, "", chunk)
+			if cached, ok := p.cache.Get(key); ok {
+				cached.Text = chunk
+				parts[i] = cached
+				return
+			}
+
+			audio, err := p.tts.Synthesize(ctx, chunk, opts)
+			if err != nil {
+				errs[i] = fmt.Errorf("часть %d: %w", i+1, err)
+				cancel()
+				return
+			}
+
+			// Без перекодирования голос все равно отправится, просто без волны в Telegram
+			voice, err := p.converter.VoiceNote(ctx, audio)
+			if err != nil {
+				log.Printf("⚠️ Голос не перекодирован в OGG/Opus: %v", err)
+			}
+			synthesized.Add(int64(utf8.RuneCountInString(chunk)))
+			if cacheableBy(identity, voice) {
+				p.cache.Put(key, voice)
+			}
+			voice.Text = chunk
+			parts[i] = voice
+		}(i, chunk)
+	}
+	wg.Wait()
+
+	// Первая настоящая ошибка важнее отмены остальных частей из-за нее
+	for _, err := range errs {
+		if err != nil && !errors.Is(err, context.Canceled) {
+			return nil, 0, err
+		}
+	}
+	for _, err := range errs {
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	return parts, int(synthesized.Load()), nil
+}
+
+// Ограничения Telegram на длину текста в единицах UTF-16
+const (
+	captionLimit = 1024 // Подпись к голосовому
+	messageLimit = 4096 // Текстовое сообщение
+)
+
+// deliver отправляет ответ и вложение с результатом запроса к БД
+func (p *Pipeline) deliver(ctx context.Context, req *Request) error {
+	if err := p.sendResponse(req); err != nil {
+		return err
+	}
+	if req.Attachment != nil {
+		if err := p.sendAttachment(req.ChatID, req.Attachment); err != nil {
+			log.Printf("Ошибка отправки результата запроса: %v", err)
+		}
+	}
+	return nil
+}
+
+// sendResponse отправляет ответ голосом, а если голоса нет - текстом
+func (p *Pipeline) sendResponse(req *Request) error {
+	if len(req.Audio) > 0 {
+		err := p.sendVoices(req)
+		if err == nil {
+			req.ResponseType = "voice"
+			return nil
+		}
+		log.Printf("Ошибка отправки голоса: %v", err)
+		req.Notice = "❌ Ошибка отправки голосового сообщения"
+	}
+
+	text := fmt.Sprintf("📝 %s", req.Response)
+	if req.Notice != "" {
+		text += "\n\n" + req.Notice
+	}
+	if err := p.sendText(req.ChatID, text); err != nil {
+		return fmt.Errorf("ошибка отправки ответа: %v", err)
+	}
+	req.ResponseType = "text"
+	return nil
+}
+
+// sendText отправляет текст, деля его на сообщения, которые Telegram примет по длине
+func (p *Pipeline) sendText(chatID int64, text string) error {
+	for _, part := range chunkTextUTF16(text, messageLimit) {
+		if _, err := p.bot.Send(tgbotapi.NewMessage(chatID, part)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendAttachment отправляет таблицу сообщением, график - фото, остальное - документом
+func (p *Pipeline) sendAttachment(chatID int64, a *Attachment) error {
+	var c tgbotapi.Chattable
+	switch {
+	case a.Text != "":
+		text := a.Text
+		if a.Caption != "" {
+			text = html.EscapeString(a.Caption) + "\n" + text
+		}
+		msg := tgbotapi.NewMessage(chatID, text)
+		msg.ParseMode = tgbotapi.ModeHTML
+		c = msg
+	case a.Photo:
+		photo := tgbotapi.NewPhoto(chatID, tgbotapi.FileBytes{Name: a.FileName, Bytes: a.Data})
+		photo.Caption = a.Caption
+		c = photo
+	default:
+		doc := tgbotapi.NewDocument(chatID, tgbotapi.FileBytes{Name: a.FileName, Bytes: a.Data})
+		doc.Caption = a.Caption
+		c = doc
+	}
+	_, err := p.bot.Send(c)
+	return err
+}
+
+// sendVoices отправляет голосовые по порядку. Текст, не поместившийся в подпись,
+// а в режиме "голос и текст" - весь текст, отправляется отдельным сообщением после голоса
+func (p *Pipeline) sendVoices(req *Request) error {
+	textSeparately := req.replyMode() == ReplyBoth && req.Intent != IntentSpeak
+
+	for _, audio := range req.Audio {
+		caption := ""
+		switch {
+		case textSeparately:
+			// Текст придет отдельным сообщением, подпись его не дублирует
+		case utf16Len(audio.Text) <= captionLimit-3:
+			// "🔊 " занимает 3 единицы UTF-16, в которых Telegram считает длину подписи
+			caption = fmt.Sprintf("🔊 %s", audio.Text)
+		default:
+			textSeparately = true
+		}
+
+		if err := p.sendVoice(req, audio, caption); err != nil {
+			return err
+		}
+	}
+
+	if textSeparately {
+		if err := p.sendText(req.ChatID, fmt.Sprintf("📝 %s", req.Response)); err != nil {
+			log.Printf("Ошибка отправки текста ответа: %v", err)
+		}
+	}
+	return nil
+}
+
+// sendVoice отправляет одно голосовое. Уже загруженное в Telegram голосовое из кэша
+// отправляется по file_id, остальные загружаются, и их file_id запоминается в кэше
+func (p *Pipeline) sendVoice(req *Request, audio *TTSAudio, caption string) error {
+	newVoice := func(file tgbotapi.RequestFileData) tgbotapi.VoiceConfig {
+		voice := tgbotapi.NewVoice(req.ChatID, file)
+		voice.Caption = caption
+		if audio.Duration > 0 {
+			voice.Duration = int(math.Ceil(audio.Duration.Seconds()))
+		}
+		return voice
+	}
+
+	if audio.FileID != "" {
+		_, err := p.bot.Send(newVoice(tgbotapi.FileID(audio.FileID)))
+		if err == nil {
+			return nil
+		}
+		// file_id мог устареть - загрузим аудио заново
+		log.Printf("⚠️ Голосовое по file_id не отправлено, загружаю заново: %v", err)
+		p.cache.ForgetFileID(audio.CacheKey)
+	}
+
+	tmpFile, err := os.CreateTemp(tempDir, "voice-response-*."+audio.Format)
+	if err != nil {
+		return err
+	}
+	req.tempFiles = append(req.tempFiles, tmpFile.Name())
+
+	_, err = tmpFile.Write(audio.Data)
+	tmpFile.Close()
+	if err != nil {
+		return err
+	}
+
+	msg, err := p.bot.Send(newVoice(tgbotapi.FilePath(tmpFile.Name())))
+	if err != nil {
+		return err
+	}
+	if audio.CacheKey != "" && msg.Voice != nil {
+		p.cache.SetFileID(audio.CacheKey, msg.Voice.FileID)
+	}
+	return nil
+}
+
+// persist сохраняет диалог в историю и подтверждает фактический расход квоты
+func (p *Pipeline) persist(ctx context.Context, req *Request) error {
+	// Ответ уже доставлен, поэтому расход подтверждаем даже при ошибке сохранения истории
+	if err := req.Quota.Commit(string(req.Intent), req.Usage); err != nil {
+		log.Printf("⚠️ %v", err)
+	}
+
+	// /voice просто озвучивает текст и в историю не попадает
+	if req.Intent == IntentSpeak {
+		return nil
+	}
+
+	err := p.saveMessage(MessageRecord{
+		ChatID:       req.ChatID,
+		UserID:       req.UserID,
+		Username:     req.Username,
+		MessageType:  req.MessageType,
+		Intent:       string(req.Intent),
+		InputText:    req.InputText,
+		ResponseType: req.ResponseType,
+		ResponseText: req.Response,
+	})
+	if err != nil {
+		return fmt.Errorf("ошибка сохранения истории: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func TestRouteIntent(t *testing.T) {
+	tests := []struct {
+		text    string
+		intent  Intent
+		payload string
+	}{
+		{"Какая сегодня погода?", IntentChat, "Какая сегодня погода?"},
+		{"  привет  ", IntentChat, "привет"},
+		{"мысль купить молоко", IntentThought, "купить молоко"},
+		{"Мысль позвонить маме", IntentThought, "позвонить маме"},
+		{"МЫСЛЬ", IntentThought, ""},
+		{"база сколько сообщений за неделю", IntentDatabase, "сколько сообщений за неделю"},
+		{"База   мои мысли", IntentDatabase, "мои мысли"},
+		// Ключевое слово засчитывается только в начале
+		{"покажи базу", IntentChat, "покажи базу"},
+		{"это моя мысль", IntentChat, "это моя мысль"},
+		{"", IntentChat, ""},
+	}
+
+	for _, tt := range tests {
+		intent, payload := routeIntent(tt.text)
+		if intent != tt.intent || payload != tt.payload {
+			t.Errorf("routeIntent(%q) = %s, %q; ожидалось %s, %q", tt.text, intent, payload, tt.intent, tt.payload)
+		}
+	}
+}
+
+// fakeMessenger запоминает все, что pipeline отправляет в Telegram
+type fakeMessenger struct {
+	mu   sync.Mutex
+	sent []tgbotapi.Chattable
+}
+
+func (m *fakeMessenger) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, c)
+	return tgbotapi.Message{}, nil
+}
+
+func (m *fakeMessenger) GetFileDirectURL(fileID string) (string, error) {
+	return "", errors.New("файлы не скачиваются")
+}
+
+// texts - тексты отправленных сообщений и подписи голосовых
+func (m *fakeMessenger) texts() (messages, captions []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, c := range m.sent {
+		switch c := c.(type) {
+		case tgbotapi.MessageConfig:
+			messages = append(messages, c.Text)
+		case tgbotapi.VoiceConfig:
+			captions = append(captions, c.Caption)
+		}
+	}
+	return messages, captions
+}
+
+// fakeLLM отвечает заданным текстом или ошибкой и запоминает запросы
+type fakeLLM struct {
+	reply    string
+	err      error
+	requests []openai.ChatCompletionRequest
+}
+
+func (l *fakeLLM) CreateChatCompletion(ctx context.Context, request openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	l.requests = append(l.requests, request)
+	if l.err != nil {
+		return openai.ChatCompletionResponse{}, l.err
+	}
+	return openai.ChatCompletionResponse{
+		Choices: []openai.ChatCompletionChoice{{Message: openai.ChatCompletionMessage{Content: l.reply}}},
+		Usage:   openai.Usage{TotalTokens: 1000},
+	}, nil
+}
+
+// fakeTTS озвучивает любой текст или всегда возвращает ошибку
+type fakeTTS struct {
+	err error
+}
+
+func (f *fakeTTS) Name() string                                   { return "fake" }
+func (f *fakeTTS) Identity(opts TTSOptions) string                { return "fake" }
+func (f *fakeTTS) Voices(ctx context.Context) ([]TTSVoice, error) { return nil, nil }
+
+func (f *fakeTTS) Synthesize(ctx context.Context, text string, opts TTSOptions) (*TTSAudio, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &TTSAudio{Data: []byte("audio"), Format: "mp3", Provider: "fake"}, nil
+}
+
+// newTestPipeline - pipeline на подделках без ffmpeg, кэша и памяти разговора.
+// Сохраненные записи истории попадают в saved
+func newTestPipeline(bot Messenger, llm LLM, tts TTSProvider, saved *[]MessageRecord) *Pipeline {
+	return &Pipeline{
+		bot:         bot,
+		llm:         llm,
+		tts:         tts,
+		memory:      &ConversationMemory{client: llm},
+		voiceLimits: map[Role]int{RoleMember: 1500},
+		chunkChars:  400,
+		ttsParallel: 1,
+		active:      make(map[int64]context.CancelFunc),
+		saveMessage: func(rec MessageRecord) error {
+			*saved = append(*saved, rec)
+			return nil
+		},
+	}
+}
+
+// newTestRequest - текстовое сообщение участника с зарезервированной квотой
+func newTestRequest(t *testing.T, text string) *Request {
+	t.Helper()
+	user := &User{ID: 42, Username: "tester", Role: RoleMember}
+	reservation, window, err := reserveQuota(user, "chat")
+	if err != nil || window != nil {
+		t.Fatalf("квота не зарезервирована: %v, %v", err, window)
+	}
+	return &Request{
+		ChatID:      42,
+		UserID:      user.ID,
+		Username:    user.DisplayName(),
+		User:        user,
+		MessageType: "text",
+		InputText:   text,
+		Quota:       reservation,
+	}
+}
+
+func TestPipelineHandle(t *testing.T) {
+	openTestDB(t)
+	t.Cleanup(func() {
+		breakersMu.Lock()
+		delete(breakers, "llm:openai")
+		breakersMu.Unlock()
+	})
+
+	tests := []struct {
+		name     string
+		text     string
+		llm      *fakeLLM
+		tts      *fakeTTS
+		messages []string // Сообщения после служебных "Думаю над ответом..." и т.п.
+		captions []string
+		saved    string // Тип ответа в истории, пусто - запрос не сохранен
+		units    float64
+	}{
+		{
+			name:     "ответ голосом",
+			text:     "Привет",
+			llm:      &fakeLLM{reply: "Здравствуйте!"},
+			tts:      &fakeTTS{},
+			captions: []string{"🔊 Здравствуйте!"},
+			saved:    "voice",
+			units:    1 + 0.13, // 1000 токенов и 13 символов
+		},
+		{
+			name:     "TTS недоступен - ответ текстом",
+			text:     "Привет",
+			llm:      &fakeLLM{reply: "Здравствуйте!"},
+			tts:      &fakeTTS{err: errors.New("сервис недоступен")},
+			messages: []string{"📝 Здравствуйте!\n\n🔇 Не удалось озвучить ответ, поэтому отвечаю текстом"},
+			saved:    "text",
+			units:    1,
+		},
+		{
+			name:     "LLM перегружен - понятная ошибка и возврат квоты",
+			text:     "Привет",
+			llm:      &fakeLLM{err: &openai.APIError{HTTPStatusCode: 429, Message: "rate limit"}},
+			tts:      &fakeTTS{},
+			messages: []string{"😔 Не удалось получить ответ от ChatGPT: сервис перегружен. Попробуйте через минуту"},
+		},
+		{
+			name:     "мысль без прав - отказ без обращения к LLM",
+			text:     "мысль купить молоко",
+			llm:      &fakeLLM{reply: "не должен вызываться"},
+			tts:      &fakeTTS{},
+			messages: []string{"❌ У вас нет доступа к этой функции"},
+		},
+	}
+
+	for _, tt := range tests {
+		bot := &fakeMessenger{}
+		var saved []MessageRecord
+		p := newTestPipeline(bot, tt.llm, tt.tts, &saved)
+		req := newTestRequest(t, tt.text)
+
+		p.Handle(req)
+
+		messages, captions := bot.texts()
+		var replies []string
+		for _, m := range messages {
+			if !strings.HasPrefix(m, "🤖") && !strings.HasPrefix(m, "🎤") {
+				replies = append(replies, m)
+			}
+		}
+		if !reflect.DeepEqual(replies, tt.messages) || !reflect.DeepEqual(captions, tt.captions) {
+			t.Errorf("%s: сообщения %q, подписи %q; ожидалось %q, %q", tt.name, replies, captions, tt.messages, tt.captions)
+		}
+
+		switch {
+		case tt.saved == "" && len(saved) > 0:
+			t.Errorf("%s: запрос сохранен в историю: %+v", tt.name, saved)
+		case tt.saved != "" && (len(saved) != 1 || saved[0].ResponseType != tt.saved || saved[0].InputText != tt.text):
+			t.Errorf("%s: в истории %+v; ожидался ответ %s", tt.name, saved, tt.saved)
+		}
+
+		var units float64
+		var status string
+		if err := db.QueryRow(`SELECT units, status FROM usage_events WHERE id = ?`, req.Quota.ID).Scan(&units, &status); err != nil {
+			t.Fatal(err)
+		}
+		wantStatus := "committed"
+		if tt.saved == "" {
+			wantStatus = "refunded"
+		}
+		if status != wantStatus || math.Abs(units-tt.units) > 1e-9 {
+			t.Errorf("%s: квота %s, %v ед.; ожидалось %s, %v ед.", tt.name, status, units, wantStatus, tt.units)
+		}
+	}
+}
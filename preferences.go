@@ -0,0 +1,108 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// ReplyMode - в каком виде пользователь получает ответы
+type ReplyMode string
+
+const (
+	ReplyVoice ReplyMode = "voice" // Голосовое с текстом в подписи
+	ReplyText  ReplyMode = "text"  // Только текст, без озвучивания
+	ReplyBoth  ReplyMode = "both"  // Голосовое и текст отдельным сообщением
+)
+
+// Preferences - настройки озвучивания пользователя из таблицы user_preferences
+type Preferences struct {
+	VoiceProvider string // Провайдер TTS, к которому относится VoiceID
+	VoiceID       string // Пусто - голос из конфигурации
+	VoiceName     string
+	Stability     *float64 // nil - по умолчанию голоса
+	Similarity    *float64
+	Speed         *float64
+	ReplyMode     ReplyMode
+}
+
+// defaultPreferences - настройки пользователя, который не заходил в /settings
+func defaultPreferences() *Preferences {
+	return &Preferences{ReplyMode: ReplyVoice}
+}
+
+// TTSOptions переводит настройки в параметры синтеза
+func (p *Preferences) TTSOptions() TTSOptions {
+	if p == nil {
+		return TTSOptions{}
+	}
+	return TTSOptions{
+		Provider:   p.VoiceProvider,
+		Voice:      p.VoiceID,
+		Stability:  p.Stability,
+		Similarity: p.Similarity,
+		Speed:      p.Speed,
+	}
+}
+
+// getPreferences возвращает настройки пользователя или настройки по умолчанию
+func getPreferences(userID int64) (*Preferences, error) {
+	prefs := defaultPreferences()
+	var provider, voiceID, voiceName sql.NullString
+	var stability, similarity, speed sql.NullFloat64
+	var mode string
+
+	err := db.QueryRow(`
+	SELECT voice_provider, voice_id, voice_name, stability, similarity, speed, reply_mode
+	FROM user_preferences WHERE user_id = ?`, userID,
+	).Scan(&provider, &voiceID, &voiceName, &stability, &similarity, &speed, &mode)
+	if err == sql.ErrNoRows {
+		return prefs, nil
+	}
+	if err != nil {
+		return prefs, fmt.Errorf("ошибка чтения настроек: %v", err)
+	}
+
+	prefs.VoiceProvider = provider.String
+	prefs.VoiceID = voiceID.String
+	prefs.VoiceName = voiceName.String
+	prefs.Stability = nullFloat(stability)
+	prefs.Similarity = nullFloat(similarity)
+	prefs.Speed = nullFloat(speed)
+	prefs.ReplyMode = ReplyMode(mode)
+	return prefs, nil
+}
+
+// savePreferences сохраняет настройки пользователя
+func savePreferences(userID int64, p *Preferences) error {
+	_, err := db.Exec(`
+	INSERT INTO user_preferences (user_id, voice_provider, voice_id, voice_name, stability, similarity, speed, reply_mode, updated_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, datetime('now'))
+	ON CONFLICT(user_id) DO UPDATE SET
+		voice_provider = excluded.voice_provider,
+		voice_id = excluded.voice_id,
+		voice_name = excluded.voice_name,
+		stability = excluded.stability,
+		similarity = excluded.similarity,
+		speed = excluded.speed,
+		reply_mode = excluded.reply_mode,
+		updated_at = excluded.updated_at
+	`, userID, nullString(p.VoiceProvider), nullString(p.VoiceID), nullString(p.VoiceName),
+		p.Stability, p.Similarity, p.Speed, string(p.ReplyMode))
+	if err != nil {
+		return fmt.Errorf("ошибка сохранения настроек: %v", err)
+	}
+	return nil
+}
+
+// nullFloat переводит NULL в nil
+func nullFloat(v sql.NullFloat64) *float64 {
+	if !v.Valid {
+		return nil
+	}
+	return &v.Float64
+}
+
+// nullString сохраняет пустую строку как NULL
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
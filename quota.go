@@ -0,0 +1,386 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// sqliteTimeFormat - формат datetime('now'), в котором хранятся метки времени
+const sqliteTimeFormat = "2006-01-02 15:04:05"
+
+// Usage - фактический расход ресурсов на один запрос
+type Usage struct {
+	STTSeconds float64 // Длительность распознанного аудио
+	LLMTokens  int     // Токены всех вызовов ChatGPT
+	TTSChars   int     // Озвученные символы
+}
+
+// AddLLM добавляет токены из ответа OpenAI
+func (u *Usage) AddLLM(usage openai.Usage) {
+	if u == nil {
+		return
+	}
+	u.LLMTokens += usage.TotalTokens
+}
+
+// costWeights - сколько единиц квоты стоит каждый ресурс
+type costWeights struct {
+	STTSecond   float64 // За секунду распознавания
+	LLM1KTokens float64 // За 1000 токенов LLM
+	TTS100Chars float64 // За 100 символов озвучивания
+}
+
+// quotaWeights, defaultPlan и reserveUnits настраиваются из окружения в configureQuota
+var (
+	quotaWeights = costWeights{STTSecond: 0.1, LLM1KTokens: 1, TTS100Chars: 1}
+	defaultPlan  = "free"
+	reserveUnits = 1.0 // Сколько единиц резервируется до обработки запроса
+)
+
+// configureQuota читает веса стоимости и план по умолчанию из окружения
+func configureQuota() {
+	quotaWeights = costWeights{
+		STTSecond:   getEnvFloat("QUOTA_WEIGHT_STT_SECOND", quotaWeights.STTSecond),
+		LLM1KTokens: getEnvFloat("QUOTA_WEIGHT_LLM_1K_TOKENS", quotaWeights.LLM1KTokens),
+		TTS100Chars: getEnvFloat("QUOTA_WEIGHT_TTS_100_CHARS", quotaWeights.TTS100Chars),
+	}
+	defaultPlan = getEnv("QUOTA_DEFAULT_PLAN", defaultPlan)
+	reserveUnits = getEnvFloat("QUOTA_RESERVE_UNITS", reserveUnits)
+	log.Printf("📏 Квоты: план по умолчанию %s, резерв %.2g ед., веса: STT %.2g/с, LLM %.2g/1000 токенов, TTS %.2g/100 символов",
+		defaultPlan, reserveUnits, quotaWeights.STTSecond, quotaWeights.LLM1KTokens, quotaWeights.TTS100Chars)
+}
+
+// Units переводит расход в единицы квоты
+func (u Usage) Units() float64 {
+	return u.STTSeconds*quotaWeights.STTSecond +
+		float64(u.LLMTokens)/1000*quotaWeights.LLM1KTokens +
+		float64(u.TTSChars)/100*quotaWeights.TTS100Chars
+}
+
+// QuotaPlan - тарифный план с лимитами по окнам (NULL - без ограничения)
+type QuotaPlan struct {
+	Name    string
+	Hourly  sql.NullFloat64
+	Daily   sql.NullFloat64
+	Monthly sql.NullFloat64
+	ResetAt sql.NullTime // Последний /resetlimit: дневной расход считается с этого момента
+}
+
+// quotaWindow - состояние одного окна квоты
+type quotaWindow struct {
+	Name  string // час, день, месяц
+	Start time.Time
+	Reset time.Time
+	Limit float64
+	Used  float64
+}
+
+// Remaining возвращает остаток единиц в окне
+func (w quotaWindow) Remaining() float64 {
+	if w.Used >= w.Limit {
+		return 0
+	}
+	return w.Limit - w.Used
+}
+
+// rowQuerier - общее у *sql.DB и *sql.Tx, чтобы квоту можно было считать внутри транзакции
+type rowQuerier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// getUserPlan возвращает план пользователя с учетом индивидуального дневного лимита
+// и сброса дневного расхода
+func getUserPlan(q rowQuerier, userID int64) (*QuotaPlan, error) {
+	plan := &QuotaPlan{}
+	var dailyOverride sql.NullFloat64
+
+	err := q.QueryRow(`
+	SELECT p.name, p.hourly_units, p.daily_units, p.monthly_units, l.daily_limit, l.usage_reset_at
+	FROM quota_plans p
+	LEFT JOIN users u ON u.user_id = ?
+	LEFT JOIN user_limits l ON l.user_id = ?
+	WHERE p.name = COALESCE(u.plan, ?)
+	`, userID, userID, defaultPlan).Scan(&plan.Name, &plan.Hourly, &plan.Daily, &plan.Monthly, &dailyOverride, &plan.ResetAt)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("план квоты не найден (по умолчанию: %s)", defaultPlan)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения плана квоты: %v", err)
+	}
+
+	// Индивидуальный лимит администратора (/setlimit) важнее дневного лимита плана
+	if dailyOverride.Valid {
+		plan.Daily = dailyOverride
+	}
+	return plan, nil
+}
+
+// windowBounds возвращает начало и конец календарного окна в UTC
+func windowBounds(name string, now time.Time) (time.Time, time.Time) {
+	now = now.UTC()
+	switch name {
+	case "час":
+		start := now.Truncate(time.Hour)
+		return start, start.Add(time.Hour)
+	case "месяц":
+		start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 1, 0)
+	default:
+		start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 0, 1)
+	}
+}
+
+// usedUnits возвращает расход пользователя с указанного момента, включая резервы
+// запросов, которые еще обрабатываются
+func usedUnits(q rowQuerier, userID int64, since time.Time) (float64, error) {
+	var used float64
+	err := q.QueryRow(
+		`SELECT COALESCE(SUM(units), 0) FROM usage_events WHERE user_id = ? AND timestamp >= ?`,
+		userID, since.Format(sqliteTimeFormat),
+	).Scan(&used)
+	if err != nil {
+		return 0, fmt.Errorf("ошибка подсчета расхода: %v", err)
+	}
+	return used, nil
+}
+
+// quotaWindows возвращает ограниченные окна квоты пользователя с текущим расходом
+func quotaWindows(q rowQuerier, userID int64, now time.Time) (*QuotaPlan, []quotaWindow, error) {
+	plan, err := getUserPlan(q, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var windows []quotaWindow
+	for _, w := range []struct {
+		name  string
+		limit sql.NullFloat64
+	}{
+		{"час", plan.Hourly},
+		{"день", plan.Daily},
+		{"месяц", plan.Monthly},
+	} {
+		if !w.limit.Valid {
+			continue
+		}
+		start, reset := windowBounds(w.name, now)
+		// После /resetlimit дневное окно начинается с момента сброса, остальные не меняются
+		from := start
+		if w.name == "день" && plan.ResetAt.Valid && plan.ResetAt.Time.After(start) {
+			from = plan.ResetAt.Time
+		}
+		used, err := usedUnits(q, userID, from)
+		if err != nil {
+			return nil, nil, err
+		}
+		windows = append(windows, quotaWindow{
+			Name:  w.name,
+			Start: start,
+			Reset: reset,
+			Limit: w.limit.Float64,
+			Used:  used,
+		})
+	}
+
+	return plan, windows, nil
+}
+
+// QuotaReservation - единицы квоты, зарезервированные под запрос до его завершения.
+// После обработки резерв либо заменяется фактическим расходом (Commit),
+// либо возвращается пользователю (Refund)
+type QuotaReservation struct {
+	ID     int64
+	UserID int64
+	Units  float64
+	done   bool
+}
+
+// reserveQuota в одной транзакции проверяет окна квоты и резервирует единицы под запрос.
+// Возвращает исчерпанное окно, если резерв не помещается в лимит.
+// Транзакция берет блокировку на запись сразу (_txlock=immediate), поэтому
+// параллельные сообщения резервируют квоту строго по очереди
+func reserveQuota(user *User, kind string) (*QuotaReservation, *quotaWindow, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, nil, fmt.Errorf("ошибка начала транзакции квоты: %v", err)
+	}
+	defer tx.Rollback()
+
+	units := reserveUnits
+	// Для ролей без лимита резерв не проверяется, но расход все равно учитывается
+	if !user.Can(PermUnlimited) {
+		_, windows, err := quotaWindows(tx, user.ID, time.Now())
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, w := range windows {
+			if w.Remaining() <= 0 {
+				log.Printf("🚫 Пользователь %s (%d) исчерпал квоту за %s: %.1f/%.1f",
+					user.DisplayName(), user.ID, w.Name, w.Used, w.Limit)
+				return nil, &w, nil
+			}
+			// Остаток меньше резерва (или лимит меньше QUOTA_RESERVE_UNITS) - резервируем остаток,
+			// иначе пользователь не сможет потратить последние единицы
+			units = min(units, w.Remaining())
+		}
+	}
+
+	result, err := tx.Exec(`
+	INSERT INTO usage_events (timestamp, user_id, kind, units, status)
+	VALUES (datetime('now'), ?, ?, ?, 'reserved')
+	`, user.ID, kind, units)
+	if err != nil {
+		return nil, nil, fmt.Errorf("ошибка резервирования квоты: %v", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, nil, fmt.Errorf("ошибка резервирования квоты: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, nil, fmt.Errorf("ошибка резервирования квоты: %v", err)
+	}
+	return &QuotaReservation{ID: id, UserID: user.ID, Units: units}, nil, nil
+}
+
+// Commit заменяет резерв фактическим расходом успешно обработанного запроса
+func (r *QuotaReservation) Commit(kind string, usage Usage) error {
+	if r == nil || r.done {
+		return nil
+	}
+	r.done = true
+
+	units := usage.Units()
+	_, err := db.Exec(`
+	UPDATE usage_events
+	SET kind = ?, stt_seconds = ?, llm_tokens = ?, tts_chars = ?, units = ?, status = 'committed'
+	WHERE id = ? AND status = 'reserved'
+	`, kind, usage.STTSeconds, usage.LLMTokens, usage.TTSChars, units, r.ID)
+	if err != nil {
+		return fmt.Errorf("ошибка записи расхода: %v", err)
+	}
+
+	log.Printf("📊 Пользователь %d: расход %.2f ед. (STT %.1fс, LLM %d токенов, TTS %d символов)",
+		r.UserID, units, usage.STTSeconds, usage.LLMTokens, usage.TTSChars)
+	return nil
+}
+
+// Refund возвращает резерв: запрос завершился ошибкой и не должен стоить квоты
+func (r *QuotaReservation) Refund() error {
+	if r == nil || r.done {
+		return nil
+	}
+	r.done = true
+
+	_, err := db.Exec(`
+	UPDATE usage_events SET units = 0, status = 'refunded'
+	WHERE id = ? AND status = 'reserved'
+	`, r.ID)
+	if err != nil {
+		return fmt.Errorf("ошибка возврата квоты: %v", err)
+	}
+
+	log.Printf("↩️ Пользователю %d возвращено %.2f ед. квоты", r.UserID, r.Units)
+	return nil
+}
+
+// releaseStaleReservations возвращает резервы, оставшиеся от запросов,
+// которые прервались вместе с процессом
+func releaseStaleReservations() error {
+	result, err := db.Exec(`UPDATE usage_events SET units = 0, status = 'refunded' WHERE status = 'reserved'`)
+	if err != nil {
+		return fmt.Errorf("ошибка возврата незавершенных резервов: %v", err)
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		log.Printf("↩️ Возвращено незавершенных резервов квоты: %d", n)
+	}
+	return nil
+}
+
+// setUserPlan назначает пользователю план квоты
+func setUserPlan(userID int64, planName string) error {
+	var exists bool
+	err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM quota_plans WHERE name = ?)`, planName).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("ошибка чтения плана: %v", err)
+	}
+	if !exists {
+		return fmt.Errorf("план %q не найден, доступные: %s", planName, strings.Join(listPlanNames(), ", "))
+	}
+
+	if _, err := db.Exec(`UPDATE users SET plan = ?, updated_at = datetime('now') WHERE user_id = ?`, planName, userID); err != nil {
+		return fmt.Errorf("ошибка назначения плана: %v", err)
+	}
+	return nil
+}
+
+// listPlanNames возвращает названия всех планов
+func listPlanNames() []string {
+	rows, err := db.Query(`SELECT name FROM quota_plans ORDER BY name`)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if rows.Scan(&name) == nil {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// resetUserUsage обнуляет расход пользователя за сегодня: дневное окно будет
+// считаться с текущего момента. Часовое и месячное окна не меняются
+func resetUserUsage(userID int64) error {
+	_, err := db.Exec(`
+	INSERT INTO user_limits (user_id, usage_reset_at)
+	VALUES (?, datetime('now'))
+	ON CONFLICT(user_id) DO UPDATE SET usage_reset_at = excluded.usage_reset_at
+	`, userID)
+	if err != nil {
+		return fmt.Errorf("ошибка сброса расхода: %v", err)
+	}
+	return nil
+}
+
+// formatQuotaExceeded - сообщение пользователю об исчерпанной квоте
+func formatQuotaExceeded(w *quotaWindow) string {
+	return fmt.Sprintf("⏳ Вы исчерпали лимит за %s (%.1f из %.1f ед.).\n\n"+
+		"Лимит обновится %s UTC.\n"+
+		"Остаток можно посмотреть командой /quota. Спасибо за понимание! 🙏",
+		w.Name, w.Used, w.Limit, w.Reset.Format("02.01 15:04"))
+}
+
+// formatQuota - ответ на /quota: план, остатки и время сброса по каждому окну
+func formatQuota(user *User) (string, error) {
+	plan, windows, err := quotaWindows(db, user.ID, time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "📊 Ваш план: %s\n\n", plan.Name)
+
+	if user.Can(PermUnlimited) || len(windows) == 0 {
+		b.WriteString("♾ Без ограничений\n")
+	} else {
+		for _, w := range windows {
+			fmt.Fprintf(&b, "• За %s: осталось %.1f из %.1f ед. (сброс %s UTC)\n",
+				w.Name, w.Remaining(), w.Limit, w.Reset.Format("02.01 15:04"))
+		}
+	}
+
+	fmt.Fprintf(&b, "\nСтоимость: %.2g ед. за секунду голоса, %.2g ед. за 1000 токенов ответа, %.2g ед. за 100 озвученных символов",
+		quotaWeights.STTSecond, quotaWeights.LLM1KTokens, quotaWeights.TTS100Chars)
+	return b.String(), nil
+}
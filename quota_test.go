@@ -0,0 +1,218 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// addUsage записывает расход пользователя задним числом
+func addUsage(t *testing.T, userID int64, units float64, ago time.Duration) {
+	t.Helper()
+	_, err := db.Exec(`INSERT INTO usage_events (timestamp, user_id, kind, units) VALUES (?, ?, 'chat', ?)`,
+		time.Now().UTC().Add(-ago).Format(sqliteTimeFormat), userID, units)
+	if err != nil {
+		t.Fatalf("ошибка записи расхода: %v", err)
+	}
+}
+
+// windowUsed - расход пользователя в окне квоты
+func windowUsed(t *testing.T, userID int64, name string) float64 {
+	t.Helper()
+	_, windows, err := quotaWindows(db, userID, time.Now())
+	if err != nil {
+		t.Fatalf("ошибка чтения квоты: %v", err)
+	}
+	for _, w := range windows {
+		if w.Name == name {
+			return w.Used
+		}
+	}
+	t.Fatalf("окно %q не найдено", name)
+	return 0
+}
+
+func TestReserveQuota(t *testing.T) {
+	openTestDB(t)
+
+	// План free: 5 ед. в день, резерв - 1 ед.
+	tests := []struct {
+		name     string
+		role     Role
+		used     float64
+		exceeded string  // Исчерпанное окно, пусто - резерв принят
+		units    float64 // Ожидаемый размер резерва
+	}{
+		{"без расхода", RoleMember, 0, "", 1},
+		{"резерв помещается впритык", RoleMember, 4, "", 1},
+		{"резервируется остаток", RoleMember, 4.5, "", 0.5},
+		{"лимит исчерпан", RoleMember, 5, "день", 0},
+		{"лимит превышен", RoleMember, 7, "день", 0},
+		{"администратор без лимита", RoleAdmin, 100, "", 1},
+	}
+
+	for i, tt := range tests {
+		user := &User{ID: int64(100 + i), Role: tt.role}
+		if tt.used > 0 {
+			addUsage(t, user.ID, tt.used, time.Minute)
+		}
+
+		reservation, window, err := reserveQuota(user, "chat")
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		switch {
+		case tt.exceeded == "" && window != nil:
+			t.Errorf("%s: резерв отклонен по окну %s", tt.name, window.Name)
+		case tt.exceeded != "" && (window == nil || window.Name != tt.exceeded):
+			t.Errorf("%s: ожидался отказ по окну %s, получено %+v", tt.name, tt.exceeded, window)
+		case tt.exceeded == "" && reservation == nil:
+			t.Errorf("%s: нет резерва", tt.name)
+		case tt.exceeded != "" && reservation != nil:
+			t.Errorf("%s: резерв создан при исчерпанной квоте", tt.name)
+		case reservation != nil && reservation.Units != tt.units:
+			t.Errorf("%s: резерв %v ед.; ожидалось %v", tt.name, reservation.Units, tt.units)
+		}
+	}
+}
+
+func TestReserveQuotaLimitBelowReserve(t *testing.T) {
+	openTestDB(t)
+	user := &User{ID: 1, Role: RoleMember}
+
+	// Индивидуальный лимит меньше резерва: запросы все равно должны проходить, пока он не исчерпан
+	if err := setUserDailyLimit(user, 0.5); err != nil {
+		t.Fatal(err)
+	}
+
+	reservation, window, err := reserveQuota(user, "chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if window != nil || reservation == nil {
+		t.Fatalf("резерв отклонен при лимите 0.5 без расхода: окно %+v", window)
+	}
+	if reservation.Units != 0.5 {
+		t.Errorf("резерв %v ед.; ожидалось 0.5", reservation.Units)
+	}
+
+	// Пока резерв висит, лимит занят целиком - следующий запрос отклоняется
+	if reservation, window, err := reserveQuota(user, "chat"); err != nil || reservation != nil || window == nil {
+		t.Errorf("второй резерв при исчерпанном лимите: %+v, окно %+v, ошибка %v", reservation, window, err)
+	}
+}
+
+func TestQuotaCommitAndRefund(t *testing.T) {
+	openTestDB(t)
+	user := &User{ID: 1, Role: RoleMember}
+
+	committed, _, err := reserveQuota(user, "chat")
+	if err != nil || committed == nil {
+		t.Fatalf("резерв не создан: %v", err)
+	}
+	refunded, _, err := reserveQuota(user, "chat")
+	if err != nil || refunded == nil {
+		t.Fatalf("резерв не создан: %v", err)
+	}
+	if used := windowUsed(t, user.ID, "день"); used != 2*reserveUnits {
+		t.Errorf("расход с двумя резервами = %v; ожидалось %v", used, 2*reserveUnits)
+	}
+
+	// 2000 токенов - 2 ед., 100 символов - 1 ед., 5 секунд - 0.5 ед.
+	usage := Usage{STTSeconds: 5, LLMTokens: 2000, TTSChars: 100}
+	if err := committed.Commit("database", usage); err != nil {
+		t.Fatal(err)
+	}
+	if err := refunded.Refund(); err != nil {
+		t.Fatal(err)
+	}
+	if used := windowUsed(t, user.ID, "день"); used != 3.5 {
+		t.Errorf("расход после Commit и Refund = %v; ожидалось 3.5", used)
+	}
+
+	// Повторные Commit и Refund ничего не меняют
+	if err := committed.Refund(); err != nil {
+		t.Fatal(err)
+	}
+	if err := refunded.Commit("chat", usage); err != nil {
+		t.Fatal(err)
+	}
+	if used := windowUsed(t, user.ID, "день"); used != 3.5 {
+		t.Errorf("расход после повторных вызовов = %v; ожидалось 3.5", used)
+	}
+
+	var kind, status string
+	if err := db.QueryRow(`SELECT kind, status FROM usage_events WHERE id = ?`, committed.ID).Scan(&kind, &status); err != nil {
+		t.Fatal(err)
+	}
+	if kind != "database" || status != "committed" {
+		t.Errorf("запись расхода: %s, %s; ожидалось database, committed", kind, status)
+	}
+}
+
+func TestReleaseStaleReservations(t *testing.T) {
+	openTestDB(t)
+	user := &User{ID: 1, Role: RoleMember}
+
+	if _, _, err := reserveQuota(user, "chat"); err != nil {
+		t.Fatal(err)
+	}
+	if err := releaseStaleReservations(); err != nil {
+		t.Fatal(err)
+	}
+	if used := windowUsed(t, user.ID, "день"); used != 0 {
+		t.Errorf("расход после возврата резервов = %v; ожидалось 0", used)
+	}
+}
+
+func TestResetUserUsage(t *testing.T) {
+	openTestDB(t)
+	if _, err := db.Exec(`UPDATE quota_plans SET hourly_units = 10 WHERE name = 'free'`); err != nil {
+		t.Fatal(err)
+	}
+	const userID = 1
+	addUsage(t, userID, 3, time.Second)
+
+	if err := resetUserUsage(userID); err != nil {
+		t.Fatal(err)
+	}
+	// Сброс обнуляет только день: часовое и месячное окна считают расход как раньше
+	for name, want := range map[string]float64{"час": 3, "день": 0, "месяц": 3} {
+		if used := windowUsed(t, userID, name); used != want {
+			t.Errorf("расход за %s после сброса = %v; ожидалось %v", name, used, want)
+		}
+	}
+
+	// Расход после сброса снова попадает в дневное окно
+	if _, err := db.Exec(`UPDATE user_limits SET usage_reset_at = ? WHERE user_id = ?`,
+		time.Now().UTC().Add(-time.Minute).Format(sqliteTimeFormat), userID); err != nil {
+		t.Fatal(err)
+	}
+	if used := windowUsed(t, userID, "день"); used != 3 {
+		t.Errorf("расход за день после сброса минуту назад = %v; ожидалось 3", used)
+	}
+}
+
+func TestUserDailyLimitOverride(t *testing.T) {
+	openTestDB(t)
+	user := &User{ID: 1, Role: RoleMember}
+
+	for _, tt := range []struct {
+		limit float64
+		want  float64 // 5 - лимит плана free
+	}{
+		{2.5, 2.5},
+		{0, 0},
+		{-1, 5},
+	} {
+		if err := setUserDailyLimit(user, tt.limit); err != nil {
+			t.Fatal(err)
+		}
+		plan, err := getUserPlan(db, user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !plan.Daily.Valid || plan.Daily.Float64 != tt.want {
+			t.Errorf("лимит после /setlimit %v = %+v; ожидалось %v", tt.limit, plan.Daily, tt.want)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// --- Повтор запросов ---
+
+// retryTransport повторяет HTTP-запросы к внешним API при 429, 5xx и сетевых ошибках.
+// Пауза между попытками - экспоненциальная с джиттером, а если сервер прислал
+// Retry-After - столько, сколько он попросил
+type retryTransport struct {
+	base      http.RoundTripper
+	attempts  int
+	baseDelay time.Duration
+	maxDelay  time.Duration
+}
+
+// newRetryTransportFromEnv настраивает повторы из окружения
+func newRetryTransportFromEnv(base http.RoundTripper) *retryTransport {
+	return &retryTransport{
+		base:      base,
+		attempts:  getEnvInt("RETRY_ATTEMPTS", 3),
+		baseDelay: getEnvSeconds("RETRY_BASE_DELAY", 500*time.Millisecond),
+		maxDelay:  getEnvSeconds("RETRY_MAX_DELAY", 10*time.Second),
+	}
+}
+
+// retryableStatus - статусы, при которых запрос имеет смысл повторить
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Тело без GetBody нельзя отправить повторно
+	canRetry := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+
+		resp, err := t.base.RoundTrip(req)
+		if !canRetry || attempt >= t.attempts || req.Context().Err() != nil {
+			return resp, err
+		}
+
+		var wait time.Duration
+		switch {
+		case err != nil:
+			wait = t.backoff(attempt)
+			log.Printf("🔁 %s: %v, повтор %d/%d через %v", req.URL.Host, err, attempt, t.attempts-1, wait.Round(time.Millisecond))
+		case retryableStatus(resp.StatusCode):
+			wait = retryAfter(resp.Header.Get("Retry-After"))
+			if wait <= 0 {
+				wait = t.backoff(attempt)
+			}
+			if wait > t.maxDelay {
+				// Ждать дольше не имеет смысла - вернем ответ, пусть решает breaker
+				return resp, nil
+			}
+			log.Printf("🔁 %s: статус %d, повтор %d/%d через %v", req.URL.Host, resp.StatusCode, attempt, t.attempts-1, wait.Round(time.Millisecond))
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		default:
+			return resp, nil
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// backoff - пауза перед повтором: случайная в пределах baseDelay*2^(attempt-1), не больше maxDelay
+func (t *retryTransport) backoff(attempt int) time.Duration {
+	limit := t.baseDelay << (attempt - 1)
+	if limit <= 0 || limit > t.maxDelay {
+		limit = t.maxDelay
+	}
+	// Половина паузы фиксирована, половина случайна, чтобы повторы разных запросов не совпадали
+	return limit/2 + time.Duration(rand.Int63n(int64(limit/2)+1))
+}
+
+// retryAfter разбирает заголовок Retry-After: число секунд или HTTP-дата
+func retryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return time.Until(at)
+	}
+	return 0
+}
+
+// --- Ошибки внешних API ---
+
+// apiStatusError - ответ внешнего API с кодом ошибки
+type apiStatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *apiStatusError) Error() string {
+	return fmt.Sprintf("ошибка API (статус %d): %s", e.StatusCode, e.Body)
+}
+
+// newAPIStatusError читает тело ответа с ошибкой
+func newAPIStatusError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return &apiStatusError{StatusCode: resp.StatusCode, Body: string(body)}
+}
+
+// statusCode возвращает HTTP-статус ошибки внешнего API (0 - не HTTP-ошибка)
+func statusCode(err error) int {
+	var statusErr *apiStatusError
+	var apiErr *openai.APIError
+	var reqErr *openai.RequestError
+	switch {
+	case errors.As(err, &statusErr):
+		return statusErr.StatusCode
+	case errors.As(err, &apiErr):
+		return apiErr.HTTPStatusCode
+	case errors.As(err, &reqErr):
+		return reqErr.HTTPStatusCode
+	}
+	return 0
+}
+
+// chainError - ошибки всех провайдеров цепочки (основного и запасных)
+type chainError []error
+
+func (e chainError) Error() string {
+	parts := make([]string, len(e))
+	for i, err := range e {
+		parts[i] = err.Error()
+	}
+	return strings.Join(parts, "; ")
+}
+
+func (e chainError) Unwrap() []error { return e }
+
+// --- Circuit breaker ---
+
+// circuitOpenError - провайдер отключен breaker'ом после серии ошибок
+type circuitOpenError struct {
+	Provider string
+	Until    time.Time
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("%s временно недоступен (до %s)", e.Provider, e.Until.Format("15:04:05"))
+}
+
+// CircuitBreaker перестает обращаться к провайдеру после threshold ошибок подряд.
+// Через cooldown пропускает один пробный запрос: успех возвращает провайдера, ошибка - снова отключает
+type CircuitBreaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool // Пробный запрос уже выполняется
+}
+
+var (
+	breakersMu sync.Mutex
+	breakers   = map[string]*CircuitBreaker{}
+)
+
+// breakerFor возвращает общий breaker провайдера, создавая его при первом обращении
+func breakerFor(name string) *CircuitBreaker {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+
+	b, ok := breakers[name]
+	if !ok {
+		b = &CircuitBreaker{
+			name:      name,
+			threshold: getEnvInt("CIRCUIT_FAILURES", 5),
+			cooldown:  getEnvSeconds("CIRCUIT_COOLDOWN", 60*time.Second),
+		}
+		breakers[name] = b
+	}
+	return b
+}
+
+// allow проверяет, можно ли обратиться к провайдеру
+func (b *CircuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return nil
+	}
+	if time.Now().Before(b.openUntil) || b.probing {
+		return &circuitOpenError{Provider: b.name, Until: b.openUntil}
+	}
+	b.probing = true
+	log.Printf("🩺 %s: пробный запрос после отключения", b.name)
+	return nil
+}
+
+// record учитывает результат обращения к провайдеру
+func (b *CircuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	wasOpen := b.failures >= b.threshold
+	b.probing = false
+
+	if !countsAsFailure(err) {
+		if err == nil && wasOpen {
+			log.Printf("✅ %s снова доступен", b.name)
+		}
+		if err == nil {
+			b.failures = 0
+		}
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+		log.Printf("🔌 %s отключен на %v после %d ошибок подряд: %v", b.name, b.cooldown, b.failures, err)
+	}
+}
+
+// countsAsFailure - говорит ли ошибка о неисправности провайдера.
+// Отмена пользователем и ошибки в самом запросе (400, 404, 413, 422) провайдера не отключают
+func countsAsFailure(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	switch statusCode(err) {
+	case http.StatusBadRequest, http.StatusNotFound, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return false
+	}
+	return true
+}
+
+// callProvider выполняет обращение к провайдеру через его breaker
+func callProvider(name string, call func() error) error {
+	b := breakerFor(name)
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := call()
+	b.record(err)
+	return err
+}
+
+// --- Провайдеры с breaker ---
+
+// resilientSTT пропускает распознавание через breaker провайдера
+type resilientSTT struct {
+	STTProvider
+}
+
+func (r *resilientSTT) Transcribe(ctx context.Context, audioPath, language string) (*STTResult, error) {
+	var result *STTResult
+	err := callProvider("stt:"+r.Name(), func() error {
+		var err error
+		result, err = r.STTProvider.Transcribe(ctx, audioPath, language)
+		return err
+	})
+	return result, err
+}
+
+// resilientTTS пропускает синтез через breaker провайдера
+type resilientTTS struct {
+	TTSProvider
+}
+
+func (r *resilientTTS) Synthesize(ctx context.Context, text string, opts TTSOptions) (*TTSAudio, error) {
+	var audio *TTSAudio
+	err := callProvider("tts:"+r.Name(), func() error {
+		var err error
+		audio, err = r.TTSProvider.Synthesize(ctx, text, opts)
+		return err
+	})
+	return audio, err
+}
+
+// createChatCompletion - запрос к ChatGPT через breaker
+func createChatCompletion(ctx context.Context, client LLM, request openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	var resp openai.ChatCompletionResponse
+	err := callProvider("llm:openai", func() error {
+		var err error
+		resp, err = client.CreateChatCompletion(ctx, request)
+		return err
+	})
+	return resp, err
+}
+
+// --- Сообщения пользователю ---
+
+// friendlyError превращает ошибку внешнего сервиса в понятное пользователю сообщение.
+// service - что именно не получилось, например "распознать голос"
+func friendlyError(service string, err error) string {
+	var openErr *circuitOpenError
+	switch {
+	case errors.As(err, &openErr):
+		return fmt.Sprintf("😔 Не удалось %s: сервис временно недоступен. Попробуйте через пару минут", service)
+	case statusCode(err) == http.StatusTooManyRequests:
+		return fmt.Sprintf("😔 Не удалось %s: сервис перегружен. Попробуйте через минуту", service)
+	case statusCode(err) >= 500:
+		return fmt.Sprintf("😔 Не удалось %s: сервис временно не отвечает. Попробуйте позже", service)
+	default:
+		return fmt.Sprintf("❌ Не удалось %s, попробуйте ещё раз", service)
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Меню /settings - сообщение с inline-клавиатурой. Нажатия приходят как callback_query
+// с данными вида "set:<действие>[:<значение>]", и бот редактирует то же сообщение
+
+// settingsPageSize - сколько голосов показывается на одной странице выбора
+const settingsPageSize = 8
+
+// voiceSetting - числовая настройка голоса, которая меняется кнопками ➖/➕
+type voiceSetting struct {
+	key      string // Имя в данных callback
+	title    string
+	def      float64 // Значение по умолчанию, от которого идет первое изменение
+	min, max float64
+	step     float64
+	onlyFor  string // Провайдер, который поддерживает настройку, пусто - все
+	value    func(p *Preferences) **float64
+}
+
+var voiceSettings = []voiceSetting{
+	{key: "stab", title: "🎚 Стабильность", def: 0.5, min: 0, max: 1, step: 0.1, onlyFor: "elevenlabs",
+		value: func(p *Preferences) **float64 { return &p.Stability }},
+	{key: "sim", title: "🎯 Похожесть", def: 0.75, min: 0, max: 1, step: 0.05, onlyFor: "elevenlabs",
+		value: func(p *Preferences) **float64 { return &p.Similarity }},
+	// Диапазон скорости ElevenLabs 0.7-1.2, у OpenAI шире - берем общий
+	{key: "speed", title: "⏩ Скорость", def: 1, min: 0.7, max: 1.2, step: 0.1,
+		value: func(p *Preferences) **float64 { return &p.Speed }},
+}
+
+// replyModeTitles - названия видов ответа
+var replyModeTitles = map[ReplyMode]string{
+	ReplyVoice: "🔊 Голос",
+	ReplyText:  "📝 Текст",
+	ReplyBoth:  "🔊+📝 Оба",
+}
+
+// available - поддерживает ли провайдер настройку
+func (s voiceSetting) available(provider string) bool {
+	return s.onlyFor == "" || s.onlyFor == provider
+}
+
+// adjust изменяет настройку на шаг вверх (+1) или вниз (-1) в пределах min..max
+func (s voiceSetting) adjust(p *Preferences, direction int) {
+	field := s.value(p)
+	v := s.def
+	if *field != nil {
+		v = **field
+	}
+	v = math.Round((v+float64(direction)*s.step)*100) / 100
+	v = math.Max(s.min, math.Min(s.max, v))
+	*field = &v
+}
+
+// handleSettingsCommand показывает меню настроек
+func handleSettingsCommand(bot *tgbotapi.BotAPI, pipeline *Pipeline, user *User, message *tgbotapi.Message) {
+	prefs, err := getPreferences(user.ID)
+	if err != nil {
+		log.Printf("Ошибка чтения настроек: %v", err)
+		bot.Send(tgbotapi.NewMessage(message.Chat.ID, "❌ Не удалось загрузить настройки"))
+		return
+	}
+
+	provider := ttsProviderName(pipeline.tts)
+	msg := tgbotapi.NewMessage(message.Chat.ID, formatSettings(provider, prefs))
+	msg.ReplyMarkup = settingsKeyboard(provider, prefs)
+	bot.Send(msg)
+}
+
+// handleSettingsCallback обрабатывает нажатие кнопки меню настроек.
+// Настройки меняются у того, кто нажал кнопку
+func handleSettingsCallback(bot *tgbotapi.BotAPI, pipeline *Pipeline, user *User, query *tgbotapi.CallbackQuery) {
+	answer := func(text string) {
+		if _, err := bot.Request(tgbotapi.NewCallback(query.ID, text)); err != nil {
+			log.Printf("Ошибка ответа на callback: %v", err)
+		}
+	}
+
+	prefs, err := getPreferences(user.ID)
+	if err != nil {
+		log.Printf("Ошибка чтения настроек: %v", err)
+		answer("❌ Не удалось загрузить настройки")
+		return
+	}
+
+	provider := ttsProviderName(pipeline.tts)
+	chatID, messageID := query.Message.Chat.ID, query.Message.MessageID
+	showMenu := func() {
+		edit := tgbotapi.NewEditMessageTextAndMarkup(chatID, messageID,
+			formatSettings(provider, prefs), settingsKeyboard(provider, prefs))
+		bot.Send(edit)
+	}
+	save := func(notice string) {
+		if err := savePreferences(user.ID, prefs); err != nil {
+			log.Printf("Ошибка сохранения настроек: %v", err)
+			answer("❌ Не удалось сохранить настройки")
+			return
+		}
+		answer(notice)
+		showMenu()
+	}
+
+	parts := strings.SplitN(query.Data, ":", 3)
+	action, arg := parts[1], ""
+	if len(parts) == 3 {
+		arg = parts[2]
+	}
+
+	switch action {
+	case "menu":
+		answer("")
+		showMenu()
+
+	case "voices":
+		page, _ := strconv.Atoi(arg)
+		voices, err := listVoices(pipeline.tts)
+		if err != nil {
+			log.Printf("Ошибка получения голосов: %v", err)
+			answer("😔 Не удалось получить список голосов, попробуйте позже")
+			return
+		}
+		if len(voices) == 0 {
+			answer("У этого провайдера озвучивания нет выбора голоса")
+			return
+		}
+		answer("")
+		edit := tgbotapi.NewEditMessageTextAndMarkup(chatID, messageID,
+			"🗣 Выберите голос:", voicesKeyboard(provider, prefs, voices, page))
+		bot.Send(edit)
+
+	case "voice":
+		if arg == "default" {
+			prefs.VoiceProvider, prefs.VoiceID, prefs.VoiceName = "", "", ""
+			save("🗣 Голос по умолчанию")
+			return
+		}
+		voices, err := listVoices(pipeline.tts)
+		if err != nil {
+			log.Printf("Ошибка получения голосов: %v", err)
+			answer("😔 Не удалось получить список голосов, попробуйте позже")
+			return
+		}
+		// Данные callback приходят от клиента, поэтому голос ищется в списке провайдера
+		for _, v := range voices {
+			if v.ID == arg {
+				prefs.VoiceProvider, prefs.VoiceID, prefs.VoiceName = provider, v.ID, v.Name
+				save("🗣 Голос: " + v.Name)
+				return
+			}
+		}
+		answer("Голос не найден")
+
+	case "mode":
+		mode := ReplyMode(arg)
+		if _, ok := replyModeTitles[mode]; !ok {
+			answer("")
+			return
+		}
+		prefs.ReplyMode = mode
+		save("💬 Ответ: " + replyModeTitles[mode])
+
+	case "reset":
+		prefs = defaultPreferences()
+		save("↩️ Настройки сброшены")
+
+	default:
+		// ➖/➕ у числовых настроек: "set:<настройка>:+" или "set:<настройка>:-"
+		for _, s := range voiceSettings {
+			if s.key == action && s.available(provider) && (arg == "+" || arg == "-") {
+				direction := 1
+				if arg == "-" {
+					direction = -1
+				}
+				s.adjust(prefs, direction)
+				save("")
+				return
+			}
+		}
+		// Кнопки со значением настройки ничего не делают
+		answer("")
+	}
+}
+
+// listVoices получает голоса провайдера с ограничением по времени:
+// пользователь ждет ответа на нажатие кнопки
+func listVoices(tts TTSProvider) ([]TTSVoice, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return tts.Voices(ctx)
+}
+
+// formatSettings - текст меню с текущими настройками
+func formatSettings(provider string, prefs *Preferences) string {
+	var sb strings.Builder
+	sb.WriteString("⚙️ Настройки озвучивания\n\n")
+
+	voice := "по умолчанию"
+	if prefs.VoiceID != "" && prefs.VoiceProvider == provider {
+		voice = prefs.VoiceName
+	}
+	fmt.Fprintf(&sb, "🗣 Голос: %s\n", voice)
+
+	for _, s := range voiceSettings {
+		if !s.available(provider) {
+			continue
+		}
+		fmt.Fprintf(&sb, "%s: %s\n", s.title, formatSettingValue(s, prefs))
+	}
+	fmt.Fprintf(&sb, "💬 Ответ: %s", replyModeTitles[prefs.ReplyMode])
+	return sb.String()
+}
+
+// formatSettingValue - значение числовой настройки или "по умолчанию"
+func formatSettingValue(s voiceSetting, prefs *Preferences) string {
+	value := *s.value(prefs)
+	if value == nil {
+		return "по умолчанию"
+	}
+	return strconv.FormatFloat(*value, 'f', 2, 64)
+}
+
+// settingsKeyboard - кнопки главного меню настроек
+func settingsKeyboard(provider string, prefs *Preferences) tgbotapi.InlineKeyboardMarkup {
+	var rows [][]tgbotapi.InlineKeyboardButton
+
+	// Локальный движок настраивается только командой, выбора голоса у него нет
+	if provider != "local" {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🗣 Выбрать голос", "set:voices:0"),
+		))
+	}
+
+	for _, s := range voiceSettings {
+		if !s.available(provider) {
+			continue
+		}
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("➖", "set:"+s.key+":-"),
+			tgbotapi.NewInlineKeyboardButtonData(s.title+" "+formatSettingValue(s, prefs), "set:"+s.key),
+			tgbotapi.NewInlineKeyboardButtonData("➕", "set:"+s.key+":+"),
+		))
+	}
+
+	var modes []tgbotapi.InlineKeyboardButton
+	for _, mode := range []ReplyMode{ReplyVoice, ReplyText, ReplyBoth} {
+		title := replyModeTitles[mode]
+		if mode == prefs.ReplyMode {
+			title = "✅ " + title
+		}
+		modes = append(modes, tgbotapi.NewInlineKeyboardButtonData(title, "set:mode:"+string(mode)))
+	}
+	rows = append(rows, modes)
+
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("↩️ Сбросить", "set:reset"),
+	))
+	return tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
+
+// voicesKeyboard - страница списка голосов по два в ряд с листанием
+func voicesKeyboard(provider string, prefs *Preferences, voices []TTSVoice, page int) tgbotapi.InlineKeyboardMarkup {
+	pages := (len(voices) + settingsPageSize - 1) / settingsPageSize
+	page = max(0, min(page, pages-1))
+	start := page * settingsPageSize
+	end := min(start+settingsPageSize, len(voices))
+
+	var rows [][]tgbotapi.InlineKeyboardButton
+	var row []tgbotapi.InlineKeyboardButton
+	for _, v := range voices[start:end] {
+		title := v.Name
+		if prefs.VoiceProvider == provider && prefs.VoiceID == v.ID {
+			title = "✅ " + title
+		}
+		row = append(row, tgbotapi.NewInlineKeyboardButtonData(title, "set:voice:"+v.ID))
+		if len(row) == 2 {
+			rows = append(rows, row)
+			row = nil
+		}
+	}
+	if len(row) > 0 {
+		rows = append(rows, row)
+	}
+
+	if pages > 1 {
+		var nav []tgbotapi.InlineKeyboardButton
+		if page > 0 {
+			nav = append(nav, tgbotapi.NewInlineKeyboardButtonData("◀️", fmt.Sprintf("set:voices:%d", page-1)))
+		}
+		nav = append(nav, tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("%d/%d", page+1, pages), "set:noop"))
+		if page < pages-1 {
+			nav = append(nav, tgbotapi.NewInlineKeyboardButtonData("▶️", fmt.Sprintf("set:voices:%d", page+1)))
+		}
+		rows = append(rows, nav)
+	}
+
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("По умолчанию", "set:voice:default"),
+		tgbotapi.NewInlineKeyboardButtonData("⬅️ Назад", "set:menu"),
+	))
+	return tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// tempDir - каталог временных аудиофайлов бота. Очищается при запуске и остановке,
+// поэтому файлы прерванных запросов не накапливаются. Пусто - системный каталог
+var tempDir string
+
+// initTempDir создает каталог временных файлов, удаляя оставшиеся от прошлого запуска
+func initTempDir() error {
+	dir := getEnv("TEMP_DIR", filepath.Join(os.TempDir(), "telegram-voice-bot"))
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("ошибка очистки временного каталога: %v", err)
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("ошибка создания временного каталога: %v", err)
+	}
+	tempDir = dir
+	return nil
+}
+
+// cleanupTempDir удаляет временные файлы, которые не успели удалить запросы
+func cleanupTempDir() {
+	if tempDir == "" {
+		return
+	}
+	if err := os.RemoveAll(tempDir); err != nil {
+		log.Printf("⚠️ Ошибка удаления временных файлов: %v", err)
+		return
+	}
+	log.Printf("🧹 Временные файлы удалены")
+}
+
+// closeDB переносит WAL в основной файл БД и закрывает подключение
+func closeDB() {
+	if readDB != nil {
+		if err := readDB.Close(); err != nil {
+			log.Printf("⚠️ Ошибка закрытия БД для чтения: %v", err)
+		}
+	}
+	if _, err := db.Exec(`PRAGMA wal_checkpoint(TRUNCATE)`); err != nil {
+		log.Printf("⚠️ Ошибка сброса WAL: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		log.Printf("⚠️ Ошибка закрытия БД: %v", err)
+		return
+	}
+	log.Printf("💾 База данных закрыта")
+}
+
+// drainUpdates передает в диспетчер обновления, которые уже лежат в канале.
+// Webhook уже ответил Telegram на них 200, и без этого они потеряются
+func drainUpdates(updates tgbotapi.UpdatesChannel, submit func(update tgbotapi.Update)) {
+	for {
+		select {
+		case update, ok := <-updates:
+			if !ok {
+				return
+			}
+			submit(update)
+		default:
+			return
+		}
+	}
+}
+
+// shutdownGrace - сколько ждать воркеры после отмены запросов, прежде чем закрыть БД
+const shutdownGrace = 5 * time.Second
+
+// backgroundTasks - долгие задачи администратора (рассылка), которые не занимают
+// воркер и очередь чата. При остановке их контекст отменяется, и shutdown ждет,
+// пока они запишут итог, до закрытия БД
+type backgroundTasks struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+var background = newBackgroundTasks()
+
+func newBackgroundTasks() *backgroundTasks {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &backgroundTasks{ctx: ctx, cancel: cancel}
+}
+
+// Go запускает задачу в отдельной горутине, не давая панике уронить бота
+func (b *backgroundTasks) Go(name string, task func(ctx context.Context)) {
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("💥 Паника в фоновой задаче %s: %v", name, r)
+			}
+		}()
+		task(b.ctx)
+	}()
+}
+
+// Stop отменяет задачи и ждет их завершения не дольше timeout
+func (b *backgroundTasks) Stop(timeout time.Duration) {
+	b.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Printf("⚠️ Фоновые задачи не завершились за %v", timeout)
+	}
+}
+
+// shutdown прерывает фоновые задачи, дожидается обработки принятых сообщений (не дольше timeout)
+// и освобождает ресурсы: резервы квоты, БД и временные файлы.
+// Если время вышло, запросы в работе отменяются, а очереди сбрасываются: воркеры
+// успевают вернуть квоту и удалить свои файлы, пока БД еще открыта
+func shutdown(dispatcher *Dispatcher, pipeline *Pipeline, timeout time.Duration) {
+	// Рассылка может идти долго - прерываем ее сразу, она сама запишет, сколько успела
+	background.Stop(shutdownGrace)
+
+	log.Printf("⏳ Жду завершения обработки сообщений (до %v)...", timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := dispatcher.Shutdown(ctx); err != nil {
+		log.Printf("⚠️ %v", err)
+
+		dropped := dispatcher.Abort()
+		canceled := pipeline.CancelAll()
+		log.Printf("🛑 Отменено запросов в работе: %d, в очереди: %d", canceled, dropped)
+
+		graceCtx, graceCancel := context.WithTimeout(context.Background(), shutdownGrace)
+		defer graceCancel()
+		if err := dispatcher.Shutdown(graceCtx); err != nil {
+			log.Printf("⚠️ После отмены %v", err)
+		}
+
+		// Прерванные запросы не должны стоить пользователям квоты
+		if err := releaseStaleReservations(); err != nil {
+			log.Printf("⚠️ %v", err)
+		}
+	} else {
+		log.Printf("✅ Все принятые сообщения обработаны")
+	}
+
+	closeDB()
+	cleanupTempDir()
+}
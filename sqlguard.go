@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// SQL для запросов "база ..." составляет GPT, поэтому он считается недоверенным и проверяется в три слоя:
+//  1. checkSQL разбирает текст на лексемы: один оператор, который начинается с SELECT или WITH;
+//  2. SQLite при подготовке сообщает авторизатору каждую таблицу, колонку и функцию запроса,
+//     и всё, чего нет в белых списках (nlSchema, nlFunctions), запрещается - в том числе DELETE внутри WITH;
+//  3. запрос выполняется через отдельное подключение mode=ro с PRAGMA query_only,
+//     с ограничением по времени, числу строк и размеру значений
+
+// readDB - подключение только для чтения, через которое выполняются запросы на естественном языке
+var readDB *sql.DB
+
+// sqlMaxValueBytes - самая длинная строка или BLOB, которую может получить запрос "база ...".
+// Без ограничения одно выражение может занять сотни мегабайт памяти процесса
+const sqlMaxValueBytes = 1 << 20
+
+// readDriver - драйвер SQLite, который ограничивает размер значений на каждом новом подключении
+const readDriver = "sqlite3_nl_read"
+
+func init() {
+	sql.Register(readDriver, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			conn.SetLimit(sqlite3.SQLITE_LIMIT_LENGTH, sqlMaxValueBytes)
+			return nil
+		},
+	})
+}
+
+// openReadDB открывает подключение только для чтения. Файл БД к этому моменту уже создан миграциями
+func openReadDB() error {
+	var err error
+	readDB, err = sql.Open(readDriver, "file:"+DB_FILE+"?mode=ro&_query_only=true&_busy_timeout=5000")
+	if err != nil {
+		return fmt.Errorf("ошибка открытия БД для чтения: %v", err)
+	}
+	if err := readDB.Ping(); err != nil {
+		return fmt.Errorf("ошибка подключения к БД для чтения: %v", err)
+	}
+	return nil
+}
+
+// sqlLimits - ограничения запросов к базе на естественном языке
+type sqlLimits struct {
+	MaxRows int           // Сколько строк результата читается (файл с результатом), остальные отбрасываются
+	Timeout time.Duration // Дольше запрос прерывается
+	Repairs int           // Сколько раз модель может исправить запрос после ошибки
+}
+
+// sqlLimitsFromEnv читает ограничения из SQL_MAX_ROWS, SQL_TIMEOUT и SQL_REPAIR_ATTEMPTS
+func sqlLimitsFromEnv() sqlLimits {
+	return sqlLimits{
+		MaxRows: getEnvInt("SQL_MAX_ROWS", 1000),
+		Timeout: getEnvSeconds("SQL_TIMEOUT", 5*time.Second),
+		Repairs: getEnvInt("SQL_REPAIR_ATTEMPTS", 2),
+	}
+}
+
+// nlFunctions - разрешенные функции SQL: агрегаты, дата/время, строки и числа.
+// load_extension, readfile и подобные в список не входят, как и printf/format/replace:
+// они собирают из короткого запроса строку любой длины
+var nlFunctions = map[string]bool{
+	"count": true, "sum": true, "total": true, "avg": true, "min": true, "max": true, "group_concat": true,
+	"date": true, "time": true, "datetime": true, "julianday": true, "strftime": true, "unixepoch": true,
+	"length": true, "lower": true, "upper": true, "substr": true, "substring": true, "trim": true,
+	"ltrim": true, "rtrim": true, "instr": true, "like": true, "glob": true,
+	"abs": true, "round": true,
+	"coalesce": true, "ifnull": true, "nullif": true, "iif": true, "typeof": true,
+}
+
+// sqlToken - лексема SQL: слово (ключевое слово или идентификатор) или знак
+type sqlToken struct {
+	text string
+	pos  int  // Смещение в тексте запроса
+	word bool // Слово без кавычек
+}
+
+// sqlTokens разбирает запрос на лексемы, пропуская комментарии. Строки и идентификаторы
+// в кавычках становятся одной лексемой, поэтому ';' внутри них не разделяет операторы
+func sqlTokens(query string) ([]sqlToken, error) {
+	var tokens []sqlToken
+	isWord := func(r rune) bool { return r == '_' || r == '$' || unicode.IsLetter(r) || unicode.IsDigit(r) }
+
+	for i := 0; i < len(query); {
+		r, size := utf8.DecodeRuneInString(query[i:])
+		rest := query[i:]
+		switch {
+		case unicode.IsSpace(r):
+			i += size
+
+		case strings.HasPrefix(rest, "--"):
+			end := strings.IndexByte(rest, '\n')
+			if end < 0 {
+				end = len(rest)
+			}
+			i += end
+
+		case strings.HasPrefix(rest, "/*"):
+			end := strings.Index(rest[2:], "*/")
+			if end < 0 {
+				return nil, fmt.Errorf("незакрытый комментарий")
+			}
+			i += 2 + end + 2
+
+		case r == '\'' || r == '"' || r == '`' || r == '[':
+			closing := byte(r)
+			if r == '[' {
+				closing = ']'
+			}
+			end := 1
+			for {
+				n := strings.IndexByte(rest[end:], closing)
+				if n < 0 {
+					return nil, fmt.Errorf("незакрытая кавычка")
+				}
+				end += n + 1
+				// Удвоенная кавычка внутри строки - экранирование
+				if closing == ']' || end >= len(rest) || rest[end] != closing {
+					break
+				}
+				end++
+			}
+			tokens = append(tokens, sqlToken{text: rest[:end], pos: i})
+			i += end
+
+		case isWord(r) && r != '$':
+			end := strings.IndexFunc(rest, func(r rune) bool { return !isWord(r) })
+			if end < 0 {
+				end = len(rest)
+			}
+			tokens = append(tokens, sqlToken{text: rest[:end], pos: i, word: true})
+			i += end
+
+		default:
+			tokens = append(tokens, sqlToken{text: string(r), pos: i})
+			i += size
+		}
+	}
+	return tokens, nil
+}
+
+// checkSQL проверяет, что запрос - один оператор чтения, и возвращает его без завершающих ';'
+func checkSQL(query string) (string, error) {
+	tokens, err := sqlTokens(query)
+	if err != nil {
+		return "", fmt.Errorf("не удалось разобрать запрос: %v", err)
+	}
+
+	end := len(query)
+	for len(tokens) > 0 && tokens[len(tokens)-1].text == ";" {
+		end = tokens[len(tokens)-1].pos
+		tokens = tokens[:len(tokens)-1]
+	}
+	if len(tokens) == 0 {
+		return "", fmt.Errorf("пустой запрос")
+	}
+
+	for i, t := range tokens {
+		if t.text == ";" {
+			return "", fmt.Errorf("разрешен только один запрос")
+		}
+		// main.messages и temp.x обошли бы ограничение строк (см. sqlscope.go)
+		if schema := unquoteIdent(t.text); (schema == "main" || schema == "temp") &&
+			i+1 < len(tokens) && tokens[i+1].text == "." {
+			return "", fmt.Errorf("обращение к схеме %s запрещено", schema)
+		}
+	}
+
+	first := strings.ToUpper(tokens[0].text)
+	if !tokens[0].word || (first != "SELECT" && first != "WITH") {
+		return "", fmt.Errorf("разрешены только SELECT запросы")
+	}
+	return strings.TrimSpace(query[:end]), nil
+}
+
+// sqliteRecursive - код SQLITE_RECURSIVE (рекурсивный WITH), драйвер его не экспортирует
+const sqliteRecursive = 33
+
+// unquoteIdent - идентификатор без кавычек в нижнем регистре
+func unquoteIdent(text string) string {
+	if len(text) >= 2 && strings.ContainsRune("\"`[", rune(text[0])) {
+		text = text[1 : len(text)-1]
+	}
+	return strings.ToLower(text)
+}
+
+// errSQLDenied - запрос обращается к тому, что не входит в белые списки
+var errSQLDenied = errors.New("запрос не прошел проверку")
+
+// sqlQueryError - ошибка в самом запросе: проверка, синтаксис, неизвестная колонка, превышение времени.
+// В отличие от ошибок подключения, ее можно показать модели, чтобы она исправила запрос
+type sqlQueryError struct {
+	err error
+}
+
+func (e *sqlQueryError) Error() string { return e.err.Error() }
+func (e *sqlQueryError) Unwrap() error { return e.err }
+
+// sqlAuthorizer разрешает только чтение таблиц и колонок из nlSchema и вызов функций из nlFunctions.
+// dbTables - все таблицы и представления БД, чтобы отличать их от подзапросов и WITH.
+// Причину первого запрета записывает в denied
+func sqlAuthorizer(dbTables map[string]bool, denied *string) func(action int, arg1, arg2, dbName string) int {
+	deny := func(reason string) int {
+		if *denied == "" {
+			*denied = reason
+		}
+		return sqlite3.SQLITE_DENY
+	}
+
+	return func(action int, arg1, arg2, dbName string) int {
+		switch action {
+		case sqlite3.SQLITE_SELECT:
+			return sqlite3.SQLITE_OK
+
+		case sqlite3.SQLITE_READ:
+			table := nlSchema.Table(arg1)
+			// Пустое имя колонки - чтение без колонок, например COUNT(*). Так же приходят
+			// подзапросы и WITH, их содержимое проверяется отдельно
+			if arg2 == "" {
+				if table != nil || !dbTables[strings.ToLower(arg1)] {
+					return sqlite3.SQLITE_OK
+				}
+				return deny(fmt.Sprintf("таблица %s недоступна", arg1))
+			}
+			if table == nil || dbName != "main" {
+				return deny(fmt.Sprintf("таблица %s недоступна", arg1))
+			}
+			if table.HasColumn(arg2) {
+				return sqlite3.SQLITE_OK
+			}
+			return deny(fmt.Sprintf("колонка %s.%s недоступна", arg1, arg2))
+
+		case sqlite3.SQLITE_FUNCTION:
+			if nlFunctions[strings.ToLower(arg2)] {
+				return sqlite3.SQLITE_OK
+			}
+			return deny(fmt.Sprintf("функция %s запрещена", arg2))
+
+		case sqliteRecursive:
+			return deny("рекурсивные запросы запрещены")
+
+		default:
+			return deny("разрешено только чтение данных")
+		}
+	}
+}
+
+// sqlResult - результат запроса: колонки и строки в порядке выборки
+type sqlResult struct {
+	Columns   []string
+	Rows      [][]interface{}
+	Truncated bool // Строк было больше MaxRows
+}
+
+// queryReadOnly проверяет запрос, ограничивает его строками из scope
+// и выполняет через подключение только для чтения
+func queryReadOnly(ctx context.Context, query string, scope sqlScope, limits sqlLimits) (*sqlResult, error) {
+	query, err := checkSQL(query)
+	if err != nil {
+		return nil, &sqlQueryError{err}
+	}
+	if query, err = scopeSQL(query, scope); err != nil {
+		return nil, &sqlQueryError{err}
+	}
+
+	if limits.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, limits.Timeout)
+		defer cancel()
+	}
+
+	// Авторизатор ставится на выделенное подключение на время одного запроса,
+	// чтобы причина запрета не смешивалась с параллельными запросами
+	conn, err := readDB.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка подключения к БД: %v", err)
+	}
+	defer conn.Close()
+
+	dbTables, err := schemaTables(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var denied string
+	setAuthorizer := func(auth func(int, string, string, string) int) error {
+		return conn.Raw(func(driverConn interface{}) error {
+			c, ok := driverConn.(*sqlite3.SQLiteConn)
+			if !ok {
+				return fmt.Errorf("неожиданный драйвер БД %T", driverConn)
+			}
+			c.RegisterAuthorizer(auth)
+			return nil
+		})
+	}
+	if err := setAuthorizer(sqlAuthorizer(dbTables, &denied)); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := setAuthorizer(nil); err != nil {
+			log.Printf("⚠️ Ошибка снятия авторизатора SQL: %v", err)
+		}
+	}()
+
+	rows, err := conn.QueryContext(ctx, query)
+	if err != nil {
+		if denied != "" {
+			return nil, &sqlQueryError{fmt.Errorf("%w: %s", errSQLDenied, denied)}
+		}
+		return nil, sqlRunError(ctx, limits, err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, fmt.Errorf("ошибка получения колонок: %v", err)
+	}
+
+	result := &sqlResult{Columns: columns}
+	for rows.Next() {
+		if limits.MaxRows > 0 && len(result.Rows) == limits.MaxRows {
+			result.Truncated = true
+			break
+		}
+
+		values := make([]interface{}, len(columns))
+		valuePtrs := make([]interface{}, len(columns))
+		for i := range values {
+			valuePtrs[i] = &values[i]
+		}
+		if err := rows.Scan(valuePtrs...); err != nil {
+			return nil, fmt.Errorf("ошибка сканирования строки: %v", err)
+		}
+		for i, v := range values {
+			if b, ok := v.([]byte); ok {
+				values[i] = string(b)
+			}
+		}
+		result.Rows = append(result.Rows, values)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, sqlRunError(ctx, limits, err)
+	}
+	return result, nil
+}
+
+// schemaTables - имена всех таблиц и представлений БД в нижнем регистре
+func schemaTables(ctx context.Context, conn *sql.Conn) (map[string]bool, error) {
+	rows, err := conn.QueryContext(ctx, `SELECT lower(name) FROM sqlite_master WHERE type IN ('table', 'view')`)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения схемы БД: %v", err)
+	}
+	defer rows.Close()
+
+	schema := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("ошибка чтения схемы БД: %v", err)
+		}
+		schema[name] = true
+	}
+	// Служебные таблицы SQLite не перечислены в sqlite_master
+	schema["sqlite_master"], schema["sqlite_schema"] = true, true
+	return schema, rows.Err()
+}
+
+// sqlRunError - ошибка выполнения, превышение времени сообщается отдельно
+func sqlRunError(ctx context.Context, limits sqlLimits, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return &sqlQueryError{fmt.Errorf("запрос выполнялся дольше %v", limits.Timeout)}
+	}
+	return &sqlQueryError{fmt.Errorf("ошибка выполнения SQL: %v", err)}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCheckSQL(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string // Запрос после проверки
+		err   string // Часть текста ошибки, пусто - запрос разрешен
+	}{
+		{query: "SELECT 1", want: "SELECT 1"},
+		{query: "  select * from messages;; ", want: "select * from messages"},
+		{query: "WITH t AS (SELECT 1) SELECT * FROM t;", want: "WITH t AS (SELECT 1) SELECT * FROM t"},
+		{query: "SELECT ';' AS s -- ; DROP TABLE messages", want: "SELECT ';' AS s -- ; DROP TABLE messages"},
+		{query: "", err: "пустой запрос"},
+		{query: " ; ", err: "пустой запрос"},
+		{query: "-- только комментарий", err: "пустой запрос"},
+		{query: "SELECT 1; DROP TABLE messages", err: "только один запрос"},
+		{query: "SELECT 1 /* ; */; DELETE FROM thoughts", err: "только один запрос"},
+		{query: "DELETE FROM messages", err: "только SELECT"},
+		{query: "PRAGMA table_info(users)", err: "только SELECT"},
+		{query: "ATTACH DATABASE 'x.db' AS x", err: "только SELECT"},
+		{query: "'SELECT' FROM messages", err: "только SELECT"},
+		{query: "SELECT * FROM main.messages", err: "схеме main"},
+		{query: "SELECT * FROM \"MAIN\" . messages", err: "схеме main"},
+		{query: "SELECT * FROM [temp].t", err: "схеме temp"},
+		{query: "SELECT 'abc", err: "не удалось разобрать"},
+	}
+
+	for _, tt := range tests {
+		got, err := checkSQL(tt.query)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("checkSQL(%q) = %q, %v; ожидалась ошибка %q", tt.query, got, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("checkSQL(%q) = %q, %v; ожидалось %q", tt.query, got, err, tt.want)
+		}
+	}
+}
+
+func TestQueryReadOnly(t *testing.T) {
+	openTestDB(t)
+	if _, err := db.Exec(`
+	INSERT INTO messages (user_id, input_text) VALUES (1, 'первое'), (1, 'второе'), (2, 'чужое');
+	INSERT INTO thoughts (thought_text, user_id) VALUES ('моя', 1), ('старая', NULL), ('чужая', 2);
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	owner := sqlScope{UserID: 1, AllMessages: true, Owner: true}
+	admin := sqlScope{UserID: 3, AllMessages: true}
+	member := sqlScope{UserID: 2}
+
+	tests := []struct {
+		name   string
+		query  string
+		scope  sqlScope
+		rows   int    // Сколько строк вернет запрос
+		denied string // Часть текста ошибки, пусто - запрос выполняется
+	}{
+		{name: "участник видит свои сообщения", query: "SELECT * FROM messages", scope: member, rows: 1},
+		{name: "чужие сообщения не видны и по условию", query: "SELECT * FROM messages WHERE user_id = 1", scope: member, rows: 0},
+		{name: "ошибка в запросе передается модели", query: "SELECT nope FROM messages", scope: member, denied: "no such column"},
+		{name: "подзапрос тоже ограничен", query: "SELECT * FROM (SELECT user_id FROM messages)", scope: member, rows: 1},
+		{name: "собственный WITH тоже ограничен", query: "WITH m AS (SELECT * FROM messages) SELECT * FROM m", scope: member, rows: 1},
+		{name: "администратор видит всю историю", query: "SELECT * FROM messages", scope: admin, rows: 3},
+		{name: "администратор не видит чужие мысли", query: "SELECT * FROM thoughts", scope: admin, rows: 0},
+		{name: "владелец видит мысли без автора", query: "SELECT * FROM thoughts", scope: owner, rows: 2},
+		{name: "участник видит свои мысли", query: "SELECT thought_text FROM thoughts", scope: member, rows: 1},
+		{name: "обход подмены через main", query: "SELECT * FROM main.messages", scope: member, denied: "схеме main"},
+		{name: "таблица вне схемы", query: "SELECT * FROM user_limits", scope: owner, denied: "таблица user_limits недоступна"},
+		{name: "COUNT(*) по таблице вне схемы", query: "SELECT COUNT(*) FROM usage_events", scope: owner, denied: "таблица usage_events недоступна"},
+		{name: "системная таблица", query: "SELECT sql FROM sqlite_master", scope: owner, denied: "недоступна"},
+		{name: "pragma через функцию-таблицу", query: "SELECT * FROM pragma_table_info('users')", scope: owner, denied: "недоступна"},
+		{name: "запрещенная функция", query: "SELECT load_extension('x')", scope: owner, denied: "функция load_extension запрещена"},
+		{name: "printf собирает строку любой длины", query: "SELECT printf('%.*c', 100000000, 'x')", scope: owner, denied: "функция printf запрещена"},
+		{name: "replace тоже", query: "SELECT replace(input_text, 'е', input_text) FROM messages", scope: owner, denied: "функция replace запрещена"},
+		{name: "рекурсивный запрос", query: "WITH RECURSIVE n(x) AS (SELECT 1 UNION ALL SELECT x + 1 FROM n) SELECT x FROM n", scope: owner, denied: "рекурсивные"},
+		{name: "запись", query: "DELETE FROM messages", scope: owner, denied: "только SELECT"},
+	}
+
+	for _, tt := range tests {
+		result, err := queryReadOnly(context.Background(), tt.query, tt.scope, sqlLimits{MaxRows: 100})
+		if tt.denied != "" {
+			var queryErr *sqlQueryError
+			switch {
+			case err == nil:
+				t.Errorf("%s: запрос выполнен, ожидалась ошибка %q", tt.name, tt.denied)
+			case !errors.As(err, &queryErr):
+				t.Errorf("%s: ошибка %v не передается модели для исправления", tt.name, err)
+			case !strings.Contains(err.Error(), tt.denied):
+				t.Errorf("%s: ошибка %q; ожидалась %q", tt.name, err, tt.denied)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if len(result.Rows) != tt.rows {
+			t.Errorf("%s: %d строк; ожидалось %d", tt.name, len(result.Rows), tt.rows)
+		}
+	}
+
+	// Данные в БД не изменились
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM messages`).Scan(&count); err != nil || count != 3 {
+		t.Errorf("в messages %d строк (%v); ожидалось 3", count, err)
+	}
+}
+
+func TestQueryReadOnlyMaxRows(t *testing.T) {
+	openTestDB(t)
+	if _, err := db.Exec(`INSERT INTO messages (user_id, input_text) VALUES (1, 'a'), (1, 'b'), (1, 'c')`); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := queryReadOnly(context.Background(), "SELECT input_text FROM messages ORDER BY id",
+		sqlScope{UserID: 1}, sqlLimits{MaxRows: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Rows) != 2 || !result.Truncated {
+		t.Errorf("%d строк, Truncated = %v; ожидалось 2 строки и Truncated", len(result.Rows), result.Truncated)
+	}
+	if result.Rows[0][0] != "a" {
+		t.Errorf("первая строка %v; ожидалось a", result.Rows[0][0])
+	}
+}
+
+func TestReadDBValueLimit(t *testing.T) {
+	openTestDB(t)
+
+	// Ограничение стоит на самом подключении и действует, даже если авторизатор что-то пропустит
+	var n int
+	if err := readDB.QueryRow(`SELECT length(zeroblob(?))`, sqlMaxValueBytes).Scan(&n); err != nil || n != sqlMaxValueBytes {
+		t.Errorf("значение в %d байт: %d, %v", sqlMaxValueBytes, n, err)
+	}
+	err := readDB.QueryRow(`SELECT length(zeroblob(?))`, sqlMaxValueBytes+1).Scan(&n)
+	if err == nil || !strings.Contains(err.Error(), "too big") {
+		t.Errorf("значение больше %d байт: %d, %v; ожидалась ошибка", sqlMaxValueBytes, n, err)
+	}
+	if err := readDB.QueryRow(`SELECT length(printf('%.*c', 100000000, 'x'))`).Scan(&n); err == nil {
+		t.Errorf("printf вернул строку длиной %d", n)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Запрос "база ..." видит только разрешенные пользователю строки. Ограничение не доверяется
+// промпту: перед выполнением запрос переписывается так, что каждая таблица из nlSchema
+// подменяется одноименным WITH с отфильтрованными строками. Обращения вида main.messages,
+// которые обошли бы подмену, запрещает checkSQL
+
+// sqlScope - чьи строки доступны запросу
+type sqlScope struct {
+	UserID      int64
+	AllMessages bool // История всех пользователей (владелец и администраторы)
+	Owner       bool // Мысли без автора, сохраненные до появления thoughts.user_id, принадлежат владельцу
+}
+
+// newSQLScope - область видимости данных для пользователя
+func newSQLScope(user *User) sqlScope {
+	return sqlScope{
+		UserID:      user.ID,
+		AllMessages: user.Can(PermAdmin),
+		Owner:       user.Role == RoleOwner,
+	}
+}
+
+// userRowsFilter - строки пользователя; владелец и администраторы видят все
+func userRowsFilter(scope sqlScope) string {
+	if scope.AllMessages {
+		return ""
+	}
+	return fmt.Sprintf("user_id = %d", scope.UserID)
+}
+
+// nlTableFilters - условие WHERE для строк каждой таблицы, пусто - все строки.
+// Открытая таблица без записи здесь фильтруется по user_id как messages, если такая колонка есть
+var nlTableFilters = map[string]func(scope sqlScope) string{
+	"messages": userRowsFilter,
+	// Мысли видны только автору, даже администраторам
+	"thoughts": func(scope sqlScope) string {
+		if scope.Owner {
+			return fmt.Sprintf("(user_id = %d OR user_id IS NULL)", scope.UserID)
+		}
+		return fmt.Sprintf("user_id = %d", scope.UserID)
+	},
+}
+
+// scopeSQL добавляет к проверенному запросу WITH, которые подменяют таблицы из nlSchema
+// отфильтрованными строками. Собственный WITH запроса продолжает список
+func scopeSQL(query string, scope sqlScope) (string, error) {
+	tokens, err := sqlTokens(query)
+	if err != nil {
+		return "", fmt.Errorf("не удалось разобрать запрос: %v", err)
+	}
+
+	var ctes []string
+	for _, t := range nlSchema.Tables {
+		cte := fmt.Sprintf("%s AS (SELECT %s FROM main.%s", t.Name, strings.Join(t.ColumnNames(), ", "), t.Name)
+		filter := nlTableFilters[t.Name]
+		if filter == nil && t.HasColumn("user_id") {
+			filter = userRowsFilter
+		}
+		if filter != nil {
+			if where := filter(scope); where != "" {
+				cte += " WHERE " + where
+			}
+		}
+		ctes = append(ctes, cte+")")
+	}
+	if len(ctes) == 0 {
+		return query, nil
+	}
+	prefix := strings.Join(ctes, ",\n")
+
+	if !strings.EqualFold(tokens[0].text, "WITH") {
+		return "WITH " + prefix + "\n" + query, nil
+	}
+	if len(tokens) < 2 {
+		return "", fmt.Errorf("неполный запрос")
+	}
+	// WITH [RECURSIVE] a AS (...) SELECT ... → WITH [RECURSIVE] <подмены>, a AS (...) SELECT ...
+	rest := tokens[1]
+	head := "WITH "
+	if strings.EqualFold(rest.text, "RECURSIVE") && len(tokens) > 2 {
+		head = "WITH RECURSIVE "
+		rest = tokens[2]
+	}
+	return head + prefix + ",\n" + query[rest.pos:], nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import "testing"
+
+// testNLSchema - схема без БД: messages и thoughts с user_id, notes - с user_id без своего фильтра,
+// tags - без user_id
+func testNLSchema(t *testing.T) {
+	t.Helper()
+	prev := nlSchema
+	t.Cleanup(func() { nlSchema = prev })
+
+	columns := func(names ...string) []NLColumn {
+		var cols []NLColumn
+		for _, name := range names {
+			cols = append(cols, NLColumn{Name: name})
+		}
+		return cols
+	}
+	nlSchema = &NLSchema{Tables: []*NLTable{
+		{Name: "messages", Columns: columns("id", "user_id", "input_text")},
+		{Name: "thoughts", Columns: columns("id", "user_id", "thought_text")},
+		{Name: "notes", Columns: columns("id", "user_id")},
+		{Name: "tags", Columns: columns("id", "name")},
+	}}
+}
+
+func TestScopeSQL(t *testing.T) {
+	testNLSchema(t)
+
+	const (
+		tags   = "tags AS (SELECT id, name FROM main.tags)"
+		query  = "SELECT COUNT(*) FROM messages"
+		member = "WITH messages AS (SELECT id, user_id, input_text FROM main.messages WHERE user_id = 7),\n" +
+			"thoughts AS (SELECT id, user_id, thought_text FROM main.thoughts WHERE user_id = 7),\n" +
+			"notes AS (SELECT id, user_id FROM main.notes WHERE user_id = 7),\n" + tags
+	)
+
+	tests := []struct {
+		name  string
+		query string
+		scope sqlScope
+		want  string
+	}{
+		{
+			name:  "участник видит только свои строки",
+			query: query,
+			scope: sqlScope{UserID: 7},
+			want:  member + "\n" + query,
+		},
+		{
+			name:  "администратор видит всю историю, но только свои мысли",
+			query: query,
+			scope: sqlScope{UserID: 1, AllMessages: true},
+			want: "WITH messages AS (SELECT id, user_id, input_text FROM main.messages),\n" +
+				"thoughts AS (SELECT id, user_id, thought_text FROM main.thoughts WHERE user_id = 1),\n" +
+				"notes AS (SELECT id, user_id FROM main.notes),\n" + tags + "\n" + query,
+		},
+		{
+			name:  "владелец видит мысли без автора",
+			query: query,
+			scope: sqlScope{UserID: 1, AllMessages: true, Owner: true},
+			want: "WITH messages AS (SELECT id, user_id, input_text FROM main.messages),\n" +
+				"thoughts AS (SELECT id, user_id, thought_text FROM main.thoughts WHERE (user_id = 1 OR user_id IS NULL)),\n" +
+				"notes AS (SELECT id, user_id FROM main.notes),\n" + tags + "\n" + query,
+		},
+		{
+			name:  "собственный WITH продолжает список",
+			query: "with recent AS (SELECT * FROM messages) SELECT * FROM recent",
+			scope: sqlScope{UserID: 7},
+			want:  member + ",\nrecent AS (SELECT * FROM messages) SELECT * FROM recent",
+		},
+		{
+			name:  "WITH RECURSIVE сохраняется",
+			query: "WITH RECURSIVE n(x) AS (SELECT 1) SELECT x FROM n",
+			scope: sqlScope{UserID: 7},
+			want:  "WITH RECURSIVE " + member[len("WITH "):] + ",\nn(x) AS (SELECT 1) SELECT x FROM n",
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := scopeSQL(tt.query, tt.scope)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s:\n%s\nожидалось:\n%s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNewSQLScope(t *testing.T) {
+	tests := []struct {
+		role  Role
+		all   bool
+		owner bool
+	}{
+		{RoleOwner, true, true},
+		{RoleAdmin, true, false},
+		{RoleMember, false, false},
+	}
+
+	for _, tt := range tests {
+		scope := newSQLScope(&User{ID: 5, Role: tt.role})
+		if scope.UserID != 5 || scope.AllMessages != tt.all || scope.Owner != tt.owner {
+			t.Errorf("newSQLScope(%s) = %+v", tt.role, scope)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Результат запроса "база ..." кроме голосового пересказа может прийти таблицей,
+// файлом CSV/XLSX или графиком. Вид выбирается по форме результата или словом
+// "таблицей"/"графиком" в конце запроса
+
+// ResultView - как показать результат запроса
+type ResultView string
+
+const (
+	ViewAuto  ResultView = ""      // По форме результата
+	ViewTable ResultView = "table" // "... таблицей"
+	ViewChart ResultView = "chart" // "... графиком"
+)
+
+// resultViewSuffixes - слово в конце запроса, которое выбирает вид результата
+var resultViewSuffixes = map[string]ResultView{
+	"таблицей": ViewTable,
+	"графиком": ViewChart,
+}
+
+const (
+	sqlSummaryRows = 50   // Сколько строк результата пересказывает GPT
+	sqlTableRows   = 20   // Больше строк - файл вместо таблицы в сообщении
+	sqlTableChars  = 3500 // Длиннее - файл: сообщение Telegram ограничено 4096 символами
+	sqlCellRunes   = 30   // Длинные значения в таблице обрезаются
+	sqlChartBars   = 30   // Больше столбцов на графике не различить
+)
+
+// Attachment - дополнительное сообщение к ответу: таблица, файл или график
+type Attachment struct {
+	Text     string // Таблица в HTML (<pre>), если не пусто
+	FileName string
+	Data     []byte
+	Photo    bool // Отправить как фото (график), иначе документом
+	Caption  string
+}
+
+// parseResultView отделяет от запроса слово "таблицей" или "графиком" в конце
+func parseResultView(payload string) (string, ResultView) {
+	trimmed := strings.TrimRight(strings.TrimSpace(payload), ".!?")
+	i := strings.LastIndexFunc(trimmed, func(r rune) bool { return r == ' ' || r == ',' })
+	if i < 0 {
+		// Одно слово - это сам вопрос
+		return payload, ViewAuto
+	}
+	view, ok := resultViewSuffixes[strings.ToLower(trimmed[i+1:])]
+	if !ok {
+		return payload, ViewAuto
+	}
+	return strings.TrimRight(trimmed[:i+1], " ,"), view
+}
+
+// renderSQLResult готовит вложение с результатом. nil - хватит голосового ответа
+// (пустой результат или одно значение). fileFormat - csv или xlsx
+func renderSQLResult(result *sqlResult, view ResultView, fileFormat string) (*Attachment, error) {
+	if len(result.Rows) == 0 {
+		return nil, nil
+	}
+
+	chart := chartKind(result)
+	switch view {
+	case ViewChart:
+		if chart != "" {
+			return renderChartAttachment(result, chart)
+		}
+		// Построить нечего - покажем таблицей и объясним почему
+		a, err := renderTableAttachment(result, fileFormat)
+		if a != nil {
+			a.Caption = "⚠️ График строится по двум колонкам: подпись и число"
+		}
+		return a, err
+
+	case ViewTable:
+		return renderTableAttachment(result, fileFormat)
+
+	default:
+		if len(result.Rows) == 1 && len(result.Columns) <= 2 {
+			return nil, nil
+		}
+		if chart != "" {
+			return renderChartAttachment(result, chart)
+		}
+		return renderTableAttachment(result, fileFormat)
+	}
+}
+
+// renderTableAttachment - моноширинная таблица, а для большого результата - файл
+func renderTableAttachment(result *sqlResult, fileFormat string) (*Attachment, error) {
+	if len(result.Rows) <= sqlTableRows && !result.Truncated {
+		if table := formatTable(result); utf8.RuneCountInString(table) <= sqlTableChars {
+			return &Attachment{Text: "<pre>" + html.EscapeString(table) + "</pre>"}, nil
+		}
+	}
+
+	caption := fmt.Sprintf("📎 Результат запроса: %d строк", len(result.Rows))
+	if result.Truncated {
+		caption = fmt.Sprintf("📎 Первые %d строк результата", len(result.Rows))
+	}
+	if fileFormat == "xlsx" {
+		data, err := formatXLSX(result)
+		if err != nil {
+			return nil, err
+		}
+		return &Attachment{FileName: "result.xlsx", Data: data, Caption: caption}, nil
+	}
+	data, err := formatCSV(result)
+	if err != nil {
+		return nil, err
+	}
+	return &Attachment{FileName: "result.csv", Data: data, Caption: caption}, nil
+}
+
+// formatSQLValue - значение ячейки в виде текста
+func formatSQLValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case time.Time:
+		if v.Hour() == 0 && v.Minute() == 0 && v.Second() == 0 {
+			return v.Format("2006-01-02")
+		}
+		return v.Format("2006-01-02 15:04:05")
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// formatTable - таблица с выравниванием по ширине колонок для моноширинного шрифта
+func formatTable(result *sqlResult) string {
+	cells := make([][]string, 0, len(result.Rows)+1)
+	cells = append(cells, result.Columns)
+	for _, row := range result.Rows {
+		line := make([]string, len(row))
+		for i, v := range row {
+			// Переносы строк сломали бы таблицу
+			s := strings.Join(strings.Fields(formatSQLValue(v)), " ")
+			if utf8.RuneCountInString(s) > sqlCellRunes {
+				s = string([]rune(s)[:sqlCellRunes-1]) + "…"
+			}
+			line[i] = s
+		}
+		cells = append(cells, line)
+	}
+
+	widths := make([]int, len(result.Columns))
+	for _, line := range cells {
+		for i, s := range line {
+			widths[i] = max(widths[i], utf8.RuneCountInString(s))
+		}
+	}
+
+	var sb strings.Builder
+	for n, line := range cells {
+		for i, s := range line {
+			if i > 0 {
+				sb.WriteString(" │ ")
+			}
+			sb.WriteString(s)
+			if i < len(line)-1 {
+				sb.WriteString(strings.Repeat(" ", widths[i]-utf8.RuneCountInString(s)))
+			}
+		}
+		sb.WriteString("\n")
+		if n == 0 {
+			for i, w := range widths {
+				if i > 0 {
+					sb.WriteString("─┼─")
+				}
+				sb.WriteString(strings.Repeat("─", w))
+			}
+			sb.WriteString("\n")
+		}
+	}
+	return strings.TrimRight(sb.String(), "\n")
+}
+
+// formatCSV - результат в CSV. BOM нужен, чтобы Excel открыл кириллицу в UTF-8
+func formatCSV(result *sqlResult) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString("\ufeff")
+	w := csv.NewWriter(&buf)
+	if err := w.Write(result.Columns); err != nil {
+		return nil, fmt.Errorf("ошибка записи CSV: %v", err)
+	}
+	for _, row := range result.Rows {
+		line := make([]string, len(row))
+		for i, v := range row {
+			line[i] = formatSQLValue(v)
+		}
+		if err := w.Write(line); err != nil {
+			return nil, fmt.Errorf("ошибка записи CSV: %v", err)
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return nil, fmt.Errorf("ошибка записи CSV: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// xlsxFiles - минимальная книга Excel с одним листом, лист дописывает formatXLSX
+var xlsxFiles = []struct{ name, body string }{
+	{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/></Types>`},
+	{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`},
+	{"xl/workbook.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="Результат" sheetId="1" r:id="rId1"/></sheets></workbook>`},
+	{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/></Relationships>`},
+}
+
+// formatXLSX - результат в XLSX: числа - числовыми ячейками, остальное - строками
+func formatXLSX(result *sqlResult) ([]byte, error) {
+	var sheet strings.Builder
+	sheet.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n" +
+		`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	writeRow := func(values []interface{}) {
+		sheet.WriteString("<row>")
+		for _, v := range values {
+			switch v := v.(type) {
+			case nil:
+				sheet.WriteString("<c/>")
+			case int64, float64:
+				fmt.Fprintf(&sheet, `<c><v>%s</v></c>`, formatSQLValue(v))
+			default:
+				fmt.Fprintf(&sheet, `<c t="inlineStr"><is><t xml:space="preserve">%s</t></is></c>`,
+					html.EscapeString(formatSQLValue(v)))
+			}
+		}
+		sheet.WriteString("</row>")
+	}
+	header := make([]interface{}, len(result.Columns))
+	for i, c := range result.Columns {
+		header[i] = c
+	}
+	writeRow(header)
+	for _, row := range result.Rows {
+		writeRow(row)
+	}
+	sheet.WriteString("</sheetData></worksheet>")
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	files := append(xlsxFiles[:len(xlsxFiles):len(xlsxFiles)], struct{ name, body string }{"xl/worksheets/sheet1.xml", sheet.String()})
+	for _, f := range files {
+		w, err := zw.Create(f.name)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка записи XLSX: %v", err)
+		}
+		if _, err := w.Write([]byte(f.body)); err != nil {
+			return nil, fmt.Errorf("ошибка записи XLSX: %v", err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("ошибка записи XLSX: %v", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestParseResultView(t *testing.T) {
+	tests := []struct {
+		payload  string
+		question string
+		view     ResultView
+	}{
+		{"сколько сообщений за неделю", "сколько сообщений за неделю", ViewAuto},
+		{"сообщения по дням графиком", "сообщения по дням", ViewChart},
+		{"мои мысли таблицей.", "мои мысли", ViewTable},
+		{"Сообщения по дням, Графиком!", "Сообщения по дням", ViewChart},
+		{"топ пользователей   таблицей", "топ пользователей", ViewTable},
+		// Одно слово - это сам вопрос, а не вид результата
+		{"графиком", "графиком", ViewAuto},
+		{"таблицей мои мысли", "таблицей мои мысли", ViewAuto},
+		{"", "", ViewAuto},
+	}
+
+	for _, tt := range tests {
+		question, view := parseResultView(tt.payload)
+		if question != tt.question || view != tt.view {
+			t.Errorf("parseResultView(%q) = %q, %q; ожидалось %q, %q", tt.payload, question, view, tt.question, tt.view)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// STTResult содержит результат распознавания речи
+type STTResult struct {
+	Text       string
+	Language   string        // Код языка, определённый провайдером
+	Duration   time.Duration // Длительность аудио
+	Confidence float64       // Уверенность распознавания от 0 до 1 (0 - неизвестно)
+	Provider   string        // Имя провайдера, который вернул результат
+}
+
+// STTProvider распознает речь из аудиофайла.
+// language - подсказка языка (ISO 639-1, например "ru"), пустая строка - автоопределение
+type STTProvider interface {
+	Name() string
+	Transcribe(ctx context.Context, audioPath, language string) (*STTResult, error)
+}
+
+// newSTTProvider создает провайдера распознавания по имени
+// Каждый провайдер обернут в circuit breaker, поэтому отключенный провайдер
+// цепочка пропускает сразу, не дожидаясь таймаута
+func newSTTProvider(name string, openaiClient *openai.Client) (STTProvider, error) {
+	provider, err := newBaseSTTProvider(name, openaiClient)
+	if err != nil {
+		return nil, err
+	}
+	return &resilientSTT{provider}, nil
+}
+
+// newBaseSTTProvider создает провайдера без circuit breaker
+func newBaseSTTProvider(name string, openaiClient *openai.Client) (STTProvider, error) {
+	switch strings.ToLower(name) {
+	case "elevenlabs":
+		apiKey := os.Getenv("ELEVENLABS_API_KEY")
+		if apiKey == "" {
+			return nil, fmt.Errorf("ELEVENLABS_API_KEY не задан для STT провайдера elevenlabs")
+		}
+		return &elevenLabsSTT{
+			apiKey: apiKey,
+			model:  getEnv("ELEVENLABS_STT_MODEL", "scribe_v2"),
+		}, nil
+	case "whisper", "openai":
+		return &whisperSTT{
+			client: openaiClient,
+			model:  getEnv("OPENAI_STT_MODEL", openai.Whisper1),
+		}, nil
+	default:
+		return nil, fmt.Errorf("неизвестный STT провайдер: %s", name)
+	}
+}
+
+// newSTTFromConfig собирает цепочку распознавания из STT_PROVIDER и STT_FALLBACK.
+// STT_FALLBACK - список провайдеров через запятую, "none" отключает запасные
+func newSTTFromConfig(openaiClient *openai.Client) (STTProvider, error) {
+	primaryName := getEnv("STT_PROVIDER", "elevenlabs")
+	primary, err := newSTTProvider(primaryName, openaiClient)
+	if err != nil {
+		return nil, err
+	}
+
+	fallbackNames := getEnv("STT_FALLBACK", "whisper")
+	if strings.EqualFold(fallbackNames, "none") {
+		return primary, nil
+	}
+
+	providers := []STTProvider{primary}
+	for _, name := range strings.Split(fallbackNames, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || strings.EqualFold(name, primary.Name()) {
+			continue
+		}
+		provider, err := newSTTProvider(name, openaiClient)
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, provider)
+	}
+
+	if len(providers) == 1 {
+		return primary, nil
+	}
+	return &fallbackSTT{providers: providers}, nil
+}
+
+// fallbackSTT по очереди пробует провайдеров, пока один из них не ответит
+type fallbackSTT struct {
+	providers []STTProvider
+}
+
+func (f *fallbackSTT) Name() string {
+	names := make([]string, len(f.providers))
+	for i, p := range f.providers {
+		names[i] = p.Name()
+	}
+	return strings.Join(names, " → ")
+}
+
+func (f *fallbackSTT) Transcribe(ctx context.Context, audioPath, language string) (*STTResult, error) {
+	var errs chainError
+	for _, provider := range f.providers {
+		result, err := provider.Transcribe(ctx, audioPath, language)
+		if err == nil {
+			return result, nil
+		}
+		// Время вышло или запрос отменен - запасные провайдеры уже не помогут
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("STT %s: %w", provider.Name(), ctx.Err())
+		}
+		log.Printf("⚠️ STT %s не справился: %v", provider.Name(), err)
+		errs = append(errs, fmt.Errorf("%s: %w", provider.Name(), err))
+	}
+	return nil, fmt.Errorf("все STT провайдеры вернули ошибку: %w", errs)
+}
+
+// elevenLabsSTT распознает речь через ElevenLabs Speech-to-Text
+type elevenLabsSTT struct {
+	apiKey string
+	model  string
+}
+
+type ElevenLabsSTTResponse struct {
+	Text                string  `json:"text"`
+	LanguageCode        string  `json:"language_code"`
+	LanguageProbability float64 `json:"language_probability"`
+	Words               []struct {
+		Text    string  `json:"text"`
+		Start   float64 `json:"start"`
+		End     float64 `json:"end"`
+		Type    string  `json:"type"`
+		Logprob float64 `json:"logprob"`
+	} `json:"words"`
+}
+
+func (e *elevenLabsSTT) Name() string { return "elevenlabs" }
+
+func (e *elevenLabsSTT) Transcribe(ctx context.Context, audioPath, language string) (*STTResult, error) {
+	// Открываем аудио файл
+	file, err := os.Open(audioPath)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка открытия файла: %v", err)
+	}
+	defer file.Close()
+
+	// Создаем multipart form
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	// Добавляем файл
+	part, err := writer.CreateFormFile("file", filepath.Base(audioPath))
+	if err != nil {
+		return nil, fmt.Errorf("ошибка создания form file: %v", err)
+	}
+	if _, err := io.Copy(part, file); err != nil {
+		return nil, fmt.Errorf("ошибка копирования файла: %v", err)
+	}
+
+	writer.WriteField("model_id", e.model)
+	if language != "" {
+		writer.WriteField("language_code", language)
+	}
+
+	writer.Close()
+
+	// Отправляем запрос к ElevenLabs Speech-to-Text API
+	url := "https://api.elevenlabs.io/v1/speech-to-text"
+	req, err := http.NewRequestWithContext(ctx, "POST", url, body)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка создания запроса: %v", err)
+	}
+
+	req.Header.Set("xi-api-key", e.apiKey)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка отправки запроса: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newAPIStatusError(resp)
+	}
+
+	// Парсим ответ
+	var result ElevenLabsSTTResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("ошибка декодирования ответа: %v", err)
+	}
+
+	// Длительность - конец последнего слова, уверенность - средняя вероятность слов
+	var duration float64
+	var logprobSum float64
+	var wordCount int
+	for _, w := range result.Words {
+		if w.End > duration {
+			duration = w.End
+		}
+		if w.Type == "word" {
+			logprobSum += w.Logprob
+			wordCount++
+		}
+	}
+
+	confidence := result.LanguageProbability
+	if wordCount > 0 {
+		confidence = math.Exp(logprobSum / float64(wordCount))
+	}
+
+	return &STTResult{
+		Text:       result.Text,
+		Language:   result.LanguageCode,
+		Duration:   time.Duration(duration * float64(time.Second)),
+		Confidence: confidence,
+		Provider:   e.Name(),
+	}, nil
+}
+
+// whisperSTT распознает речь через OpenAI Whisper
+type whisperSTT struct {
+	client *openai.Client
+	model  string
+}
+
+func (w *whisperSTT) Name() string { return "whisper" }
+
+func (w *whisperSTT) Transcribe(ctx context.Context, audioPath, language string) (*STTResult, error) {
+	resp, err := w.client.CreateTranscription(ctx, openai.AudioRequest{
+		Model:    w.model,
+		FilePath: audioPath,
+		Language: language,
+		Format:   openai.AudioResponseFormatVerboseJSON,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ошибка Whisper: %w", err)
+	}
+
+	// Уверенность - средняя вероятность по сегментам
+	var confidence float64
+	if len(resp.Segments) > 0 {
+		var logprobSum float64
+		for _, s := range resp.Segments {
+			logprobSum += s.AvgLogprob
+		}
+		confidence = math.Exp(logprobSum / float64(len(resp.Segments)))
+	}
+
+	return &STTResult{
+		Text:       strings.TrimSpace(resp.Text),
+		Language:   resp.Language,
+		Duration:   time.Duration(resp.Duration * float64(time.Second)),
+		Confidence: confidence,
+		Provider:   w.Name(),
+	}, nil
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// TTSAudio содержит синтезированное аудио
+type TTSAudio struct {
+	Data     []byte
+	Format   string        // Расширение файла без точки: mp3, wav, ogg (OGG/Opus)
+	Provider string        // Имя провайдера, который синтезировал аудио
+	Duration time.Duration // Длительность, известна после подготовки голосового (AudioConverter)
+	Text     string        // Озвученный текст, подпись к голосовому
+	CacheKey string        // Ключ в кэше озвучивания, пусто - аудио не кэшировано
+	FileID   string        // file_id уже загруженного в Telegram голосового
+}
+
+// TTSOptions - настройки озвучивания пользователя (/settings).
+// Пустые поля - значения по умолчанию провайдера и голоса
+type TTSOptions struct {
+	Provider   string   // Провайдер, к которому относится Voice
+	Voice      string   // ID голоса, пусто - голос из конфигурации
+	Stability  *float64 // Стабильность голоса 0..1 (ElevenLabs)
+	Similarity *float64 // Похожесть на исходный голос 0..1 (ElevenLabs)
+	Speed      *float64 // Скорость речи, 1 - обычная
+}
+
+// voiceFor возвращает выбранный пользователем голос, если он относится к провайдеру
+func (o TTSOptions) voiceFor(provider, fallback string) string {
+	if o.Voice != "" && o.Provider == provider {
+		return o.Voice
+	}
+	return fallback
+}
+
+// formatOption - значение настройки для ключа кэша
+func formatOption(value *float64) string {
+	if value == nil {
+		return "-"
+	}
+	return strconv.FormatFloat(*value, 'f', 2, 64)
+}
+
+// TTSVoice - голос из списка провайдера
+type TTSVoice struct {
+	ID   string
+	Name string
+}
+
+// ttsProviderName - имя основного провайдера цепочки: с него начинается Identity
+func ttsProviderName(tts TTSProvider) string {
+	name, _, _ := strings.Cut(tts.Identity(TTSOptions{}), "|")
+	return name
+}
+
+// TTSProvider преобразует текст в голос
+type TTSProvider interface {
+	Name() string
+	// Identity - имя провайдера, голос, модель, формат и настройки: все, от чего зависит
+	// звучание одного и того же текста. Часть ключа кэша озвучивания
+	Identity(opts TTSOptions) string
+	// Voices - голоса, которые можно выбрать в /settings. nil - выбора нет
+	Voices(ctx context.Context) ([]TTSVoice, error)
+	Synthesize(ctx context.Context, text string, opts TTSOptions) (*TTSAudio, error)
+}
+
+// newTTSProvider создает провайдера синтеза речи по имени
+// Каждый провайдер обернут в circuit breaker, поэтому отключенный провайдер
+// цепочка пропускает сразу, не дожидаясь таймаута
+func newTTSProvider(name string, openaiClient *openai.Client) (TTSProvider, error) {
+	provider, err := newBaseTTSProvider(name, openaiClient)
+	if err != nil {
+		return nil, err
+	}
+	return &resilientTTS{provider}, nil
+}
+
+// newBaseTTSProvider создает провайдера без circuit breaker
+func newBaseTTSProvider(name string, openaiClient *openai.Client) (TTSProvider, error) {
+	switch strings.ToLower(name) {
+	case "elevenlabs":
+		apiKey := os.Getenv("ELEVENLABS_API_KEY")
+		if apiKey == "" {
+			return nil, fmt.Errorf("ELEVENLABS_API_KEY не задан для TTS провайдера elevenlabs")
+		}
+		return &elevenLabsTTS{
+			apiKey:       apiKey,
+			voiceID:      getEnv("ELEVENLABS_VOICE_ID", ELEVENLABS_VOICE),
+			model:        getEnv("ELEVENLABS_TTS_MODEL", "eleven_multilingual_v2"),
+			outputFormat: getEnv("ELEVENLABS_OUTPUT_FORMAT", "opus_48000_64"),
+		}, nil
+	case "openai":
+		return &openAITTS{
+			client: openaiClient,
+			model:  getEnv("OPENAI_TTS_MODEL", string(openai.TTSModel1)),
+			voice:  getEnv("OPENAI_TTS_VOICE", string(openai.VoiceOnyx)),
+		}, nil
+	case "local":
+		command := strings.Fields(os.Getenv("TTS_LOCAL_COMMAND"))
+		if len(command) == 0 {
+			return nil, fmt.Errorf("TTS_LOCAL_COMMAND не задан для TTS провайдера local")
+		}
+		return &localTTS{
+			command: command,
+			format:  getEnv("TTS_LOCAL_FORMAT", "wav"),
+		}, nil
+	default:
+		return nil, fmt.Errorf("неизвестный TTS провайдер: %s", name)
+	}
+}
+
+// newTTSFromConfig собирает цепочку синтеза из TTS_PROVIDER и TTS_FALLBACK.
+// TTS_FALLBACK - список провайдеров через запятую, "none" отключает запасные
+func newTTSFromConfig(openaiClient *openai.Client) (TTSProvider, error) {
+	primaryName := getEnv("TTS_PROVIDER", "elevenlabs")
+	primary, err := newTTSProvider(primaryName, openaiClient)
+	if err != nil {
+		return nil, err
+	}
+
+	fallbackNames := getEnv("TTS_FALLBACK", "openai")
+	if strings.EqualFold(fallbackNames, "none") {
+		return primary, nil
+	}
+
+	providers := []TTSProvider{primary}
+	for _, name := range strings.Split(fallbackNames, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || strings.EqualFold(name, primary.Name()) {
+			continue
+		}
+		provider, err := newTTSProvider(name, openaiClient)
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, provider)
+	}
+
+	if len(providers) == 1 {
+		return primary, nil
+	}
+	return &fallbackTTS{providers: providers}, nil
+}
+
+// fallbackTTS по очереди пробует провайдеров, пока один из них не ответит.
+// Нужен, чтобы бот продолжал отвечать голосом, когда закончилась квота ElevenLabs
+type fallbackTTS struct {
+	providers []TTSProvider
+}
+
+func (f *fallbackTTS) Name() string {
+	names := make([]string, len(f.providers))
+	for i, p := range f.providers {
+		names[i] = p.Name()
+	}
+	return strings.Join(names, " → ")
+}
+
+// Identity - настройки основного провайдера: в кэш попадает только его голос
+func (f *fallbackTTS) Identity(opts TTSOptions) string { return f.providers[0].Identity(opts) }
+
+// Voices - голоса основного провайдера
+func (f *fallbackTTS) Voices(ctx context.Context) ([]TTSVoice, error) {
+	return f.providers[0].Voices(ctx)
+}
+
+func (f *fallbackTTS) Synthesize(ctx context.Context, text string, opts TTSOptions) (*TTSAudio, error) {
+	var errs chainError
+	for _, provider := range f.providers {
+		audio, err := provider.Synthesize(ctx, text, opts)
+		if err == nil {
+			return audio, nil
+		}
+		// Время вышло или запрос отменен - запасные провайдеры уже не помогут
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("TTS %s: %w", provider.Name(), ctx.Err())
+		}
+		log.Printf("⚠️ TTS %s не справился: %v", provider.Name(), err)
+		errs = append(errs, fmt.Errorf("%s: %w", provider.Name(), err))
+	}
+	return nil, fmt.Errorf("все TTS провайдеры вернули ошибку: %w", errs)
+}
+
+// elevenLabsTTS синтезирует речь через ElevenLabs Text-to-Speech
+type elevenLabsTTS struct {
+	apiKey       string
+	voiceID      string
+	model        string
+	outputFormat string // opus_* - сразу OGG/Opus для голосовых, mp3_* - MP3
+
+	// Список голосов меняется редко, поэтому кэшируется на voicesTTL
+	voicesMu sync.Mutex
+	voices   []TTSVoice
+	voicesAt time.Time
+}
+
+// voicesTTL - сколько хранится список голосов ElevenLabs
+const voicesTTL = 10 * time.Minute
+
+type ElevenLabsRequest struct {
+	Text          string                   `json:"text"`
+	ModelID       string                   `json:"model_id"`
+	VoiceSettings *ElevenLabsVoiceSettings `json:"voice_settings,omitempty"`
+}
+
+// ElevenLabsVoiceSettings - настройки голоса. Незаданные поля берутся из настроек голоса
+type ElevenLabsVoiceSettings struct {
+	Stability       *float64 `json:"stability,omitempty"`
+	SimilarityBoost *float64 `json:"similarity_boost,omitempty"`
+	Speed           *float64 `json:"speed,omitempty"`
+}
+
+func (e *elevenLabsTTS) Name() string { return "elevenlabs" }
+
+func (e *elevenLabsTTS) Identity(opts TTSOptions) string {
+	return strings.Join([]string{e.Name(), opts.voiceFor(e.Name(), e.voiceID), e.model, e.outputFormat,
+		formatOption(opts.Stability), formatOption(opts.Similarity), formatOption(opts.Speed)}, "|")
+}
+
+// Voices загружает голоса аккаунта ElevenLabs
+func (e *elevenLabsTTS) Voices(ctx context.Context) ([]TTSVoice, error) {
+	e.voicesMu.Lock()
+	defer e.voicesMu.Unlock()
+
+	if e.voices != nil && time.Since(e.voicesAt) < voicesTTL {
+		return e.voices, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://api.elevenlabs.io/v1/voices", nil)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка создания запроса: %v", err)
+	}
+	req.Header.Set("xi-api-key", e.apiKey)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка получения голосов: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newAPIStatusError(resp)
+	}
+
+	var result struct {
+		Voices []struct {
+			VoiceID string `json:"voice_id"`
+			Name    string `json:"name"`
+		} `json:"voices"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("ошибка разбора списка голосов: %v", err)
+	}
+
+	voices := make([]TTSVoice, 0, len(result.Voices))
+	for _, v := range result.Voices {
+		voices = append(voices, TTSVoice{ID: v.VoiceID, Name: v.Name})
+	}
+	e.voices = voices
+	e.voicesAt = time.Now()
+	return voices, nil
+}
+
+func (e *elevenLabsTTS) Synthesize(ctx context.Context, text string, opts TTSOptions) (*TTSAudio, error) {
+	url := fmt.Sprintf("https://api.elevenlabs.io/v1/text-to-speech/%s?output_format=%s",
+		opts.voiceFor(e.Name(), e.voiceID), e.outputFormat)
+
+	requestBody := ElevenLabsRequest{
+		Text:    text,
+		ModelID: e.model,
+	}
+	if opts.Stability != nil || opts.Similarity != nil || opts.Speed != nil {
+		requestBody.VoiceSettings = &ElevenLabsVoiceSettings{
+			Stability:       opts.Stability,
+			SimilarityBoost: opts.Similarity,
+			Speed:           opts.Speed,
+		}
+	}
+
+	jsonData, err := json.Marshal(requestBody)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка создания JSON: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("ошибка создания запроса: %v", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("xi-api-key", e.apiKey)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка отправки запроса: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newAPIStatusError(resp)
+	}
+
+	audioData, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения аудио: %v", err)
+	}
+
+	format := "mp3"
+	if strings.HasPrefix(e.outputFormat, "opus") {
+		format = "ogg"
+	}
+	return &TTSAudio{Data: audioData, Format: format, Provider: e.Name()}, nil
+}
+
+// openAITTS синтезирует речь через OpenAI audio/speech
+type openAITTS struct {
+	client *openai.Client
+	model  string
+	voice  string
+}
+
+func (o *openAITTS) Name() string { return "openai" }
+
+// Identity учитывает только голос и скорость: стабильность и похожесть OpenAI не поддерживает
+func (o *openAITTS) Identity(opts TTSOptions) string {
+	return strings.Join([]string{o.Name(), opts.voiceFor(o.Name(), o.voice), o.model, "opus",
+		formatOption(opts.Speed)}, "|")
+}
+
+// openAIVoices - встроенные голоса OpenAI TTS
+var openAIVoices = []TTSVoice{
+	{ID: "alloy", Name: "Alloy"},
+	{ID: "ash", Name: "Ash"},
+	{ID: "coral", Name: "Coral"},
+	{ID: "echo", Name: "Echo"},
+	{ID: "fable", Name: "Fable"},
+	{ID: "nova", Name: "Nova"},
+	{ID: "onyx", Name: "Onyx"},
+	{ID: "sage", Name: "Sage"},
+	{ID: "shimmer", Name: "Shimmer"},
+}
+
+func (o *openAITTS) Voices(ctx context.Context) ([]TTSVoice, error) {
+	return openAIVoices, nil
+}
+
+func (o *openAITTS) Synthesize(ctx context.Context, text string, opts TTSOptions) (*TTSAudio, error) {
+	request := openai.CreateSpeechRequest{
+		Model:          openai.SpeechModel(o.model),
+		Input:          text,
+		Voice:          openai.SpeechVoice(opts.voiceFor(o.Name(), o.voice)),
+		ResponseFormat: openai.SpeechResponseFormatOpus, // OGG/Opus - формат голосовых Telegram
+	}
+	if opts.Speed != nil {
+		request.Speed = *opts.Speed
+	}
+
+	resp, err := o.client.CreateSpeech(ctx, request)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка OpenAI TTS: %w", err)
+	}
+	defer resp.Close()
+
+	audioData, err := io.ReadAll(resp)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения аудио: %v", err)
+	}
+
+	return &TTSAudio{Data: audioData, Format: "ogg", Provider: o.Name()}, nil
+}
+
+// localTTS запускает локальный движок (piper, espeak-ng) как подпроцесс.
+// Текст передается на stdin. Если в команде есть {output}, он заменяется
+// путем к временному файлу, иначе аудио читается из stdout
+type localTTS struct {
+	command []string
+	format  string
+}
+
+func (l *localTTS) Name() string { return "local" }
+
+// Identity не зависит от настроек: локальный движок настраивается только командой
+func (l *localTTS) Identity(opts TTSOptions) string {
+	return strings.Join([]string{l.Name(), strings.Join(l.command, " "), l.format}, "|")
+}
+
+// Voices - выбора голоса нет, голос задается в TTS_LOCAL_COMMAND
+func (l *localTTS) Voices(ctx context.Context) ([]TTSVoice, error) {
+	return nil, nil
+}
+
+func (l *localTTS) Synthesize(ctx context.Context, text string, opts TTSOptions) (*TTSAudio, error) {
+	outFile, err := os.CreateTemp(tempDir, "tts-local-*."+l.format)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка создания файла: %v", err)
+	}
+	outPath := outFile.Name()
+	outFile.Close()
+	defer os.Remove(outPath)
+
+	usesOutputFile := false
+	args := make([]string, len(l.command))
+	for i, arg := range l.command {
+		if strings.Contains(arg, "{output}") {
+			usesOutputFile = true
+			arg = strings.ReplaceAll(arg, "{output}", outPath)
+		}
+		args[i] = arg
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = strings.NewReader(text)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ошибка локального TTS (%s): %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+
+	audioData := stdout.Bytes()
+	if usesOutputFile {
+		audioData, err = os.ReadFile(outPath)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка чтения аудио: %v", err)
+		}
+	}
+
+	if len(audioData) == 0 {
+		return nil, fmt.Errorf("локальный TTS (%s) вернул пустое аудио", args[0])
+	}
+
+	return &TTSAudio{Data: audioData, Format: l.format, Provider: l.Name()}, nil
+}
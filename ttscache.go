@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// TTSCache хранит готовые голосовые в таблице tts_cache. Ключ - хэш текста вместе
+// с голосом, моделью и настройками провайдера, поэтому смена голоса не отдает старое аудио.
+// Общий размер ограничен maxBytes, при переполнении удаляются давно не использованные записи
+type TTSCache struct {
+	maxBytes int64
+}
+
+// newTTSCacheFromConfig включает кэш (TTS_CACHE) с лимитом TTS_CACHE_MAX_MB. nil - кэш выключен
+func newTTSCacheFromConfig() *TTSCache {
+	if !getEnvBool("TTS_CACHE", true) {
+		log.Printf("🗄 Кэш озвучивания выключен")
+		return nil
+	}
+	c := &TTSCache{maxBytes: int64(getEnvFloat("TTS_CACHE_MAX_MB", 100) * 1024 * 1024)}
+	log.Printf("🗄 Кэш озвучивания: до %d МБ", c.maxBytes/1024/1024)
+	return c
+}
+
+// ttsCacheKey - ключ кэша: identity провайдера (голос, модель, формат), дополнительные
+// настройки (например, склейка частей) и сам текст
+func ttsCacheKey(identity, settings, text string) string {
+	sum := sha256.Sum256([]byte(identity + "\x00" + settings + "\x00" + text))
+	return hex.EncodeToString(sum[:])
+}
+
+// cacheTimeFormat - метка времени с миллисекундами, чтобы LRU различал записи одной секунды
+const cacheTimeFormat = "2006-01-02 15:04:05.000"
+
+// Get возвращает голосовое из кэша и отмечает его использование
+func (c *TTSCache) Get(key string) (*TTSAudio, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	audio := &TTSAudio{CacheKey: key}
+	var durationMs int64
+	var fileID sql.NullString
+	err := db.QueryRow(`SELECT provider, format, duration_ms, data, file_id FROM tts_cache WHERE key = ?`, key).
+		Scan(&audio.Provider, &audio.Format, &durationMs, &audio.Data, &fileID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("⚠️ Ошибка чтения кэша озвучивания: %v", err)
+		}
+		return nil, false
+	}
+	audio.Duration = time.Duration(durationMs) * time.Millisecond
+	audio.FileID = fileID.String
+
+	_, err = db.Exec(`UPDATE tts_cache SET last_used_at = ?, hits = hits + 1 WHERE key = ?`,
+		time.Now().UTC().Format(cacheTimeFormat), key)
+	if err != nil {
+		log.Printf("⚠️ Ошибка обновления кэша озвучивания: %v", err)
+	}
+	return audio, true
+}
+
+// Put сохраняет голосовое и удаляет старые записи сверх лимита размера
+func (c *TTSCache) Put(key string, audio *TTSAudio) {
+	if c == nil || int64(len(audio.Data)) > c.maxBytes {
+		return
+	}
+	audio.CacheKey = key
+
+	now := time.Now().UTC().Format(cacheTimeFormat)
+	_, err := db.Exec(`
+		INSERT INTO tts_cache (key, provider, format, duration_ms, data, size, created_at, last_used_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(key) DO UPDATE SET
+			provider = excluded.provider, format = excluded.format, duration_ms = excluded.duration_ms,
+			data = excluded.data, size = excluded.size, file_id = NULL, last_used_at = excluded.last_used_at`,
+		key, audio.Provider, audio.Format, audio.Duration.Milliseconds(), audio.Data, len(audio.Data), now, now)
+	if err != nil {
+		log.Printf("⚠️ Ошибка записи в кэш озвучивания: %v", err)
+		return
+	}
+
+	if err := c.evict(); err != nil {
+		log.Printf("⚠️ %v", err)
+	}
+}
+
+// SetFileID запоминает file_id отправленного голосового, чтобы в следующий раз не загружать его заново
+func (c *TTSCache) SetFileID(key, fileID string) {
+	if c == nil || key == "" || fileID == "" {
+		return
+	}
+	if _, err := db.Exec(`UPDATE tts_cache SET file_id = ? WHERE key = ?`, fileID, key); err != nil {
+		log.Printf("⚠️ Ошибка записи file_id в кэш озвучивания: %v", err)
+	}
+}
+
+// ForgetFileID сбрасывает file_id, который Telegram больше не принимает
+func (c *TTSCache) ForgetFileID(key string) {
+	if c == nil || key == "" {
+		return
+	}
+	if _, err := db.Exec(`UPDATE tts_cache SET file_id = NULL WHERE key = ?`, key); err != nil {
+		log.Printf("⚠️ Ошибка сброса file_id в кэше озвучивания: %v", err)
+	}
+}
+
+// evict удаляет давно не использованные записи, пока кэш не уложится в maxBytes
+func (c *TTSCache) evict() error {
+	result, err := db.Exec(`
+		DELETE FROM tts_cache WHERE key IN (
+			SELECT key FROM (
+				SELECT key, SUM(size) OVER (ORDER BY last_used_at DESC, key) AS total FROM tts_cache
+			) WHERE total > ?
+		)`, c.maxBytes)
+	if err != nil {
+		return fmt.Errorf("ошибка очистки кэша озвучивания: %v", err)
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		log.Printf("🗄 Из кэша озвучивания удалено записей: %d", n)
+	}
+	return nil
+}
+
+// cacheableBy проверяет, что аудио синтезировал провайдер из identity, а не запасной:
+// голос запасного провайдера нельзя отдавать по ключу основного
+func cacheableBy(identity string, audio *TTSAudio) bool {
+	return strings.HasPrefix(identity, audio.Provider+"|")
+}
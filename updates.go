@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// UpdateSource - источник обновлений Telegram: long polling или webhook.
+// Оба режима отдают обновления в один канал, дальше они обрабатываются одинаково
+type UpdateSource interface {
+	Name() string
+	Updates() tgbotapi.UpdatesChannel
+	Stop() // Прекращает прием обновлений и закрывает канал
+}
+
+// newUpdateSourceFromConfig выбирает режим получения обновлений по BOT_MODE
+func newUpdateSourceFromConfig(bot *tgbotapi.BotAPI) (UpdateSource, error) {
+	switch mode := strings.ToLower(getEnv("BOT_MODE", "polling")); mode {
+	case "polling":
+		return newPollingSource(bot)
+	case "webhook":
+		return newWebhookSource(bot, webhookConfigFromEnv())
+	default:
+		return nil, fmt.Errorf("неизвестный режим BOT_MODE %q (polling или webhook)", mode)
+	}
+}
+
+// allowedUpdates - типы обновлений, которые нужны боту: сообщения и нажатия кнопок (/settings)
+var allowedUpdates = []string{"message", "callback_query"}
+
+// --- Long polling ---
+
+type pollingSource struct {
+	bot     *tgbotapi.BotAPI
+	updates tgbotapi.UpdatesChannel
+	once    sync.Once
+}
+
+func newPollingSource(bot *tgbotapi.BotAPI) (*pollingSource, error) {
+	// Пока установлен webhook, getUpdates не работает - снимаем его
+	if _, err := bot.Request(tgbotapi.DeleteWebhookConfig{}); err != nil {
+		return nil, fmt.Errorf("ошибка удаления webhook: %v", err)
+	}
+
+	u := tgbotapi.NewUpdate(0)
+	u.Timeout = 60
+	u.AllowedUpdates = allowedUpdates
+
+	return &pollingSource{bot: bot, updates: bot.GetUpdatesChan(u)}, nil
+}
+
+func (s *pollingSource) Name() string { return "long polling" }
+
+func (s *pollingSource) Updates() tgbotapi.UpdatesChannel { return s.updates }
+
+// Stop останавливает опрос. Канал закроется после завершения текущего запроса getUpdates
+func (s *pollingSource) Stop() {
+	s.once.Do(s.bot.StopReceivingUpdates)
+}
+
+// --- Webhook ---
+
+// webhookConfig - настройки встроенного сервера для webhook
+type webhookConfig struct {
+	URL        string // Публичный адрес, на который Telegram отправляет обновления
+	Path       string
+	Listen     string
+	Secret     string // Проверяется в заголовке X-Telegram-Bot-Api-Secret-Token
+	CertFile   string // Сертификат и ключ для HTTPS, пусто - HTTP (TLS на прокси)
+	KeyFile    string
+	SelfSigned bool // Загрузить сертификат в Telegram при setWebhook
+	// Снимать webhook при остановке. При обновлении без простоя новый экземпляр
+	// регистрирует webhook раньше, чем останавливается старый, поэтому по умолчанию выключено
+	DeleteOnStop bool
+}
+
+// webhookConfigFromEnv читает настройки webhook из окружения.
+// На Render адрес сервиса берется из RENDER_EXTERNAL_URL, порт - из PORT
+func webhookConfigFromEnv() webhookConfig {
+	return webhookConfig{
+		URL:        getEnv("WEBHOOK_URL", getEnv("RENDER_EXTERNAL_URL", "")),
+		Path:       getEnv("WEBHOOK_PATH", "/telegram/webhook"),
+		Listen:     getEnv("WEBHOOK_LISTEN", ":"+getEnv("PORT", "8080")),
+		Secret:     getEnv("WEBHOOK_SECRET", ""),
+		CertFile:   getEnv("WEBHOOK_CERT", ""),
+		KeyFile:    getEnv("WEBHOOK_KEY", ""),
+		SelfSigned: getEnvBool("WEBHOOK_SELF_SIGNED", false),
+
+		DeleteOnStop: getEnvBool("WEBHOOK_DELETE_ON_STOP", false),
+	}
+}
+
+type webhookSource struct {
+	bot      *tgbotapi.BotAPI
+	config   webhookConfig
+	server   *http.Server
+	updates  chan tgbotapi.Update
+	stopping chan struct{} // Закрывается в начале Stop
+	once     sync.Once
+}
+
+// newWebhookSource запускает HTTP(S) сервер и регистрирует webhook в Telegram
+func newWebhookSource(bot *tgbotapi.BotAPI, config webhookConfig) (*webhookSource, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("для режима webhook нужен WEBHOOK_URL")
+	}
+	if !strings.HasPrefix(config.Path, "/") {
+		config.Path = "/" + config.Path
+	}
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		return nil, fmt.Errorf("WEBHOOK_CERT и WEBHOOK_KEY задаются вместе")
+	}
+
+	if config.Secret == "" {
+		// Секрет нужен только на время жизни webhook, который и так переустанавливается при запуске
+		secret, err := randomToken()
+		if err != nil {
+			return nil, err
+		}
+		config.Secret = secret
+		log.Printf("⚠️  WEBHOOK_SECRET не задан, сгенерирован случайный секрет")
+	}
+
+	s := &webhookSource{
+		bot:      bot,
+		config:   config,
+		updates:  make(chan tgbotapi.Update, bot.Buffer),
+		stopping: make(chan struct{}),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(config.Path, s.handleWebhook)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	s.server = &http.Server{
+		Addr:              config.Listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+	}
+
+	go func() {
+		var err error
+		if config.CertFile != "" {
+			err = s.server.ListenAndServeTLS(config.CertFile, config.KeyFile)
+		} else {
+			err = s.server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("❌ Ошибка webhook-сервера: %v", err)
+		}
+	}()
+
+	if err := s.setWebhook(); err != nil {
+		s.server.Close()
+		return nil, err
+	}
+
+	log.Printf("🌐 Webhook: %s, сервер слушает %s", s.webhookURL(), config.Listen)
+	return s, nil
+}
+
+func (s *webhookSource) Name() string { return "webhook" }
+
+func (s *webhookSource) Updates() tgbotapi.UpdatesChannel { return s.updates }
+
+// webhookURL - полный адрес webhook
+func (s *webhookSource) webhookURL() string {
+	return strings.TrimRight(s.config.URL, "/") + s.config.Path
+}
+
+// setWebhook регистрирует webhook с секретом.
+// tgbotapi v5.5.1 не знает про secret_token, поэтому параметры собираются вручную
+func (s *webhookSource) setWebhook() error {
+	params := tgbotapi.Params{
+		"url":          s.webhookURL(),
+		"secret_token": s.config.Secret,
+	}
+	if err := params.AddInterface("allowed_updates", allowedUpdates); err != nil {
+		return err
+	}
+
+	var err error
+	if s.config.SelfSigned && s.config.CertFile != "" {
+		_, err = s.bot.UploadFiles("setWebhook", params, []tgbotapi.RequestFile{
+			{Name: "certificate", Data: tgbotapi.FilePath(s.config.CertFile)},
+		})
+	} else {
+		_, err = s.bot.MakeRequest("setWebhook", params)
+	}
+	if err != nil {
+		return fmt.Errorf("ошибка установки webhook: %v", err)
+	}
+	return nil
+}
+
+// handleWebhook принимает обновление от Telegram и проверяет секрет
+func (s *webhookSource) handleWebhook(w http.ResponseWriter, r *http.Request) {
+	token := r.Header.Get("X-Telegram-Bot-Api-Secret-Token")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.config.Secret)) != 1 {
+		log.Printf("🚫 Webhook: запрос с неверным секретом от %s", r.RemoteAddr)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	update, err := s.bot.HandleUpdate(r)
+	if err != nil {
+		log.Printf("Webhook: некорректное обновление: %v", err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	select {
+	case s.updates <- *update:
+	case <-s.stopping:
+		// Бот останавливается: Telegram повторит обновление позже
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+	}
+}
+
+// Stop дожидается завершения текущих запросов и закрывает канал. Webhook остается
+// в Telegram: его уже мог переустановить новый экземпляр бота (WEBHOOK_DELETE_ON_STOP)
+func (s *webhookSource) Stop() {
+	s.once.Do(func() {
+		close(s.stopping)
+
+		if s.config.DeleteOnStop {
+			s.deleteWebhook()
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := s.server.Shutdown(ctx); err != nil {
+			log.Printf("⚠️ Ошибка остановки webhook-сервера: %v", err)
+		}
+
+		// После Shutdown обработчики уже не пишут в канал
+		close(s.updates)
+	})
+}
+
+// deleteWebhook снимает webhook, если он все еще указывает на адрес этого экземпляра
+func (s *webhookSource) deleteWebhook() {
+	info, err := s.bot.GetWebhookInfo()
+	if err != nil {
+		log.Printf("⚠️ Ошибка получения webhook: %v", err)
+		return
+	}
+	if info.URL != s.webhookURL() {
+		log.Printf("🌐 Webhook уже указывает на %q, не снимаю", info.URL)
+		return
+	}
+	if _, err := s.bot.Request(tgbotapi.DeleteWebhookConfig{}); err != nil {
+		log.Printf("⚠️ Ошибка удаления webhook: %v", err)
+		return
+	}
+	log.Printf("🌐 Webhook снят")
+}
+
+// randomToken возвращает случайную строку для секрета webhook
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("ошибка генерации секрета: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}